@@ -38,6 +38,15 @@ from brood.models import (
     SubscriptionPlan,
     KVBrood,
     Application,
+    IdempotencyKey,
+    AuditEvent,
+    UserDeletionConfirmation,
+    LoginHistory,
+    PasswordHistory,
+    ServiceAccount,
+    ApplicationSlug,
+    ApplicationTransferRequest,
+    WebAuthnCredential,
 )
 from brood.resources.models import (
     Resource,
@@ -63,6 +72,15 @@ def include_symbol(tablename, schema):
         ResourcePermission.__tablename__,
         ResourceHolderPermission.__tablename__,
         Application.__tablename__,
+        IdempotencyKey.__tablename__,
+        AuditEvent.__tablename__,
+        UserDeletionConfirmation.__tablename__,
+        LoginHistory.__tablename__,
+        PasswordHistory.__tablename__,
+        ServiceAccount.__tablename__,
+        ApplicationSlug.__tablename__,
+        ApplicationTransferRequest.__tablename__,
+        WebAuthnCredential.__tablename__,
     }
 
 
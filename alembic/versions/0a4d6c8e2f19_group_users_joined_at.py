@@ -0,0 +1,33 @@
+"""Time users joined groups
+
+Revision ID: 0a4d6c8e2f19
+Revises: f2c7b9e1d034
+Create Date: 2026-10-15 13:02:26.775410
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = "0a4d6c8e2f19"
+down_revision = "f2c7b9e1d034"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    # Existing memberships get time of migration as we have no record when they were created
+    op.add_column(
+        "group_users",
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+    )
+
+
+def downgrade():
+    op.drop_column("group_users", "created_at")
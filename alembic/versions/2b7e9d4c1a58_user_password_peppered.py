@@ -0,0 +1,29 @@
+"""Users password pepper flag
+
+Revision ID: 2b7e9d4c1a58
+Revises: 8f2c6b1d4a37
+Create Date: 2026-10-15 14:41:27.305148
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = "2b7e9d4c1a58"
+down_revision = "8f2c6b1d4a37"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "users",
+        sa.Column(
+            "password_peppered", sa.Boolean(), server_default=sa.false(), nullable=False
+        ),
+    )
+
+
+def downgrade():
+    op.drop_column("users", "password_peppered")
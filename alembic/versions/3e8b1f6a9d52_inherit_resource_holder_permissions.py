@@ -0,0 +1,27 @@
+"""Inherit flag for resource holder permissions
+
+Revision ID: 3e8b1f6a9d52
+Revises: 0a4d6c8e2f19
+Create Date: 2026-10-15 12:41:27.318204
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = "3e8b1f6a9d52"
+down_revision = "0a4d6c8e2f19"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "resource_holder_permissions",
+        sa.Column("inherit", sa.Boolean(), server_default=sa.false(), nullable=False),
+    )
+
+
+def downgrade():
+    op.drop_column("resource_holder_permissions", "inherit")
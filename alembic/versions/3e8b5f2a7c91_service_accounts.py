@@ -0,0 +1,73 @@
+"""Service accounts
+
+Revision ID: 3e8b5f2a7c91
+Revises: 9a3c5e7f1b24
+Create Date: 2026-10-15 16:32:47.508214
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "3e8b5f2a7c91"
+down_revision = "9a3c5e7f1b24"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.create_table(
+        "service_accounts",
+        sa.Column("id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("name", sa.String(), nullable=False),
+        sa.Column("application_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["application_id"],
+            ["applications.id"],
+            name="fk_service_accounts_application_id",
+            ondelete="CASCADE",
+        ),
+        sa.PrimaryKeyConstraint("id", name=op.f("pk_service_accounts")),
+        sa.UniqueConstraint("id", name=op.f("uq_service_accounts_id")),
+    )
+    op.create_index(
+        op.f("ix_service_accounts_application_id"),
+        "service_accounts",
+        ["application_id"],
+        unique=False,
+    )
+    op.add_column(
+        "tokens",
+        sa.Column("service_account_id", postgresql.UUID(as_uuid=True), nullable=True),
+    )
+    op.create_foreign_key(
+        "fk_tokens_service_account_id",
+        "tokens",
+        "service_accounts",
+        ["service_account_id"],
+        ["id"],
+        ondelete="CASCADE",
+    )
+    op.create_index(
+        op.f("ix_tokens_service_account_id"),
+        "tokens",
+        ["service_account_id"],
+        unique=False,
+    )
+
+
+def downgrade():
+    op.drop_index(op.f("ix_tokens_service_account_id"), table_name="tokens")
+    op.drop_constraint("fk_tokens_service_account_id", "tokens", type_="foreignkey")
+    op.drop_column("tokens", "service_account_id")
+    op.drop_index(
+        op.f("ix_service_accounts_application_id"), table_name="service_accounts"
+    )
+    op.drop_table("service_accounts")
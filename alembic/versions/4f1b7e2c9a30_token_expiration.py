@@ -0,0 +1,27 @@
+"""Token expiration
+
+Revision ID: 4f1b7e2c9a30
+Revises: 6ae8af4e1863
+Create Date: 2026-10-15 09:12:41.337905
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = "4f1b7e2c9a30"
+down_revision = "6ae8af4e1863"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "tokens",
+        sa.Column("expires_at", sa.DateTime(timezone=True), nullable=True),
+    )
+
+
+def downgrade():
+    op.drop_column("tokens", "expires_at")
@@ -0,0 +1,53 @@
+"""User deletion confirmations
+
+Revision ID: 5c9d3e7a2b86
+Revises: 7b4e2a9c1f63
+Create Date: 2026-10-15 13:32:40.619253
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "5c9d3e7a2b86"
+down_revision = "7b4e2a9c1f63"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.create_table(
+        "user_deletion_confirmations",
+        sa.Column("id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("user_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("expires_at", sa.DateTime(timezone=True), nullable=False),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["user_id"],
+            ["users.id"],
+            name="fk_user_deletion_confirmations_user_id",
+            ondelete="CASCADE",
+        ),
+        sa.PrimaryKeyConstraint("id", name=op.f("pk_user_deletion_confirmations")),
+        sa.UniqueConstraint("id", name=op.f("uq_user_deletion_confirmations_id")),
+    )
+    op.create_index(
+        op.f("ix_user_deletion_confirmations_user_id"),
+        "user_deletion_confirmations",
+        ["user_id"],
+        unique=False,
+    )
+
+
+def downgrade():
+    op.drop_index(
+        op.f("ix_user_deletion_confirmations_user_id"),
+        table_name="user_deletion_confirmations",
+    )
+    op.drop_table("user_deletion_confirmations")
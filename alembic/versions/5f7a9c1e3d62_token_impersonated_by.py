@@ -0,0 +1,36 @@
+"""Impersonation tokens
+
+Revision ID: 5f7a9c1e3d62
+Revises: b6f4d2a9e153
+Create Date: 2026-10-15 17:58:36.214907
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "5f7a9c1e3d62"
+down_revision = "b6f4d2a9e153"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "tokens",
+        sa.Column("impersonated_by", postgresql.UUID(as_uuid=True), nullable=True),
+    )
+    op.create_foreign_key(
+        "fk_tokens_impersonated_by",
+        "tokens",
+        "users",
+        ["impersonated_by"],
+        ["id"],
+        ondelete="CASCADE",
+    )
+
+
+def downgrade():
+    op.drop_constraint("fk_tokens_impersonated_by", "tokens", type_="foreignkey")
+    op.drop_column("tokens", "impersonated_by")
@@ -0,0 +1,77 @@
+"""Provider-aware normalized emails
+
+Revision ID: 6d1a8f3e5c74
+Revises: 2b7e9d4c1a58
+Create Date: 2026-10-15 15:02:51.774362
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = "6d1a8f3e5c74"
+down_revision = "2b7e9d4c1a58"
+branch_labels = None
+depends_on = None
+
+SUBADDRESS_EMAIL_DOMAINS = {"gmail.com", "googlemail.com", "outlook.com", "hotmail.com"}
+DOTLESS_EMAIL_DOMAINS = {"gmail.com", "googlemail.com"}
+
+UPDATE_NORMALIZED_EMAIL = sa.text(
+    "UPDATE users SET normalized_email = :normalized_email WHERE id = :id"
+)
+
+
+def normalize_email(email: str) -> str:
+    # Copy of brood.actions.normalize_email at the time of migration
+    segments = email.lower().split("@")
+    hostname = segments[-1]
+    normalized_username = "@".join(segments[:-1])
+    if hostname in SUBADDRESS_EMAIL_DOMAINS:
+        normalized_username = normalized_username.split("+")[0]
+    if hostname in DOTLESS_EMAIL_DOMAINS:
+        normalized_username = normalized_username.replace(".", "")
+    return f"{normalized_username}@{hostname}"
+
+
+def upgrade():
+    connection = op.get_bind()
+    users = connection.execute(
+        sa.text(
+            "SELECT id, email, normalized_email, application_id FROM users "
+            "ORDER BY created_at"
+        )
+    ).fetchall()
+
+    taken = {(user.normalized_email, user.application_id) for user in users}
+    for user in users:
+        normalized_email = normalize_email(user.email)
+        if normalized_email == user.normalized_email:
+            continue
+        # Previously distinct values could collide only by case of the domain, the
+        # earlier user gets the new value and the later one keeps the old one
+        if (normalized_email, user.application_id) in taken:
+            print(
+                f"Skipping user {user.id}, normalized email {normalized_email} is taken"
+            )
+            continue
+        connection.execute(
+            UPDATE_NORMALIZED_EMAIL,
+            {"normalized_email": normalized_email, "id": user.id},
+        )
+        taken.discard((user.normalized_email, user.application_id))
+        taken.add((normalized_email, user.application_id))
+
+
+def downgrade():
+    # Previous normalization removed dots and subaddresses for all domains
+    connection = op.get_bind()
+    users = connection.execute(sa.text("SELECT id, email FROM users")).fetchall()
+    for user in users:
+        segments = user.email.split("@")
+        username = "".join("@".join(segments[:-1]).split(".")).split("+")[0].lower()
+        connection.execute(
+            UPDATE_NORMALIZED_EMAIL,
+            {"normalized_email": f"{username}@{segments[-1]}", "id": user.id},
+        )
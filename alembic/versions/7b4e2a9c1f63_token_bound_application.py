@@ -0,0 +1,39 @@
+"""Token bound application
+
+Revision ID: 7b4e2a9c1f63
+Revises: 3e8b1f6a9d52
+Create Date: 2026-10-15 13:05:12.470918
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+
+# revision identifiers, used by Alembic.
+revision = "7b4e2a9c1f63"
+down_revision = "3e8b1f6a9d52"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "tokens",
+        sa.Column(
+            "bound_application_id", postgresql.UUID(as_uuid=True), nullable=True
+        ),
+    )
+    op.create_foreign_key(
+        "fk_tokens_bound_application_id",
+        "tokens",
+        "applications",
+        ["bound_application_id"],
+        ["id"],
+        ondelete="CASCADE",
+    )
+
+
+def downgrade():
+    op.drop_constraint("fk_tokens_bound_application_id", "tokens", type_="foreignkey")
+    op.drop_column("tokens", "bound_application_id")
@@ -0,0 +1,43 @@
+"""Scopes and derived tokens for token exchange
+
+Revision ID: 7d2e9b4c6a18
+Revises: c4e8a1b7d095
+Create Date: 2026-10-15 19:05:27.318640
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "7d2e9b4c6a18"
+down_revision = "c4e8a1b7d095"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "tokens",
+        sa.Column("scopes", postgresql.JSONB(astext_type=sa.Text()), nullable=True),
+    )
+    op.add_column(
+        "tokens",
+        sa.Column(
+            "derived_from_token_id", postgresql.UUID(as_uuid=True), nullable=True
+        ),
+    )
+    op.create_foreign_key(
+        "fk_tokens_derived_from_token_id",
+        "tokens",
+        "tokens",
+        ["derived_from_token_id"],
+        ["id"],
+        ondelete="CASCADE",
+    )
+
+
+def downgrade():
+    op.drop_constraint("fk_tokens_derived_from_token_id", "tokens", type_="foreignkey")
+    op.drop_column("tokens", "derived_from_token_id")
+    op.drop_column("tokens", "scopes")
@@ -0,0 +1,45 @@
+"""Notify about kv_brood changes
+
+Revision ID: 8f2c6b1d4a37
+Revises: 5c9d3e7a2b86
+Create Date: 2026-10-15 14:05:12.481906
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = "8f2c6b1d4a37"
+down_revision = "5c9d3e7a2b86"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.execute(
+        """
+        CREATE FUNCTION notify_kv_brood_change() RETURNS trigger AS $$
+        BEGIN
+            IF TG_OP = 'DELETE' THEN
+                PERFORM pg_notify('brood_config', OLD.kv_key);
+            ELSE
+                PERFORM pg_notify('brood_config', NEW.kv_key);
+            END IF;
+            RETURN NULL;
+        END;
+        $$ LANGUAGE plpgsql
+        """
+    )
+    op.execute(
+        """
+        CREATE TRIGGER kv_brood_change_notify
+        AFTER INSERT OR UPDATE OR DELETE ON kv_brood
+        FOR EACH ROW EXECUTE PROCEDURE notify_kv_brood_change()
+        """
+    )
+
+
+def downgrade():
+    op.execute("DROP TRIGGER kv_brood_change_notify ON kv_brood")
+    op.execute("DROP FUNCTION notify_kv_brood_change()")
@@ -0,0 +1,56 @@
+"""Login history
+
+Revision ID: 9a3c5e7f1b24
+Revises: 6d1a8f3e5c74
+Create Date: 2026-10-15 15:48:09.137520
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "9a3c5e7f1b24"
+down_revision = "6d1a8f3e5c74"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.create_table(
+        "login_history",
+        sa.Column("id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("user_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("ip", sa.String(length=45), nullable=True),
+        sa.Column("user_agent", sa.Text(), nullable=True),
+        sa.Column("success", sa.Boolean(), nullable=False),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["user_id"],
+            ["users.id"],
+            name="fk_login_history_user_id",
+            ondelete="CASCADE",
+        ),
+        sa.PrimaryKeyConstraint("id", name=op.f("pk_login_history")),
+        sa.UniqueConstraint("id", name=op.f("uq_login_history_id")),
+    )
+    op.create_index(
+        op.f("ix_login_history_user_id"), "login_history", ["user_id"], unique=False
+    )
+    op.create_index(
+        op.f("ix_login_history_created_at"),
+        "login_history",
+        ["created_at"],
+        unique=False,
+    )
+
+
+def downgrade():
+    op.drop_index(op.f("ix_login_history_created_at"), table_name="login_history")
+    op.drop_index(op.f("ix_login_history_user_id"), table_name="login_history")
+    op.drop_table("login_history")
@@ -0,0 +1,27 @@
+"""Token names
+
+Revision ID: a8f3d6e2b597
+Revises: e1b5c8d3f274
+Create Date: 2026-10-15 19:58:36.142907
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = "a8f3d6e2b597"
+down_revision = "e1b5c8d3f274"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column("tokens", sa.Column("name", sa.String(length=64), nullable=True))
+    op.create_unique_constraint(
+        op.f("uq_tokens_user_id"), "tokens", ["user_id", "name"]
+    )
+
+
+def downgrade():
+    op.drop_constraint(op.f("uq_tokens_user_id"), "tokens", type_="unique")
+    op.drop_column("tokens", "name")
@@ -0,0 +1,51 @@
+"""Application slugs
+
+Revision ID: b6f4d2a9e153
+Revises: 3e8b5f2a7c91
+Create Date: 2026-10-15 17:21:05.643190
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "b6f4d2a9e153"
+down_revision = "3e8b5f2a7c91"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.create_table(
+        "application_slugs",
+        sa.Column("slug", sa.String(), nullable=False),
+        sa.Column("application_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["application_id"],
+            ["applications.id"],
+            name="fk_application_slugs_application_id",
+            ondelete="CASCADE",
+        ),
+        sa.PrimaryKeyConstraint("slug", name=op.f("pk_application_slugs")),
+        sa.UniqueConstraint("slug", name=op.f("uq_application_slugs_slug")),
+    )
+    op.create_index(
+        op.f("ix_application_slugs_application_id"),
+        "application_slugs",
+        ["application_id"],
+        unique=False,
+    )
+
+
+def downgrade():
+    op.drop_index(
+        op.f("ix_application_slugs_application_id"), table_name="application_slugs"
+    )
+    op.drop_table("application_slugs")
@@ -0,0 +1,86 @@
+"""Admin flags for users and audit events
+
+Revision ID: b7d2f0c4e815
+Revises: 9c3e5d1a7b42
+Create Date: 2026-10-15 10:48:02.561730
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "b7d2f0c4e815"
+down_revision = "9c3e5d1a7b42"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "users",
+        sa.Column("is_admin", sa.Boolean(), server_default=sa.false(), nullable=False),
+    )
+    op.add_column(
+        "users",
+        sa.Column(
+            "is_super_admin", sa.Boolean(), server_default=sa.false(), nullable=False
+        ),
+    )
+
+    op.create_table(
+        "audit_events",
+        sa.Column("id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("event_type", sa.String(length=100), nullable=False),
+        sa.Column("actor_user_id", postgresql.UUID(as_uuid=True), nullable=True),
+        sa.Column("target_user_id", postgresql.UUID(as_uuid=True), nullable=True),
+        sa.Column("details", postgresql.JSONB(astext_type=sa.Text()), nullable=True),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["actor_user_id"],
+            ["users.id"],
+            name="fk_audit_events_actor_user_id",
+            ondelete="SET NULL",
+        ),
+        sa.ForeignKeyConstraint(
+            ["target_user_id"],
+            ["users.id"],
+            name="fk_audit_events_target_user_id",
+            ondelete="SET NULL",
+        ),
+        sa.PrimaryKeyConstraint("id", name=op.f("pk_audit_events")),
+        sa.UniqueConstraint("id", name=op.f("uq_audit_events_id")),
+    )
+    op.create_index(
+        op.f("ix_audit_events_event_type"),
+        "audit_events",
+        ["event_type"],
+        unique=False,
+    )
+    op.create_index(
+        op.f("ix_audit_events_actor_user_id"),
+        "audit_events",
+        ["actor_user_id"],
+        unique=False,
+    )
+    op.create_index(
+        op.f("ix_audit_events_target_user_id"),
+        "audit_events",
+        ["target_user_id"],
+        unique=False,
+    )
+
+
+def downgrade():
+    op.drop_index(op.f("ix_audit_events_target_user_id"), table_name="audit_events")
+    op.drop_index(op.f("ix_audit_events_actor_user_id"), table_name="audit_events")
+    op.drop_index(op.f("ix_audit_events_event_type"), table_name="audit_events")
+    op.drop_table("audit_events")
+
+    op.drop_column("users", "is_super_admin")
+    op.drop_column("users", "is_admin")
@@ -0,0 +1,74 @@
+"""Application transfer requests
+
+Revision ID: c4e8a1b7d095
+Revises: 5f7a9c1e3d62
+Create Date: 2026-10-15 18:40:12.905371
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "c4e8a1b7d095"
+down_revision = "5f7a9c1e3d62"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.create_table(
+        "application_transfer_requests",
+        sa.Column("id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("application_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("requester_user_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("new_owner_type", sa.String(), nullable=False),
+        sa.Column("new_owner_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("token", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("expires_at", sa.DateTime(timezone=True), nullable=False),
+        sa.Column("accepted_at", sa.DateTime(timezone=True), nullable=True),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["application_id"],
+            ["applications.id"],
+            name="fk_application_transfer_requests_application_id",
+            ondelete="CASCADE",
+        ),
+        sa.ForeignKeyConstraint(
+            ["requester_user_id"],
+            ["users.id"],
+            name="fk_application_transfer_requests_requester_user_id",
+            ondelete="CASCADE",
+        ),
+        sa.PrimaryKeyConstraint("id", name=op.f("pk_application_transfer_requests")),
+        sa.UniqueConstraint("id", name=op.f("uq_application_transfer_requests_id")),
+    )
+    op.create_index(
+        op.f("ix_application_transfer_requests_application_id"),
+        "application_transfer_requests",
+        ["application_id"],
+        unique=False,
+    )
+    op.create_index(
+        op.f("ix_application_transfer_requests_token"),
+        "application_transfer_requests",
+        ["token"],
+        unique=True,
+    )
+
+
+def downgrade():
+    op.drop_index(
+        op.f("ix_application_transfer_requests_token"),
+        table_name="application_transfer_requests",
+    )
+    op.drop_index(
+        op.f("ix_application_transfer_requests_application_id"),
+        table_name="application_transfer_requests",
+    )
+    op.drop_table("application_transfer_requests")
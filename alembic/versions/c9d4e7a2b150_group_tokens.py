@@ -0,0 +1,38 @@
+"""Group tokens
+
+Revision ID: c9d4e7a2b150
+Revises: f6c2a9e4d318
+Create Date: 2026-10-15 20:51:09.364182
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "c9d4e7a2b150"
+down_revision = "f6c2a9e4d318"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "tokens",
+        sa.Column("group_id", postgresql.UUID(as_uuid=True), nullable=True),
+    )
+    op.create_foreign_key(
+        "fk_tokens_group_id",
+        "tokens",
+        "groups",
+        ["group_id"],
+        ["id"],
+        ondelete="CASCADE",
+    )
+    op.create_index(op.f("ix_tokens_group_id"), "tokens", ["group_id"], unique=False)
+
+
+def downgrade():
+    op.drop_index(op.f("ix_tokens_group_id"), table_name="tokens")
+    op.drop_constraint("fk_tokens_group_id", "tokens", type_="foreignkey")
+    op.drop_column("tokens", "group_id")
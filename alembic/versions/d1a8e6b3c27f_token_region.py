@@ -0,0 +1,24 @@
+"""Token region
+
+Revision ID: d1a8e6b3c27f
+Revises: b7d2f0c4e815
+Create Date: 2026-10-15 11:21:47.902615
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = "d1a8e6b3c27f"
+down_revision = "b7d2f0c4e815"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column("tokens", sa.Column("region", sa.String(), nullable=True))
+
+
+def downgrade():
+    op.drop_column("tokens", "region")
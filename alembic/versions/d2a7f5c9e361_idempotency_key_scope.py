@@ -0,0 +1,68 @@
+"""Idempotency keys scoped by credential with in-flight reservation
+
+Revision ID: d2a7f5c9e361
+Revises: c9d4e7a2b150
+Create Date: 2026-10-15 21:14:38.905217
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "d2a7f5c9e361"
+down_revision = "c9d4e7a2b150"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    # Recorded responses are short-lived, they are dropped instead of being migrated
+    op.execute("DELETE FROM idempotency_keys")
+    op.drop_constraint(
+        op.f("uq_idempotency_keys_key"), "idempotency_keys", type_="unique"
+    )
+    op.drop_constraint(
+        "fk_idempotency_keys_user_id", "idempotency_keys", type_="foreignkey"
+    )
+    op.drop_column("idempotency_keys", "user_id")
+    op.add_column(
+        "idempotency_keys", sa.Column("scope", sa.String(length=64), nullable=False)
+    )
+    op.add_column(
+        "idempotency_keys",
+        sa.Column(
+            "response_headers", postgresql.JSONB(astext_type=sa.Text()), nullable=True
+        ),
+    )
+    op.alter_column("idempotency_keys", "response_status", nullable=True)
+    op.alter_column("idempotency_keys", "response_body", nullable=True)
+    op.create_unique_constraint(
+        op.f("uq_idempotency_keys_key"), "idempotency_keys", ["key", "scope"]
+    )
+
+
+def downgrade():
+    op.execute("DELETE FROM idempotency_keys")
+    op.drop_constraint(
+        op.f("uq_idempotency_keys_key"), "idempotency_keys", type_="unique"
+    )
+    op.alter_column("idempotency_keys", "response_body", nullable=False)
+    op.alter_column("idempotency_keys", "response_status", nullable=False)
+    op.drop_column("idempotency_keys", "response_headers")
+    op.drop_column("idempotency_keys", "scope")
+    op.add_column(
+        "idempotency_keys",
+        sa.Column("user_id", postgresql.UUID(as_uuid=True), nullable=True),
+    )
+    op.create_foreign_key(
+        "fk_idempotency_keys_user_id",
+        "idempotency_keys",
+        "users",
+        ["user_id"],
+        ["id"],
+        ondelete="CASCADE",
+    )
+    op.create_unique_constraint(
+        op.f("uq_idempotency_keys_key"), "idempotency_keys", ["key", "user_id"]
+    )
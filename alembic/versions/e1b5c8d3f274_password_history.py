@@ -0,0 +1,51 @@
+"""Password history
+
+Revision ID: e1b5c8d3f274
+Revises: 7d2e9b4c6a18
+Create Date: 2026-10-15 19:32:51.604218
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "e1b5c8d3f274"
+down_revision = "7d2e9b4c6a18"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.create_table(
+        "password_history",
+        sa.Column("id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("user_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("password_hash", sa.String(), nullable=False),
+        sa.Column("password_peppered", sa.Boolean(), nullable=False),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["user_id"],
+            ["users.id"],
+            name="fk_password_history_user_id",
+            ondelete="CASCADE",
+        ),
+        sa.PrimaryKeyConstraint("id", name=op.f("pk_password_history")),
+        sa.UniqueConstraint("id", name=op.f("uq_password_history_id")),
+    )
+    op.create_index(
+        op.f("ix_password_history_user_id"),
+        "password_history",
+        ["user_id"],
+        unique=False,
+    )
+
+
+def downgrade():
+    op.drop_index(op.f("ix_password_history_user_id"), table_name="password_history")
+    op.drop_table("password_history")
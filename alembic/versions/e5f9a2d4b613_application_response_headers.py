@@ -0,0 +1,31 @@
+"""Application response headers
+
+Revision ID: e5f9a2d4b613
+Revises: d1a8e6b3c27f
+Create Date: 2026-10-15 11:54:09.118342
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "e5f9a2d4b613"
+down_revision = "d1a8e6b3c27f"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "applications",
+        sa.Column(
+            "response_headers",
+            postgresql.JSONB(astext_type=sa.Text()),
+            nullable=True,
+        ),
+    )
+
+
+def downgrade():
+    op.drop_column("applications", "response_headers")
@@ -0,0 +1,33 @@
+"""Token names unique among active tokens only
+
+Revision ID: e7c1a4d8b296
+Revises: d2a7f5c9e361
+Create Date: 2026-10-15 21:52:17.384106
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = "e7c1a4d8b296"
+down_revision = "d2a7f5c9e361"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.drop_constraint("uq_tokens_user_id", "tokens", type_="unique")
+    op.create_index(
+        "uq_tokens_user_id_name_active",
+        "tokens",
+        ["user_id", "name"],
+        unique=True,
+        postgresql_where=sa.text("active"),
+    )
+
+
+def downgrade():
+    op.drop_index("uq_tokens_user_id_name_active", table_name="tokens")
+    # Revoked tokens could share names with active ones
+    op.execute("UPDATE tokens SET name = NULL WHERE NOT active")
+    op.create_unique_constraint("uq_tokens_user_id", "tokens", ["user_id", "name"])
@@ -0,0 +1,27 @@
+"""User profile
+
+Revision ID: f2c7b9e1d034
+Revises: e5f9a2d4b613
+Create Date: 2026-10-15 12:30:51.640127
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "f2c7b9e1d034"
+down_revision = "e5f9a2d4b613"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.add_column(
+        "users",
+        sa.Column("profile", postgresql.JSONB(astext_type=sa.Text()), nullable=True),
+    )
+
+
+def downgrade():
+    op.drop_column("users", "profile")
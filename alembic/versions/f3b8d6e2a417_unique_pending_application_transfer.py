@@ -0,0 +1,44 @@
+"""Only one pending transfer of application
+
+Revision ID: f3b8d6e2a417
+Revises: e7c1a4d8b296
+Create Date: 2026-10-15 23:18:42.507319
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = "f3b8d6e2a417"
+down_revision = "e7c1a4d8b296"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    # Expired transfers could not be accepted anymore, of concurrent ones latest is kept
+    op.execute(
+        "DELETE FROM application_transfer_requests "
+        "WHERE accepted_at IS NULL AND expires_at <= now()"
+    )
+    op.execute(
+        "DELETE FROM application_transfer_requests a "
+        "USING application_transfer_requests b "
+        "WHERE a.accepted_at IS NULL AND b.accepted_at IS NULL "
+        "AND a.application_id = b.application_id "
+        "AND (a.created_at, a.id) < (b.created_at, b.id)"
+    )
+    op.create_index(
+        "uq_application_transfer_requests_application_id_pending",
+        "application_transfer_requests",
+        ["application_id"],
+        unique=True,
+        postgresql_where=sa.text("accepted_at IS NULL"),
+    )
+
+
+def downgrade():
+    op.drop_index(
+        "uq_application_transfer_requests_application_id_pending",
+        table_name="application_transfer_requests",
+    )
@@ -0,0 +1,58 @@
+"""WebAuthn credentials
+
+Revision ID: f6c2a9e4d318
+Revises: a8f3d6e2b597
+Create Date: 2026-10-15 20:27:14.583106
+
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects import postgresql
+
+# revision identifiers, used by Alembic.
+revision = "f6c2a9e4d318"
+down_revision = "a8f3d6e2b597"
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    op.create_table(
+        "webauthn_credentials",
+        sa.Column("id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("user_id", postgresql.UUID(as_uuid=True), nullable=False),
+        sa.Column("credential_id", sa.LargeBinary(), nullable=False),
+        sa.Column("public_key", sa.LargeBinary(), nullable=False),
+        sa.Column("sign_count", sa.Integer(), nullable=False),
+        sa.Column("aaguid", sa.LargeBinary(), nullable=True),
+        sa.Column(
+            "created_at",
+            sa.DateTime(timezone=True),
+            server_default=sa.text("TIMEZONE('utc', statement_timestamp())"),
+            nullable=False,
+        ),
+        sa.ForeignKeyConstraint(
+            ["user_id"],
+            ["users.id"],
+            name="fk_webauthn_credentials_user_id",
+            ondelete="CASCADE",
+        ),
+        sa.PrimaryKeyConstraint("id", name=op.f("pk_webauthn_credentials")),
+        sa.UniqueConstraint(
+            "credential_id", name=op.f("uq_webauthn_credentials_credential_id")
+        ),
+        sa.UniqueConstraint("id", name=op.f("uq_webauthn_credentials_id")),
+    )
+    op.create_index(
+        op.f("ix_webauthn_credentials_user_id"),
+        "webauthn_credentials",
+        ["user_id"],
+        unique=False,
+    )
+
+
+def downgrade():
+    op.drop_index(
+        op.f("ix_webauthn_credentials_user_id"), table_name="webauthn_credentials"
+    )
+    op.drop_table("webauthn_credentials")
@@ -1,19 +1,24 @@
 """
 User-related Brood operations
 """
-from datetime import datetime, timedelta
+from datetime import datetime, timedelta, timezone
+import hashlib
+import hmac
+import json
 import logging
 from random import randint
 import re
-from typing import Any, cast, Callable, Dict, List, Optional, Set
+from typing import Any, cast, Callable, Dict, Iterator, List, Optional, Set, Tuple
 import uuid
 
 from passlib.context import CryptContext
+from psycopg2 import errorcodes  # type: ignore
 from sendgrid import SendGridAPIClient
 from sendgrid.helpers.mail import Mail
 from sqlalchemy.orm.base import PASSIVE_OFF
 import stripe  # type: ignore
-from sqlalchemy import func, or_, and_
+from sqlalchemy import func, or_, and_, tuple_
+from sqlalchemy.exc import IntegrityError
 from sqlalchemy.orm.session import Session
 from sqlalchemy.orm.exc import MultipleResultsFound
 
@@ -35,21 +40,52 @@ from .models import (
     Subscription,
     SubscriptionPlan,
     Application,
+    IdempotencyKey,
+    AuditEvent,
+    UserDeletionConfirmation,
+    LoginHistory,
+    PasswordHistory,
+    ServiceAccount,
+    ApplicationSlug,
+    ApplicationTransferRequest,
+    WebAuthnCredential,
 )
+from .resources.models import Resource
 from .settings import (
+    ALLOWED_EMAIL_DOMAINS,
+    BLOCKED_EMAIL_DOMAINS,
+    APPLICATION_TRANSFER_TTL_HOURS,
     BUGOUT_URL,
     BUGOUT_FROM_EMAIL,
     SENDGRID_API_KEY,
     DEFAULT_USER_GROUP_LIMIT,
+    DEFAULT_TOKEN_TTL,
+    EXCHANGE_MAX_TTL_HOURS,
+    GROUP_TOKEN_MAX_TTL_DAYS,
+    MAX_TOKEN_TTL,
+    IDEMPOTENCY_TTL_HOURS,
+    IMPERSONATION_TOKEN_TTL,
+    REGION,
+    USER_DELETION_CONFIRMATION_TTL_MINUTES,
+    application_transfer_link_from_env,
     group_invite_link_from_env,
     TEMPLATE_ID_BUGOUT_WELCOME_EMAIL,
     TEMPLATE_ID_MOONSTREAM_WELCOME_EMAIL,
     MOONSTREAM_APPLICATION_ID,
+    PASSWORD_HISTORY_SIZE,
+    PASSWORD_PEPPER,
+    RESERVED_USERNAMES,
 )
 
 logger = logging.getLogger(__name__)
 
 SPACE_REGEX = re.compile(r"\s")
+TOKEN_NAME_REGEX = re.compile(r"^[A-Za-z0-9-]{1,64}$")
+
+# Mail providers which deliver mail sent to user+tag@domain to user@domain
+SUBADDRESS_EMAIL_DOMAINS = {"gmail.com", "googlemail.com", "outlook.com", "hotmail.com"}
+# Mail providers which ignore dots in the local part of address
+DOTLESS_EMAIL_DOMAINS = {"gmail.com", "googlemail.com"}
 
 
 class PasswordInvalidParameters(ValueError):
@@ -60,12 +96,38 @@ class PasswordInvalidParameters(ValueError):
     generic_error_message = "Password is not strong enough:\n- Passwords must be at least 8 characters in length"
 
 
+class EmailDomainNotAllowed(ValueError):
+    """
+    Raised when domain of provided email is not in BROOD_EMAIL_DOMAIN_ALLOWLIST.
+    """
+
+
+class EmailDomainBlocked(ValueError):
+    """
+    Raised when domain of provided email is in BROOD_EMAIL_DOMAIN_BLOCKLIST.
+    """
+
+
 class UsernameInvalidParameters(ValueError):
     """
     Raised when provided username does not fit validation requirements.
     """
 
 
+class UsernameReserved(UsernameInvalidParameters):
+    """
+    Raised when provided username is in BROOD_RESERVED_USERNAMES.
+    """
+
+
+class PasswordRecentlyUsed(PasswordInvalidParameters):
+    """
+    Raised when new password matches one of recent passwords stored in history.
+    """
+
+    generic_error_message = "password recently used"
+
+
 class UserIncorrectPassword(ValueError):
     """
     Raised when authentication attempt is made with the wrong password.
@@ -91,12 +153,37 @@ class UserNotFound(Exception):
     """
 
 
+class UserDeletionNotConfirmed(Exception):
+    """
+    Raised when account deletion confirmation token is missing, expired or issued for
+    another user.
+    """
+
+
+class UserPreconditionFailed(Exception):
+    """
+    Raised when user was modified after the state client expects (If-Match ETag mismatch).
+    """
+
+
+class UserProfileTooLarge(ValueError):
+    """
+    Raised when serialized user profile exceeds the size limit.
+    """
+
+
 class UserAlreadyExists(Exception):
     """
     Raised when given user name already exists in the database.
     """
 
 
+class UserEmailNormalizedExists(UserAlreadyExists):
+    """
+    Raised when user with another form of the same email (e.g. with +subaddress) exists.
+    """
+
+
 class VerificationEmailNotFound(Exception):
     """
     Raised when no verification emails are found (for a given user).
@@ -128,6 +215,12 @@ class GroupInvalidParameters(ValueError):
     """
 
 
+class GroupParentCycle(ValueError):
+    """
+    Raised when new group parent would create a loop in groups hierarchy.
+    """
+
+
 class GroupNotFound(Exception):
     """
     Raised when group with the given parameters is not found in the database.
@@ -170,6 +263,13 @@ class NoPermissions(Exception):
     """
 
 
+class SuperAdminSelfRevocation(Exception):
+    """
+    Raised when super-admin tries to revoke own super-admin flag, which could lock out admin
+    management.
+    """
+
+
 class NoInheritancePermission(Exception):
     """
     Raised when user violates inheritance rules.
@@ -182,6 +282,18 @@ class TokenInvalidParameters(ValueError):
     """
 
 
+class TokenNameExists(ValueError):
+    """
+    Raised when user already has token with the given name.
+    """
+
+
+class TokenTTLExceeded(ValueError):
+    """
+    Raised when requested token time to live exceeds the maximum allowed by configuration.
+    """
+
+
 class LackOfUserSpace(Exception):
     """
     Raised when group doesn't have free space.
@@ -200,6 +312,16 @@ class KVBroodNotFound(Exception):
     """
 
 
+def is_unique_violation(err: Exception) -> bool:
+    """
+    Checks if database error is Postgres unique_violation (SQLSTATE 23505). It happens when
+    concurrent requests race to insert rows with the same unique values.
+    """
+    if not isinstance(err, IntegrityError):
+        return False
+    return getattr(err.orig, "pgcode", None) == errorcodes.UNIQUE_VIOLATION
+
+
 def user_as_json_dict(user: User) -> Dict[str, Any]:
     """
     Returns a representation of the given user as a JSON-serializable dictionary.
@@ -247,10 +369,31 @@ def token_as_json_dict(token: Token) -> Dict[str, Any]:
         "created_at": str(token.created_at),
         "updated_at": str(token.updated_at),
         "restricted": token.restricted,
+        "expires_at": str(token.expires_at) if token.expires_at is not None else None,
+        "region": token.region,
     }
     return token_json
 
 
+def audit_event_as_json_dict(audit_event: AuditEvent) -> Dict[str, Any]:
+    """
+    Returns a representation of the given audit event as a JSON-serializable dictionary.
+    """
+    audit_event_json = {
+        "id": str(audit_event.id),
+        "event_type": audit_event.event_type,
+        "actor_user_id": str(audit_event.actor_user_id)
+        if audit_event.actor_user_id is not None
+        else None,
+        "target_user_id": str(audit_event.target_user_id)
+        if audit_event.target_user_id is not None
+        else None,
+        "details": audit_event.details,
+        "created_at": str(audit_event.created_at),
+    }
+    return audit_event_json
+
+
 def group_as_json_dict(group: Group) -> Dict[str, Any]:
     """
     Returns a representation of the given group as a JSON-serializable dictionary.
@@ -332,6 +475,27 @@ def get_password_context() -> CryptContext:
     return password_context
 
 
+def pepper_password(password: str) -> str:
+    """
+    Applies HMAC-SHA256 keyed with BROOD_PASSWORD_PEPPER to password.
+    """
+    assert PASSWORD_PEPPER is not None
+    return hmac.new(
+        PASSWORD_PEPPER.encode(), password.encode(), hashlib.sha256
+    ).hexdigest()
+
+
+def hash_password(password: str) -> Tuple[str, bool]:
+    """
+    Returns password hash and whether password was peppered before hashing. Pepper is
+    applied only if BROOD_PASSWORD_PEPPER is set.
+    """
+    password_context = get_password_context()
+    if PASSWORD_PEPPER is None:
+        return password_context.hash(password), False
+    return password_context.hash(pepper_password(password)), True
+
+
 def generate_verification_code(
     randint_generator: Optional[Callable[[int, int], int]] = None,
 ) -> str:
@@ -350,18 +514,21 @@ def generate_verification_code(
 
 def normalize_email(email: str) -> str:
     """
-    Normalize an email to store it in the database.
+    Normalize an email to store it in the database, addresses which lead to the same
+    inbox are normalized to the same value.
+
+    Subaddresses are stripped and dots are removed only for providers known to ignore
+    them, other addresses are only lowercased.
     """
-    segments = email.split("@")
+    segments = email.lower().split("@")
     assert len(segments) > 1
     hostname = segments[-1]
-    username_raw = "@".join(segments[:-1])
-    username_no_dots = "".join(username_raw.split("."))
-    assert username_no_dots != ""
-    plus_segments = username_no_dots.split("+")
-    assert len(plus_segments) > 0
-    assert plus_segments[0] != ""
-    normalized_username = plus_segments[0].lower()
+    normalized_username = "@".join(segments[:-1])
+    if hostname in SUBADDRESS_EMAIL_DOMAINS:
+        normalized_username = normalized_username.split("+")[0]
+    if hostname in DOTLESS_EMAIL_DOMAINS:
+        normalized_username = normalized_username.replace(".", "")
+    assert normalized_username != ""
     return f"{normalized_username}@{hostname}"
 
 
@@ -379,6 +546,102 @@ def verify_username(username: str) -> None:
         raise UsernameInvalidParameters(f"Username must not contain spaces")
 
 
+def verify_username_not_reserved(username: str) -> None:
+    if username.lower() in RESERVED_USERNAMES:
+        raise UsernameReserved(f"Username {username} is reserved")
+
+
+def email_domain_matches(domain: str, domains: List[str]) -> bool:
+    """
+    Checks if domain is in the list, entries prefixed with dot match subdomains.
+    """
+    for listed_domain in domains:
+        if listed_domain.startswith("."):
+            if domain.endswith(listed_domain):
+                return True
+        elif domain == listed_domain:
+            return True
+    return False
+
+
+def verify_email_domain(email: str) -> None:
+    domain = email.rpartition("@")[2].lower()
+    if email_domain_matches(domain, BLOCKED_EMAIL_DOMAINS):
+        raise EmailDomainBlocked(f"Email domain {domain} is blocked")
+    if ALLOWED_EMAIL_DOMAINS and not email_domain_matches(
+        domain, ALLOWED_EMAIL_DOMAINS
+    ):
+        raise EmailDomainNotAllowed(f"Email domain {domain} is not allowed")
+
+
+def verify_password_hash(password: str, password_hash: str, peppered: bool) -> bool:
+    """
+    Checks if password matches hash, peppered hashes could be checked only if
+    BROOD_PASSWORD_PEPPER is set.
+    """
+    password_context = get_password_context()
+    if peppered:
+        if PASSWORD_PEPPER is None:
+            return False
+        return password_context.verify(pepper_password(password), password_hash)
+    return password_context.verify(password, password_hash)
+
+
+def verify_password_history(session: Session, user: User, password: str) -> None:
+    """
+    Raises PasswordRecentlyUsed if password matches one of the last
+    BROOD_PASSWORD_HISTORY_SIZE passwords of user, current password included.
+    """
+    if PASSWORD_HISTORY_SIZE == 0:
+        return
+    if verify_password_hash(password, user.password_hash, user.password_peppered):
+        raise PasswordRecentlyUsed("Password matches current password")
+
+    previous_passwords = (
+        session.query(PasswordHistory)
+        .filter(PasswordHistory.user_id == user.id)
+        .order_by(PasswordHistory.created_at.desc())
+        .limit(PASSWORD_HISTORY_SIZE - 1)
+        .all()
+    )
+    for previous_password in previous_passwords:
+        if verify_password_hash(
+            password,
+            previous_password.password_hash,
+            previous_password.password_peppered,
+        ):
+            raise PasswordRecentlyUsed("Password matches one of previous passwords")
+
+
+def push_password_history(session: Session, user: User) -> None:
+    """
+    Stores current password hash of user in history and prunes history to
+    BROOD_PASSWORD_HISTORY_SIZE - 1 entries, as current password is checked too.
+    """
+    if PASSWORD_HISTORY_SIZE == 0:
+        return
+    session.add(
+        PasswordHistory(
+            user_id=user.id,
+            password_hash=user.password_hash,
+            password_peppered=user.password_peppered,
+        )
+    )
+    session.flush()
+
+    stale_entries = (
+        session.query(PasswordHistory.id)
+        .filter(PasswordHistory.user_id == user.id)
+        .order_by(PasswordHistory.created_at.desc())
+        .offset(PASSWORD_HISTORY_SIZE - 1)
+        .all()
+    )
+    if stale_entries:
+        session.query(PasswordHistory).filter(
+            PasswordHistory.id.in_([entry[0] for entry in stale_entries])
+        ).delete(synchronize_session=False)
+
+
 def password_confirm(
     user: User,
     password: Optional[str] = None,
@@ -386,6 +649,9 @@ def password_confirm(
 ) -> bool:
     """
     Confirm password provided by user.
+
+    If pepper is configured and password was hashed without it, password is rehashed
+    with pepper. Updated hash is stored with the next commit of the caller.
     """
     if password is None and password_hash is None:
         raise UserInvalidParameters(
@@ -394,7 +660,17 @@ def password_confirm(
         )
     password_context = get_password_context()
     if password is not None:
-        if password_context.verify(password, user.password_hash):
+        if user.password_peppered:
+            if PASSWORD_PEPPER is None:
+                logger.error(
+                    f"Password of user {user.id} is peppered, but "
+                    "BROOD_PASSWORD_PEPPER is not set"
+                )
+            elif password_context.verify(pepper_password(password), user.password_hash):
+                return True
+        elif password_context.verify(password, user.password_hash):
+            if PASSWORD_PEPPER is not None:
+                user.password_hash, user.password_peppered = hash_password(password)
             return True
     if password_hash is not None:
         if user.password_hash == password_hash:
@@ -412,6 +688,7 @@ def create_user(
     first_name: Optional[str] = None,
     last_name: Optional[str] = None,
     application_id: Optional[uuid.UUID] = None,
+    bypass_registration_policy: bool = False,
 ) -> User:
     """
     Creates a new user in the given database session and
@@ -420,6 +697,9 @@ def create_user(
     According with autogenerated_user var it create bugout user for Slack/Github installation or
     normal user.
 
+    Reserved usernames and email domain lists are not applied to autogenerated users and
+    with bypass_registration_policy, which is set by operators creating users from CLI.
+
     Sessions are expected to be sqlalchemy Session objects:
     https://docs.sqlalchemy.org/en/13/orm/session_api.html#sqlalchemy.orm.session.Session
     """
@@ -433,9 +713,27 @@ def create_user(
 
     verify_username(username)
     verify_password_strength(password)
+    # Autogenerated users of installations are not registered by people
+    if not autogenerated_user and not bypass_registration_policy:
+        verify_username_not_reserved(username)
+        verify_email_domain(email)
+
+    # Unique constraint does not cover users without application, as NULLs are distinct
+    same_inbox_query = session.query(User.id).filter(
+        User.normalized_email == normalized_email
+    )
+    if application_id is None:
+        same_inbox_query = same_inbox_query.filter(User.application_id.is_(None))
+    else:
+        same_inbox_query = same_inbox_query.filter(
+            User.application_id == application_id
+        )
+    if same_inbox_query.first() is not None:
+        raise UserEmailNormalizedExists(
+            f"User with email normalized to {normalized_email} already exists"
+        )
 
-    password_context = get_password_context()
-    password_hash = password_context.hash(password)
+    password_hash, password_peppered = hash_password(password)
     auth_type = "brood"
 
     user_object = User(
@@ -443,6 +741,7 @@ def create_user(
         email=email,
         normalized_email=normalized_email,
         password_hash=password_hash,
+        password_peppered=password_peppered,
         auth_type=auth_type,
         verified=True if autogenerated_user else False,
         autogenerated=True if autogenerated_user else False,
@@ -457,9 +756,12 @@ def create_user(
         session.add(user_object)
         session.add(user_group_limit)
         session.commit()
-    except Exception as e:
-        logger.error(e)
-        raise UserAlreadyExists("This user already exists")
+    except IntegrityError as e:
+        session.rollback()
+        if is_unique_violation(e):
+            raise UserAlreadyExists("This user already exists")
+        logger.error(e, extra={"error": e})
+        raise
 
     return user_object
 
@@ -511,14 +813,25 @@ def get_user(
     return users[0]
 
 
+def user_etag(user: User) -> str:
+    """
+    Generates quoted ETag for user state based on its updated_at timestamp.
+    """
+    updated_at_us = int(user.updated_at.timestamp() * 1_000_000)
+    return f'"{hashlib.sha256(str(updated_at_us).encode()).hexdigest()}"'
+
+
 def update_user(
     session: Session,
     user_id: uuid.UUID,
     first_name: Optional[str] = None,
     last_name: Optional[str] = None,
+    expected_updated_at: Optional[datetime] = None,
 ) -> User:
     """
     Update user's first_name and last_name with the given ID.
+
+    If expected_updated_at is provided, user is updated only if it was not modified since then.
     """
     if first_name is None and last_name is None:
         raise UserInvalidParameters(
@@ -528,24 +841,170 @@ def update_user(
     query = session.query(User).filter(User.id == user_id)
     user_object = query.first()
 
+    if expected_updated_at is not None:
+        query = query.filter(User.updated_at == expected_updated_at)
+
+    update_values: Dict[Any, Any] = {}
     if first_name is not None:
-        query.update({User.first_name: first_name})
+        update_values[User.first_name] = first_name
     if last_name is not None:
-        query.update({User.last_name: last_name})
+        update_values[User.last_name] = last_name
+
+    updated_rows = query.update(update_values)
+    if updated_rows == 0 and expected_updated_at is not None:
+        session.rollback()
+        raise UserPreconditionFailed("User was modified by another request")
 
     session.commit()
     return user_object
 
 
+# Maximum size of serialized user profile in bytes
+USER_PROFILE_MAX_SIZE = 16 * 1024
+
+
+def update_user_profile(
+    session: Session, user_id: uuid.UUID, profile: Dict[str, Any]
+) -> User:
+    """
+    Replaces profile metadata of user with the given ID. Profile must be JSON object.
+    """
+    if not isinstance(profile, dict):
+        raise UserInvalidParameters("User profile must be JSON object")
+    if len(json.dumps(profile).encode("utf-8")) > USER_PROFILE_MAX_SIZE:
+        raise UserProfileTooLarge(
+            f"User profile must not exceed {USER_PROFILE_MAX_SIZE} bytes"
+        )
+
+    user = session.query(User).filter(User.id == user_id).one_or_none()
+    if user is None:
+        raise UserNotFound(f"Did not find user with id={user_id}")
+
+    user.profile = profile
+    session.add(user)
+    session.commit()
+    return user
+
+
+def create_audit_event(
+    session: Session,
+    event_type: str,
+    actor_user_id: Optional[uuid.UUID] = None,
+    target_user_id: Optional[uuid.UUID] = None,
+    details: Optional[Dict[str, Any]] = None,
+) -> AuditEvent:
+    """
+    Adds audit event to the session, it is committed together with the audited change.
+    """
+    audit_event = AuditEvent(
+        event_type=event_type,
+        actor_user_id=actor_user_id,
+        target_user_id=target_user_id,
+        details=details,
+    )
+    session.add(audit_event)
+    return audit_event
+
+
+def get_user_activity(
+    session: Session,
+    user_id: uuid.UUID,
+    limit: int = 20,
+    cursor: Optional[Tuple[datetime, uuid.UUID]] = None,
+) -> List[AuditEvent]:
+    """
+    Returns audit events where user is actor or target, newest first. Cursor is
+    (created_at, id) of the last event from previous page.
+    """
+    query = session.query(AuditEvent).filter(
+        or_(AuditEvent.actor_user_id == user_id, AuditEvent.target_user_id == user_id)
+    )
+    if cursor is not None:
+        query = query.filter(tuple_(AuditEvent.created_at, AuditEvent.id) < cursor)
+    return (
+        query.order_by(AuditEvent.created_at.desc(), AuditEvent.id.desc())
+        .limit(limit)
+        .all()
+    )
+
+
+def update_admin_flags(
+    session: Session,
+    user: User,
+    is_admin: Optional[bool] = None,
+    is_super_admin: Optional[bool] = None,
+    actor_user_id: Optional[uuid.UUID] = None,
+) -> User:
+    """
+    Sets admin flags of the user and records the change in audit log. Permissions are not
+    checked, actor_user_id is None for operators changing flags with CLI.
+    """
+    if is_admin is None and is_super_admin is None:
+        raise UserInvalidParameters(
+            "In order to update admin flags, at least one of is_admin, or is_super_admin must be specified"
+        )
+
+    details: Dict[str, Any] = {}
+    if is_admin is not None:
+        details["is_admin"] = {"old": user.is_admin, "new": is_admin}
+        user.is_admin = is_admin
+    if is_super_admin is not None:
+        details["is_super_admin"] = {"old": user.is_super_admin, "new": is_super_admin}
+        user.is_super_admin = is_super_admin
+
+    session.add(user)
+    create_audit_event(
+        session,
+        event_type="user_admin_flags_updated",
+        actor_user_id=actor_user_id,
+        target_user_id=user.id,
+        details=details,
+    )
+    session.commit()
+    return user
+
+
+def set_user_admin_flags(
+    session: Session,
+    current_user: User,
+    user_id: uuid.UUID,
+    is_admin: Optional[bool] = None,
+    is_super_admin: Optional[bool] = None,
+) -> User:
+    """
+    Allows super-admins to manage admin flags of users.
+    """
+    if not current_user.is_super_admin:
+        raise NoPermissions("Only super-admins could manage admin flags")
+    if current_user.id == user_id and is_super_admin is False:
+        raise SuperAdminSelfRevocation("Super-admins could not revoke own super-admin")
+
+    user = session.query(User).filter(User.id == user_id).one_or_none()
+    if user is None:
+        raise UserNotFound(f"Did not find user with id={user_id}")
+
+    return update_admin_flags(
+        session,
+        user,
+        is_admin=is_admin,
+        is_super_admin=is_super_admin,
+        actor_user_id=current_user.id,
+    )
+
+
 def delete_user(
     session: Session,
     username: Optional[str] = None,
     email: Optional[str] = None,
     user_id: Optional[uuid.UUID] = None,
     current_password: Optional[str] = None,
+    deletion_confirmation: Optional[UserDeletionConfirmation] = None,
 ) -> User:
     """
     Delete a user by username, email, or user_id. Uses get_user to locate the specified user.
+
+    Provided deletion confirmation is consumed in the same transaction, so it could not
+    be used again.
     """
     if username is None and email is None and user_id is None:
         raise UserInvalidParameters(
@@ -565,11 +1024,94 @@ def delete_user(
                     "Attempted to delete user with incorrect password"
                 )
 
+    if deletion_confirmation is not None:
+        session.delete(deletion_confirmation)
     session.delete(user)
     session.commit()
     return user
 
 
+def iter_user_audit_events(
+    session: Session, user_id: uuid.UUID, batch_size: int = 500
+) -> Iterator[AuditEvent]:
+    """
+    Iterates over audit events where user is actor or target, oldest first.
+    """
+    query = (
+        session.query(AuditEvent)
+        .filter(
+            or_(
+                AuditEvent.actor_user_id == user_id,
+                AuditEvent.target_user_id == user_id,
+            )
+        )
+        .order_by(AuditEvent.created_at, AuditEvent.id)
+        .execution_options(stream_results=True)
+        .yield_per(batch_size)
+    )
+    for audit_event in query:
+        yield audit_event
+
+
+def iter_users(session: Session, batch_size: int = 1000) -> Iterator[User]:
+    """
+    Iterates over all users in order of registration. Rows are fetched from server-side
+    cursor in batches, so all users are never loaded into memory at once.
+    """
+    query = (
+        session.query(User)
+        .order_by(User.created_at, User.id)
+        .execution_options(stream_results=True)
+        .yield_per(batch_size)
+    )
+    for user in query:
+        yield user
+
+
+def create_user_deletion_confirmation(
+    session: Session, user_id: uuid.UUID
+) -> UserDeletionConfirmation:
+    """
+    Issues short-lived token which confirms user deletion.
+    """
+    confirmation = UserDeletionConfirmation(
+        user_id=user_id,
+        expires_at=datetime.now(timezone.utc)
+        + timedelta(minutes=USER_DELETION_CONFIRMATION_TTL_MINUTES),
+    )
+    session.add(confirmation)
+    create_audit_event(
+        session,
+        event_type="user_deletion_requested",
+        actor_user_id=user_id,
+        target_user_id=user_id,
+    )
+    session.commit()
+    return confirmation
+
+
+def check_user_deletion_confirmation(
+    session: Session, user_id: uuid.UUID, confirmation_id: Optional[uuid.UUID]
+) -> UserDeletionConfirmation:
+    """
+    Returns confirmation token if it is valid for the user, otherwise raises
+    UserDeletionNotConfirmed.
+    """
+    if confirmation_id is None:
+        raise UserDeletionNotConfirmed("User deletion confirmation token is required")
+    confirmation = (
+        session.query(UserDeletionConfirmation)
+        .filter(UserDeletionConfirmation.id == confirmation_id)
+        .filter(UserDeletionConfirmation.user_id == user_id)
+        .one_or_none()
+    )
+    if confirmation is None or confirmation.expires_at <= datetime.now(timezone.utc):
+        raise UserDeletionNotConfirmed(
+            "User deletion confirmation token is invalid or expired"
+        )
+    return confirmation
+
+
 def change_password(
     session: Session,
     new_password: str,
@@ -578,6 +1120,7 @@ def change_password(
     username: Optional[str] = None,
     email: Optional[str] = None,
     user_id: Optional[uuid.UUID] = None,
+    audit_details: Optional[Dict[str, Any]] = None,
 ) -> User:
     """
     Change a user's password.
@@ -595,11 +1138,18 @@ def change_password(
         )
 
     verify_password_strength(new_password)
+    verify_password_history(session, user, new_password)
 
-    password_context = get_password_context()
-    new_password_hash = password_context.hash(new_password)
-    user.password_hash = new_password_hash
+    push_password_history(session, user)
+    user.password_hash, user.password_peppered = hash_password(new_password)
     session.add(user)
+    create_audit_event(
+        session,
+        event_type="user_password_changed",
+        actor_user_id=user.id,
+        target_user_id=user.id,
+        details=audit_details,
+    )
     session.commit()
     return user
 
@@ -640,7 +1190,10 @@ def send_welcome_email(user: User, application_id: Optional[uuid.UUID] = None) -
             f"Welcome email successfully submitted to Sendgrid for user with id={user_id}"
         )
     except Exception as e:
-        logger.error(f"Error sending welcome email {e}")
+        logger.error(
+            f"Error sending welcome email {e}",
+            extra={"user_id": user_id, "error": e},
+        )
         pass
 
 
@@ -825,61 +1378,450 @@ def reset_password_confirmation(
         query.update({ResetPassword.completed: True})
         session.commit()
     except Exception as e:
-        logger.error(f"Unable to change password, error: {e}")
+        logger.error(
+            f"Unable to change password, error: {e}",
+            extra={"user_id": reset_object.user_id, "error": e},
+        )
         raise
 
     return user
 
 
-def create_token(
-    session: Session,
-    user_id: uuid.UUID,
-    token_type: Optional[TokenType] = TokenType.bugout,
-    token_note: Optional[str] = None,
-    restricted: bool = False,
-) -> Token:
+def token_expiration(token_ttl: Optional[int] = None) -> Optional[datetime]:
     """
-    Generate an access token for the given user (user retrieved using get_user).
+    Calculates expiration time for a new token from requested time to live in seconds.
+
+    If token_ttl is not provided, BROOD_DEFAULT_TOKEN_TTL is applied, or
+    BROOD_MAX_TOKEN_TTL if default is not set. Requested TTL could not exceed
+    BROOD_MAX_TOKEN_TTL. Returns None for non-expiring tokens.
     """
-    token = Token(
-        user_id=user_id,
-        active=True,
-        token_type=token_type,
-        note=token_note,
-        restricted=restricted,
-    )
-    session.add(token)
-    session.commit()
-    return token
+    if token_ttl is None:
+        token_ttl = DEFAULT_TOKEN_TTL
+    if token_ttl is None:
+        token_ttl = MAX_TOKEN_TTL
+    if token_ttl is not None and token_ttl < 0:
+        raise TokenTTLExceeded("Token TTL must not be negative")
+    if MAX_TOKEN_TTL is not None and (
+        token_ttl is None or token_ttl == 0 or token_ttl > MAX_TOKEN_TTL
+    ):
+        raise TokenTTLExceeded(
+            f"Token TTL must be positive and not exceed {MAX_TOKEN_TTL} seconds"
+        )
+    if token_ttl is None or token_ttl == 0:
+        return None
+    return datetime.now(timezone.utc) + timedelta(seconds=token_ttl)
 
 
-def get_token(session: Session, token: uuid.UUID) -> Token:
+def is_token_expired(token: Token) -> bool:
     """
-    Retrieve the token with the given ID from the database (if it exists).
+    Checks if token expiration time has passed.
     """
-    token_object = session.query(Token).filter(Token.id == token).first()
-    if token_object is None:
-        raise TokenNotFound(f"Token not found with ID: {token}")
-    token_object = cast(Token, token_object)
-    return token_object
+    if token.expires_at is None:
+        return False
+    return token.expires_at <= datetime.now(timezone.utc)
 
 
-def update_token(
-    session: Session,
-    token: uuid.UUID,
-    token_type: Optional[TokenType] = None,
-    token_note: Optional[str] = None,
-    target_token: Optional[uuid.UUID] = None,
-) -> Token:
+def same_token_owner(token: Token, other: Token) -> bool:
     """
-    Update the token's type and note with the given ID.
+    Checks if tokens belong to the same user, service account or group.
     """
-    if token_type is None and token_note is None:
-        raise TokenInvalidParameters(
-            "In order to update token, at least one of token_type, or token_note must be specified"
-        )
-    if token_type is not None and token_type not in TokenType:
-        raise TokenInvalidParameters("Incorrect token type provided.")
+    return (token.user_id, token.service_account_id, token.group_id) == (
+        other.user_id,
+        other.service_account_id,
+        other.group_id,
+    )
+
+
+# Scopes of regular tokens, restricted tokens could only identify a user
+TOKEN_SCOPES = ["identify", "api", "token:introspect"]
+RESTRICTED_TOKEN_SCOPES = ["identify"]
+# Granted only to tokens created with explicit scopes which include it
+EXCHANGE_SCOPE = "token:exchange"
+# Group tokens have no user to derive exchanged tokens for
+GROUP_TOKEN_SCOPES = ["identify", "api", "token:introspect"]
+
+
+def token_scopes(token: Token) -> List[str]:
+    """
+    Scopes of the token for external services. Tokens created with requested scopes and
+    tokens derived by exchange have explicit scopes, scopes of others depend on
+    restricted flag.
+    """
+    if token.scopes is not None:
+        return list(token.scopes)
+    if token.restricted:
+        return list(RESTRICTED_TOKEN_SCOPES)
+    return list(TOKEN_SCOPES)
+
+
+def verify_token_scopes(scopes: List[str], restricted: bool) -> List[str]:
+    """
+    Checks scopes requested for a new token, returns them without duplicates.
+    """
+    base_scopes = RESTRICTED_TOKEN_SCOPES if restricted else TOKEN_SCOPES
+    allowed_scopes = base_scopes + [EXCHANGE_SCOPE]
+    unknown_scopes = [scope for scope in scopes if scope not in allowed_scopes]
+    if len(scopes) == 0 or unknown_scopes:
+        raise TokenInvalidParameters(
+            f"Token scopes must be a non-empty subset of: {', '.join(allowed_scopes)}"
+        )
+    return list(dict.fromkeys(scopes))
+
+
+def token_owner_has_application_access(
+    session: Session, token: Token, application: Application
+) -> bool:
+    """
+    Checks if service account of the token belongs to the application, or user of the
+    token is registered in the application or is a member of the application group.
+    """
+    if token.service_account is not None:
+        return token.service_account.application_id == application.id
+    if token.user is None:
+        return False
+    if token.user.application_id == application.id:
+        return True
+    try:
+        check_user_type_in_group(
+            session, user_id=token.user_id, group_id=application.group_id
+        )
+    except GroupNotFound:
+        return False
+    return True
+
+
+def exchange_token(
+    session: Session,
+    caller_token: Token,
+    target_application_id: uuid.UUID,
+    requested_scopes: Optional[List[str]] = None,
+    audit_details: Optional[Dict[str, Any]] = None,
+) -> Token:
+    """
+    Derives token for another application from caller token with scopes limited to the
+    requested ones. Derived token expires within BROOD_EXCHANGE_MAX_TTL_HOURS and not
+    later than caller token. Derived tokens could not be exchanged further.
+    """
+    caller_scopes = token_scopes(caller_token)
+    if EXCHANGE_SCOPE not in caller_scopes:
+        raise exceptions.AccessTokenUnauthorized(
+            "Token is not authorized to be exchanged"
+        )
+    applications = get_applications(session, application_id=target_application_id)
+    if len(applications) == 0:
+        raise exceptions.ApplicationsNotFound(
+            f"There are no application with id: {target_application_id}"
+        )
+    if not token_owner_has_application_access(session, caller_token, applications[0]):
+        raise exceptions.AccessTokenUnauthorized(
+            "Token owner has no access to the target application"
+        )
+
+    if requested_scopes is None:
+        requested_scopes = caller_scopes
+    scopes = [
+        scope
+        for scope in caller_scopes
+        if scope in requested_scopes and scope != EXCHANGE_SCOPE
+    ]
+
+    expires_at = datetime.now(timezone.utc) + timedelta(hours=EXCHANGE_MAX_TTL_HOURS)
+    if caller_token.expires_at is not None:
+        expires_at = min(expires_at, caller_token.expires_at)
+
+    token = Token(
+        user_id=caller_token.user_id,
+        service_account_id=caller_token.service_account_id,
+        active=True,
+        token_type=caller_token.token_type,
+        note=f"Exchanged from token {caller_token.id}",
+        restricted="api" not in scopes,
+        scopes=scopes,
+        expires_at=expires_at,
+        region=REGION,
+        bound_application_id=target_application_id,
+        derived_from_token_id=caller_token.id,
+    )
+    session.add(token)
+    session.flush()
+    create_audit_event(
+        session,
+        event_type="token_exchanged",
+        actor_user_id=caller_token.user_id,
+        target_user_id=caller_token.user_id,
+        details={
+            **(audit_details or {}),
+            "token_id": str(caller_token.id),
+            "derived_token_id": str(token.id),
+            "application_id": str(target_application_id),
+            "scopes": scopes,
+        },
+    )
+    session.commit()
+    return token
+
+
+def create_group_token(
+    session: Session,
+    group_id: uuid.UUID,
+    scopes: List[str],
+    created_by: uuid.UUID,
+    token_note: Optional[str] = None,
+    token_ttl: Optional[int] = None,
+    audit_details: Optional[Dict[str, Any]] = None,
+) -> Token:
+    """
+    Generate token owned by the group instead of a user, so jobs of the group keep
+    working when members leave it. Token expires after token_ttl seconds, by default and
+    at most after BROOD_GROUP_TOKEN_MAX_TTL_DAYS.
+    """
+    if len(scopes) == 0:
+        raise TokenInvalidParameters("At least one scope is required")
+    unknown_scopes = [scope for scope in scopes if scope not in GROUP_TOKEN_SCOPES]
+    if unknown_scopes:
+        raise TokenInvalidParameters(
+            f"Unsupported scopes: {', '.join(unknown_scopes)}, group tokens could have "
+            f"{', '.join(GROUP_TOKEN_SCOPES)}"
+        )
+
+    max_ttl = GROUP_TOKEN_MAX_TTL_DAYS * 24 * 60 * 60
+    if token_ttl is None:
+        token_ttl = max_ttl
+    if token_ttl <= 0 or token_ttl > max_ttl:
+        raise TokenTTLExceeded(
+            f"Token TTL must be positive and not exceed {max_ttl} seconds"
+        )
+
+    token = Token(
+        user_id=None,
+        group_id=group_id,
+        active=True,
+        token_type=TokenType.bugout,
+        note=token_note,
+        restricted="api" not in scopes,
+        scopes=list(dict.fromkeys(scopes)),
+        expires_at=datetime.now(timezone.utc) + timedelta(seconds=token_ttl),
+        region=REGION,
+    )
+    session.add(token)
+    session.flush()
+    create_audit_event(
+        session,
+        event_type="group_token_created",
+        actor_user_id=created_by,
+        details={
+            **(audit_details or {}),
+            "group_id": str(group_id),
+            "token_id": str(token.id),
+            "scopes": token.scopes,
+        },
+    )
+    session.commit()
+    return token
+
+
+def token_fingerprint(token_id: uuid.UUID) -> str:
+    """
+    Non-secret identifier of the token, token ID itself is the secret.
+    """
+    return hashlib.sha256(str(token_id).encode("utf-8")).hexdigest()[:16]
+
+
+def revoke_group_token(
+    session: Session,
+    group_id: uuid.UUID,
+    fingerprint: str,
+    revoked_by: uuid.UUID,
+    audit_details: Optional[Dict[str, Any]] = None,
+) -> Token:
+    """
+    Revoke active token of the group with the given fingerprint.
+    """
+    for token in get_group_tokens(session, group_id):
+        if token_fingerprint(token.id) == fingerprint:
+            break
+    else:
+        raise TokenNotFound(f"Token not found with fingerprint: {fingerprint}")
+
+    token.active = False
+    session.add(token)
+    create_audit_event(
+        session,
+        event_type="group_token_revoked",
+        actor_user_id=revoked_by,
+        details={
+            **(audit_details or {}),
+            "group_id": str(group_id),
+            "fingerprint": fingerprint,
+        },
+    )
+    session.commit()
+    return token
+
+
+def get_group_tokens(session: Session, group_id: uuid.UUID) -> List[Token]:
+    """
+    Returns active and not expired tokens of the group, newest first.
+    """
+    tokens = (
+        session.query(Token)
+        .filter(Token.group_id == group_id)
+        .filter(Token.active == True)
+        .filter(Token.expires_at > datetime.now(timezone.utc))
+        .order_by(Token.created_at.desc())
+        .all()
+    )
+    return tokens
+
+
+def create_token(
+    session: Session,
+    user_id: Optional[uuid.UUID],
+    token_type: Optional[TokenType] = TokenType.bugout,
+    token_note: Optional[str] = None,
+    restricted: bool = False,
+    token_ttl: Optional[int] = None,
+    bound_application_id: Optional[uuid.UUID] = None,
+    service_account_id: Optional[uuid.UUID] = None,
+    impersonated_by: Optional[uuid.UUID] = None,
+    name: Optional[str] = None,
+    scopes: Optional[List[str]] = None,
+) -> Token:
+    """
+    Generate an access token for the given user (user retrieved using get_user) or for
+    the given service account, then user_id is None.
+
+    Token with requested scopes has only them, token:exchange scope is granted only this
+    way.
+    """
+    if name is not None:
+        verify_token_name(session, user_id, name)
+    if scopes is not None:
+        scopes = verify_token_scopes(scopes, restricted)
+        restricted = restricted or "api" not in scopes
+    expires_at = token_expiration(token_ttl)
+    token = Token(
+        user_id=user_id,
+        name=name,
+        service_account_id=service_account_id,
+        impersonated_by=impersonated_by,
+        active=True,
+        token_type=token_type,
+        note=token_note,
+        restricted=restricted,
+        scopes=scopes,
+        expires_at=expires_at,
+        region=REGION,
+        bound_application_id=bound_application_id,
+    )
+    session.add(token)
+    try:
+        session.commit()
+    except IntegrityError as e:
+        session.rollback()
+        # Concurrent request took the name after it was verified
+        if name is not None and is_unique_violation(e):
+            raise TokenNameExists(f"Token with name {name} already exists")
+        raise
+    return token
+
+
+def get_token(session: Session, token: uuid.UUID) -> Token:
+    """
+    Retrieve the token with the given ID from the database (if it exists).
+    """
+    token_object = session.query(Token).filter(Token.id == token).first()
+    if token_object is None:
+        raise TokenNotFound(f"Token not found with ID: {token}")
+    token_object = cast(Token, token_object)
+    return token_object
+
+
+def verify_token_name(
+    session: Session,
+    user_id: Optional[uuid.UUID],
+    name: str,
+    exclude_token_id: Optional[uuid.UUID] = None,
+) -> None:
+    """
+    Checks if name has up to 64 letters, digits or dashes and is not used by other
+    active tokens of the user. Name of expired token is released.
+    """
+    if TOKEN_NAME_REGEX.match(name) is None:
+        raise TokenInvalidParameters(
+            "Token name must contain from 1 to 64 letters, digits or dashes"
+        )
+    query = session.query(Token).filter(
+        Token.user_id == user_id, Token.name == name, Token.active == True
+    )
+    if exclude_token_id is not None:
+        query = query.filter(Token.id != exclude_token_id)
+    token_object = query.first()
+    if token_object is None:
+        return
+    if not is_token_expired(token_object):
+        raise TokenNameExists(f"Token with name {name} already exists")
+    token_object.name = None
+    session.add(token_object)
+    session.flush()
+
+
+def get_token_by_name(session: Session, user_id: uuid.UUID, name: str) -> Token:
+    """
+    Retrieve active token of the user by its name.
+    """
+    token_object = (
+        session.query(Token)
+        .filter(Token.user_id == user_id)
+        .filter(Token.name == name)
+        .filter(Token.active == True)
+        .one_or_none()
+    )
+    if token_object is None or is_token_expired(token_object):
+        raise TokenNotFound(f"Token not found with name: {name}")
+    return token_object
+
+
+def update_token_name(
+    session: Session, user_id: uuid.UUID, token_id: uuid.UUID, name: str
+) -> Token:
+    """
+    Rename token of the user.
+    """
+    token_object = get_token(session, token_id)
+    if token_object.user_id != user_id:
+        raise exceptions.AccessTokenUnauthorized(
+            "Could not perform the desired operation."
+        )
+    verify_token_name(session, user_id, name, exclude_token_id=token_object.id)
+    token_object.name = name
+    session.add(token_object)
+    try:
+        session.commit()
+    except IntegrityError as e:
+        session.rollback()
+        if is_unique_violation(e):
+            raise TokenNameExists(f"Token with name {name} already exists")
+        raise
+    return token_object
+
+
+def update_token(
+    session: Session,
+    token: uuid.UUID,
+    token_type: Optional[TokenType] = None,
+    token_note: Optional[str] = None,
+    target_token: Optional[uuid.UUID] = None,
+) -> Token:
+    """
+    Update the token's type and note with the given ID.
+    """
+    if token_type is None and token_note is None:
+        raise TokenInvalidParameters(
+            "In order to update token, at least one of token_type, or token_note must be specified"
+        )
+    if token_type is not None and token_type not in TokenType:
+        raise TokenInvalidParameters("Incorrect token type provided.")
 
     token_object = get_token(session, token)
     if token_object.restricted:
@@ -890,7 +1832,7 @@ def update_token(
     target_object = token_object
     if target_token is not None:
         target_object = get_token(session, target_token)
-    if token_object.user_id != target_object.user_id:
+    if not same_token_owner(token_object, target_object):
         raise exceptions.AccessTokenUnauthorized(
             "Could not perform the desired operation."
         )
@@ -906,7 +1848,10 @@ def update_token(
 
 
 def revoke_token(
-    session: Session, token: uuid.UUID, target: Optional[uuid.UUID] = None
+    session: Session,
+    token: uuid.UUID,
+    target: Optional[uuid.UUID] = None,
+    audit_details: Optional[Dict[str, Any]] = None,
 ) -> Token:
     """
     Revoke the token with the given ID (if it exists).
@@ -919,14 +1864,299 @@ def revoke_token(
     target_object = token_object
     if target is not None:
         target_object = get_token(session, target)
-    if token_object.user_id != target_object.user_id:
+    if not same_token_owner(token_object, target_object):
+        raise exceptions.AccessTokenUnauthorized(
+            "Could not perform the desired operation."
+        )
+    target_object.active = False
+    session.add(target_object)
+    create_audit_event(
+        session,
+        event_type="token_revoked",
+        actor_user_id=token_object.user_id,
+        target_user_id=target_object.user_id,
+        details={
+            **(audit_details or {}),
+            "token_id": str(target_object.id),
+            "name": target_object.name,
+        },
+    )
+    session.commit()
+    return target_object
+
+
+def rotate_token(session: Session, token_id: uuid.UUID, current_token: Token) -> Token:
+    """
+    Revokes token and issues new one with the same type, note, restrictions and lifetime
+    in single transaction. Only owner of current token, user or service account, could
+    rotate the token.
+    """
+    token_object = get_token(session, token_id)
+    if not same_token_owner(current_token, token_object):
         raise exceptions.AccessTokenUnauthorized(
             "Could not perform the desired operation."
         )
-    target_object.active = False
-    session.add(target_object)
-    session.commit()
-    return target_object
+    if not token_object.active or is_token_expired(token_object):
+        raise TokenNotFound(f"Token not found with ID: {token_id}")
+    # Rotated token would outlive the token it was exchanged from
+    if token_object.derived_from_token_id is not None:
+        raise exceptions.RestrictedTokenUnauthorized(
+            "Exchanged tokens could not be rotated"
+        )
+
+    token_ttl = None
+    if token_object.expires_at is not None:
+        token_ttl = int(
+            (token_object.expires_at - token_object.created_at).total_seconds()
+        )
+    new_token = Token(
+        user_id=token_object.user_id,
+        service_account_id=token_object.service_account_id,
+        active=True,
+        token_type=token_object.token_type,
+        note=token_object.note,
+        restricted=token_object.restricted,
+        scopes=token_object.scopes,
+        expires_at=token_expiration(token_ttl),
+        region=REGION,
+        bound_application_id=token_object.bound_application_id,
+        impersonated_by=token_object.impersonated_by,
+        name=token_object.name,
+    )
+    # Name moves to the new token, old one is released first to keep names unique
+    token_object.active = False
+    token_object.name = None
+    session.add(token_object)
+    session.flush()
+    session.add(new_token)
+    session.commit()
+    return new_token
+
+
+def impersonate_user(
+    session: Session,
+    admin: User,
+    user_id: uuid.UUID,
+    audit_details: Optional[Dict[str, Any]] = None,
+) -> Token:
+    """
+    Issues short-lived token for super-admin to act as the user. Issuance is recorded in
+    audit log with admin as actor and user as target.
+    """
+    user = get_user(session, user_id=user_id)
+    token = create_token(
+        session,
+        user_id=user.id,
+        token_note=f"Impersonation by {admin.username}",
+        token_ttl=IMPERSONATION_TOKEN_TTL,
+        impersonated_by=admin.id,
+    )
+    create_audit_event(
+        session,
+        event_type="user_impersonation",
+        actor_user_id=admin.id,
+        target_user_id=user.id,
+        details={**(audit_details or {}), "token_id": str(token.id)},
+    )
+    session.commit()
+    return token
+
+
+def revoke_user_tokens(
+    session: Session, user_id: uuid.UUID, except_token: Optional[uuid.UUID] = None
+) -> List[uuid.UUID]:
+    """
+    Revoke all active tokens of the user except the provided one.
+
+    Returns IDs of revoked tokens.
+    """
+    query = session.query(Token).filter(Token.user_id == user_id, Token.active == True)
+    if except_token is not None:
+        query = query.filter(Token.id != except_token)
+    tokens = query.all()
+    for token_object in tokens:
+        token_object.active = False
+        session.add(token_object)
+    session.commit()
+    return [token_object.id for token_object in tokens]
+
+
+def get_user_token_ids(session: Session, user_id: uuid.UUID) -> List[uuid.UUID]:
+    """
+    Returns IDs of active tokens of the user, they are deleted together with the user.
+    """
+    rows = (
+        session.query(Token.id)
+        .filter(Token.user_id == user_id, Token.active == True)
+        .all()
+    )
+    return [row.id for row in rows]
+
+
+def get_group_token_ids(session: Session, group_id: uuid.UUID) -> List[uuid.UUID]:
+    """
+    Returns IDs of active tokens of the group and of service accounts of its
+    applications, they are deleted together with the group.
+    """
+    group_rows = (
+        session.query(Token.id)
+        .filter(Token.group_id == group_id, Token.active == True)
+        .all()
+    )
+    service_account_rows = (
+        session.query(Token.id)
+        .join(ServiceAccount, ServiceAccount.id == Token.service_account_id)
+        .join(Application, Application.id == ServiceAccount.application_id)
+        .filter(Application.group_id == group_id, Token.active == True)
+        .all()
+    )
+    return [row.id for row in group_rows + service_account_rows]
+
+
+def get_service_account_token_ids(
+    session: Session,
+    application_id: uuid.UUID,
+    service_account_id: Optional[uuid.UUID] = None,
+) -> List[uuid.UUID]:
+    """
+    Returns IDs of active tokens of service accounts of the application, or of one
+    service account, they are deleted together with it.
+    """
+    query = (
+        session.query(Token.id)
+        .join(ServiceAccount, ServiceAccount.id == Token.service_account_id)
+        .filter(ServiceAccount.application_id == application_id, Token.active == True)
+    )
+    if service_account_id is not None:
+        query = query.filter(ServiceAccount.id == service_account_id)
+    return [row.id for row in query.all()]
+
+
+def cleanup_tokens(
+    session: Session, retention: timedelta = timedelta(days=1), batch_size: int = 500
+) -> int:
+    """
+    Deletes tokens expired or revoked longer than retention period ago. Tokens are deleted in
+    batches, so transactions stay short and do not block autovacuum.
+
+    Returns number of deleted tokens.
+    """
+    cutoff = datetime.now(timezone.utc) - retention
+    deleted_total = 0
+    while True:
+        batch = (
+            session.query(Token.id)
+            .filter(
+                or_(
+                    Token.expires_at < cutoff,
+                    and_(Token.active == False, Token.updated_at < cutoff),
+                )
+            )
+            .limit(batch_size)
+        )
+        deleted = (
+            session.query(Token)
+            .filter(Token.id.in_(batch))
+            .delete(synchronize_session=False)
+        )
+        session.commit()
+        deleted_total += deleted
+        if deleted < batch_size:
+            break
+
+    return deleted_total
+
+
+def record_login_attempt(
+    session: Session,
+    user_id: uuid.UUID,
+    success: bool,
+    audit_details: Optional[Dict[str, Any]] = None,
+) -> LoginHistory:
+    """
+    Adds login attempt to user login history, changes are committed by the caller.
+    """
+    audit_details = audit_details or {}
+    login_attempt = LoginHistory(
+        user_id=user_id,
+        ip=audit_details.get("ip"),
+        user_agent=audit_details.get("device"),
+        success=success,
+    )
+    session.add(login_attempt)
+    return login_attempt
+
+
+def get_login_history(
+    session: Session,
+    user_id: uuid.UUID,
+    limit: int = 10,
+    cursor: Optional[Tuple[datetime, uuid.UUID]] = None,
+) -> List[LoginHistory]:
+    """
+    Returns login attempts of user, newest first. Cursor is (created_at, id) of the last
+    entry from previous page.
+    """
+    query = session.query(LoginHistory).filter(LoginHistory.user_id == user_id)
+    if cursor is not None:
+        query = query.filter(tuple_(LoginHistory.created_at, LoginHistory.id) < cursor)
+    return (
+        query.order_by(LoginHistory.created_at.desc(), LoginHistory.id.desc())
+        .limit(limit)
+        .all()
+    )
+
+
+def cleanup_login_history(
+    session: Session, retention: timedelta, batch_size: int = 500
+) -> int:
+    """
+    Deletes login history entries older than retention period in batches. Returns number
+    of deleted entries.
+    """
+    cutoff = datetime.now(timezone.utc) - retention
+    deleted_total = 0
+    while True:
+        batch = (
+            session.query(LoginHistory.id)
+            .filter(LoginHistory.created_at < cutoff)
+            .limit(batch_size)
+        )
+        deleted = (
+            session.query(LoginHistory)
+            .filter(LoginHistory.id.in_(batch))
+            .delete(synchronize_session=False)
+        )
+        session.commit()
+        deleted_total += deleted
+        if deleted < batch_size:
+            break
+
+    return deleted_total
+
+
+def get_user_by_login(
+    session: Session,
+    login: str,
+    login_type: Optional[data.LoginType] = None,
+    application_id: Optional[uuid.UUID] = None,
+) -> User:
+    """
+    Get a user by login which is either username or email. If login_type is not provided, login
+    containing @ is looked up as email first, usernames are allowed to contain @ as well so
+    username lookup is used as a fallback.
+    """
+    if login_type == data.LoginType.username:
+        return get_user(session, username=login, application_id=application_id)
+    if login_type == data.LoginType.email:
+        return get_user(session, email=login, application_id=application_id)
+
+    if "@" in login:
+        try:
+            return get_user(session, email=login, application_id=application_id)
+        except UserNotFound:
+            pass
+    return get_user(session, username=login, application_id=application_id)
 
 
 def login(
@@ -937,16 +2167,27 @@ def login(
     token_note: Optional[str] = None,
     restricted: bool = False,
     application_id: Optional[uuid.UUID] = None,
+    token_ttl: Optional[int] = None,
+    login_type: Optional[data.LoginType] = None,
+    audit_details: Optional[Dict[str, Any]] = None,
+    token_name: Optional[str] = None,
+    scopes: Optional[List[str]] = None,
 ) -> Token:
     """
-    Login with the given username and password to get a new token for the user with that username.
+    Login with the given username or email and password to get a new token for the user.
     If token_type and token_note provieded it works as token generation handler. By default it
     creates "bugout" token with None in note.
     """
-    user = get_user(session, username=username, application_id=application_id)
+    user = get_user_by_login(
+        session, username, login_type=login_type, application_id=application_id
+    )
 
     password_abide = password_confirm(user, password=password)
+    record_login_attempt(
+        session, user_id=user.id, success=password_abide, audit_details=audit_details
+    )
     if password_abide is False:
+        session.commit()
         raise UserIncorrectPassword("Attempted to login with incorrect password")
 
     token = create_token(
@@ -955,7 +2196,115 @@ def login(
         token_type=token_type,
         token_note=token_note,
         restricted=restricted,
+        token_ttl=token_ttl,
+        bound_application_id=application_id,
+        name=token_name,
+        scopes=scopes,
+    )
+    create_audit_event(
+        session,
+        event_type="user_login",
+        actor_user_id=user.id,
+        target_user_id=user.id,
+        details=audit_details,
+    )
+    session.commit()
+    return token
+
+
+def get_webauthn_credentials(
+    session: Session, user_id: uuid.UUID
+) -> List[WebAuthnCredential]:
+    """
+    Returns passkeys registered by the user.
+    """
+    credentials = (
+        session.query(WebAuthnCredential)
+        .filter(WebAuthnCredential.user_id == user_id)
+        .order_by(WebAuthnCredential.created_at)
+        .all()
+    )
+    return credentials
+
+
+def get_webauthn_credential(
+    session: Session, credential_id: bytes
+) -> WebAuthnCredential:
+    """
+    Returns passkey by credential ID assigned by authenticator.
+    """
+    credential = (
+        session.query(WebAuthnCredential)
+        .filter(WebAuthnCredential.credential_id == credential_id)
+        .one_or_none()
+    )
+    if credential is None:
+        raise exceptions.WebAuthnCredentialNotFound("WebAuthn credential not found")
+    return credential
+
+
+def create_webauthn_credential(
+    session: Session,
+    user_id: uuid.UUID,
+    credential_id: bytes,
+    public_key: bytes,
+    sign_count: int,
+    aaguid: Optional[bytes] = None,
+    audit_details: Optional[Dict[str, Any]] = None,
+) -> WebAuthnCredential:
+    """
+    Stores verified passkey of the user.
+    """
+    credential = WebAuthnCredential(
+        user_id=user_id,
+        credential_id=credential_id,
+        public_key=public_key,
+        sign_count=sign_count,
+        aaguid=aaguid,
+    )
+    session.add(credential)
+    session.flush()
+    create_audit_event(
+        session,
+        event_type="webauthn_credential_registered",
+        actor_user_id=user_id,
+        target_user_id=user_id,
+        details={**(audit_details or {}), "credential_id": str(credential.id)},
+    )
+    session.commit()
+    return credential
+
+
+def webauthn_login(
+    session: Session,
+    credential: WebAuthnCredential,
+    sign_count: int,
+    application_id: Optional[uuid.UUID] = None,
+    audit_details: Optional[Dict[str, Any]] = None,
+) -> Token:
+    """
+    Issues token for user who signed authentication challenge with the passkey. Sign
+    count of the passkey is updated, so replayed assertions are rejected.
+    """
+    credential.sign_count = sign_count
+    session.add(credential)
+    record_login_attempt(
+        session, user_id=credential.user_id, success=True, audit_details=audit_details
     )
+    token = create_token(
+        session,
+        user_id=credential.user_id,
+        token_note="WebAuthn login token",
+        bound_application_id=application_id,
+    )
+    create_audit_event(
+        session,
+        event_type="user_login",
+        actor_user_id=credential.user_id,
+        target_user_id=credential.user_id,
+        details={**(audit_details or {}), "method": "webauthn"},
+    )
+    session.commit()
     return token
 
 
@@ -1092,6 +2441,69 @@ def get_group(
     return group
 
 
+def set_group_parent(
+    session: Session, group_id: uuid.UUID, parent_id: Optional[uuid.UUID] = None
+) -> Group:
+    """
+    Sets parent of the group, None parent_id clears it. Group which becomes top level
+    group receives free subscription plan, as groups created without parent do.
+    """
+    group = session.query(Group).filter(Group.id == group_id).one_or_none()
+    if group is None:
+        raise GroupNotFound(f"Did not find group with id={group_id}")
+
+    if parent_id is None:
+        if group.parent is not None:
+            group.parent = None
+            session.add(group)
+            session.commit()
+            if len(subscriptions.get_group_subscriptions(session, group.id)) == 0:
+                free_plan_id = get_kv_variable(
+                    session, "BUGOUT_GROUP_FREE_SUBSCRIPTION_PLAN"
+                ).kv_value
+                free_plan = subscriptions.get_subscription_plan(session, free_plan_id)
+                subscriptions.add_group_subscription(
+                    session,
+                    group_id=group.id,
+                    plan_id=free_plan.id,
+                    units=free_plan.default_units,
+                    active=True,
+                )
+        return group
+
+    parent_group = session.query(Group).filter(Group.id == parent_id).one_or_none()
+    if parent_group is None:
+        raise GroupNotFound("There is no provided group with parent id")
+
+    # Walk up from the new parent, reaching the group itself means a loop
+    visited: Set[uuid.UUID] = set()
+    ancestor: Optional[Group] = parent_group
+    while ancestor is not None and ancestor.id not in visited:
+        if ancestor.id == group.id:
+            raise GroupParentCycle(
+                "Group could not be a parent of itself or its ancestors"
+            )
+        visited.add(ancestor.id)
+        if ancestor.parent is None:
+            break
+        ancestor = (
+            session.query(Group).filter(Group.id == ancestor.parent).one_or_none()
+        )
+
+    has_children = (
+        session.query(Group.id).filter(Group.parent == group.id).first() is not None
+    )
+    if parent_group.parent is not None or has_children:
+        raise GroupInvalidParameters(
+            "Wrong group parent provided, it is forbidden to have more then one level of inheritance"
+        )
+
+    group.parent = parent_group.id
+    session.add(group)
+    session.commit()
+    return group
+
+
 def create_group(
     session: Session, group_name: str, user: User, parent_id: Optional[uuid.UUID] = None
 ) -> Group:
@@ -1154,7 +2566,7 @@ def create_group(
             username=user.username,
         )
     except Exception as e:
-        logger.error(e)
+        logger.error(e, extra={"error": e})
         raise GroupAlreadyExists("Error due adding subscription or set user in group")
 
     return group
@@ -1459,11 +2871,59 @@ def check_user_type_in_group(
     )
 
 
+def get_stats(session: Session) -> data.AdminStatsResponse:
+    """
+    Counts users, tokens, groups and resources in a single database round trip.
+    """
+    now = datetime.now(timezone.utc)
+    active_tokens = session.query(func.count(Token.id)).filter(
+        Token.active == True,
+        or_(Token.expires_at.is_(None), Token.expires_at > now),
+    )
+    stats = session.query(
+        session.query(func.count(User.id)).scalar_subquery(),
+        session.query(func.count(User.id))
+        .filter(User.verified == True)
+        .scalar_subquery(),
+        active_tokens.scalar_subquery(),
+        session.query(func.count(Group.id)).scalar_subquery(),
+        session.query(func.count(Resource.id)).scalar_subquery(),
+    ).one()
+    return data.AdminStatsResponse(
+        users=stats[0],
+        verified_users=stats[1],
+        active_tokens=stats[2],
+        groups=stats[3],
+        resources=stats[4],
+        computed_at=now,
+    )
+
+
+def count_group_users(
+    session: Session, group_id: uuid.UUID, user_type: Optional[Role] = None
+) -> int:
+    """
+    Counts members of group, optionally only members with provided role.
+    """
+    query = session.query(func.count(GroupUser.user_id)).filter(
+        GroupUser.group_id == group_id
+    )
+    if user_type is not None:
+        query = query.filter(GroupUser.user_type == user_type)
+    return query.one()[0]
+
+
 def get_group_users(
-    session: Session, group_id: uuid.UUID, group_name: Optional[str]
+    session: Session,
+    group_id: uuid.UUID,
+    group_name: Optional[str],
+    user_type: Optional[Role] = None,
+    limit: Optional[int] = None,
+    offset: int = 0,
 ) -> data.UsersListResponse:
     """
-    Extract member list of group.
+    Extract member list of group, optionally filtered by role and paginated in order members
+    joined the group.
 
     # TODO(kompotkot): Optimize and reduce unnecessary SQL queries.
     """
@@ -1473,11 +2933,17 @@ def get_group_users(
     max_seats = get_num_seats(session, group)
 
     group_users_response = data.UsersListResponse(
-        id=group_id, name=group_name, users=[], num_users=num_users, num_seats=max_seats
+        id=group_id,
+        name=group_name,
+        users=[],
+        num_users=num_users,
+        num_seats=max_seats,
+        limit=limit,
+        offset=offset,
     )
 
     # Extract users information for requested group
-    group_users = (
+    query = (
         session.query(
             GroupUser.group_id,
             Group.name,
@@ -1485,12 +2951,18 @@ def get_group_users(
             User.username,
             User.email,
             GroupUser.user_type,
+            GroupUser.created_at,
         )
         .join(Group, GroupUser.group_id == Group.id)
         .join(User, GroupUser.user_id == User.id)
         .filter(GroupUser.group_id == group_id)
-        .all()
     )
+    if user_type is not None:
+        query = query.filter(GroupUser.user_type == user_type)
+    query = query.order_by(GroupUser.created_at, GroupUser.user_id).offset(offset)
+    if limit is not None:
+        query = query.limit(limit)
+    group_users = query.all()
     if len(group_users) > 0:
         group_users_response.users = [
             data.UserInListResponse(
@@ -1498,6 +2970,7 @@ def get_group_users(
                 username=user.username,
                 email=user.email,
                 user_type=user.user_type,
+                joined_at=user.created_at,
             )
             for user in group_users
         ]
@@ -1676,3 +3149,392 @@ def delete_application(
     db_session.commit()
 
     return application
+
+
+# Header names are RFC 7230 tokens
+HEADER_NAME_REGEX = re.compile(r"^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+# Headers in this namespace are reserved for Brood itself
+INTERNAL_HEADERS_PREFIX = "x-brood-"
+# Headers which would break security policy, CORS or framing of responses
+RESERVED_HEADERS = {
+    "set-cookie",
+    "content-security-policy",
+    "x-frame-options",
+    "content-type",
+    "content-length",
+    "content-encoding",
+    "transfer-encoding",
+    "connection",
+    "keep-alive",
+    "proxy-authenticate",
+    "proxy-authorization",
+    "te",
+    "trailer",
+    "upgrade",
+}
+RESERVED_HEADERS_PREFIXES = (INTERNAL_HEADERS_PREFIX, "access-control-")
+
+
+def is_reserved_header(name: str) -> bool:
+    lowered = name.lower()
+    return lowered in RESERVED_HEADERS or lowered.startswith(RESERVED_HEADERS_PREFIXES)
+
+
+def update_application_headers(
+    db_session: Session,
+    application_id: uuid.UUID,
+    headers: Dict[str, str],
+) -> Application:
+    """
+    Replaces custom response headers of application. Empty dictionary removes all headers.
+    """
+    for name, value in headers.items():
+        if HEADER_NAME_REGEX.match(name) is None:
+            raise exceptions.ApplicationHeadersInvalid(f"Invalid header name: {name}")
+        if is_reserved_header(name):
+            raise exceptions.ApplicationHeadersInvalid(
+                f"Header is reserved and could not be set by application: {name}"
+            )
+        if "\r" in value or "\n" in value:
+            raise exceptions.ApplicationHeadersInvalid(
+                f"Invalid value for header: {name}"
+            )
+
+    application = (
+        db_session.query(Application)
+        .filter(Application.id == application_id)
+        .one_or_none()
+    )
+    if application is None:
+        raise exceptions.ApplicationsNotFound(
+            f"There are no application with id: {application_id}"
+        )
+
+    application.response_headers = headers if headers else None
+    db_session.add(application)
+    db_session.commit()
+
+    return application
+
+
+def get_application_id_by_slug(db_session: Session, slug: str) -> Optional[uuid.UUID]:
+    application_slug = (
+        db_session.query(ApplicationSlug)
+        .filter(ApplicationSlug.slug == slug)
+        .one_or_none()
+    )
+    if application_slug is None:
+        return None
+    return application_slug.application_id
+
+
+def get_pending_application_transfer(
+    db_session: Session, application_id: uuid.UUID
+) -> Optional[ApplicationTransferRequest]:
+    return (
+        db_session.query(ApplicationTransferRequest)
+        .filter(
+            ApplicationTransferRequest.application_id == application_id,
+            ApplicationTransferRequest.accepted_at.is_(None),
+            ApplicationTransferRequest.expires_at > datetime.now(timezone.utc),
+        )
+        .first()
+    )
+
+
+def create_application_transfer(
+    db_session: Session,
+    application_id: uuid.UUID,
+    requester_user_id: uuid.UUID,
+    new_group_id: uuid.UUID,
+) -> ApplicationTransferRequest:
+    """
+    Creates request to transfer application to another group, only one transfer of
+    application could be pending at a time.
+    """
+    if get_pending_application_transfer(db_session, application_id) is not None:
+        raise exceptions.ApplicationTransferExists(
+            f"Application with id: {application_id} already has pending transfer"
+        )
+    group = get_group(db_session, group_id=new_group_id)
+
+    # Expired transfer is still unaccepted, it would violate uniqueness of pending one
+    db_session.query(ApplicationTransferRequest).filter(
+        ApplicationTransferRequest.application_id == application_id,
+        ApplicationTransferRequest.accepted_at.is_(None),
+        ApplicationTransferRequest.expires_at <= datetime.now(timezone.utc),
+    ).delete(synchronize_session=False)
+
+    transfer = ApplicationTransferRequest(
+        application_id=application_id,
+        requester_user_id=requester_user_id,
+        new_owner_type="group",
+        new_owner_id=group.id,
+        expires_at=datetime.now(timezone.utc)
+        + timedelta(hours=APPLICATION_TRANSFER_TTL_HOURS),
+    )
+    db_session.add(transfer)
+    create_audit_event(
+        db_session,
+        event_type="application_transfer_requested",
+        actor_user_id=requester_user_id,
+        details={"application_id": str(application_id), "group_id": str(group.id)},
+    )
+    try:
+        db_session.commit()
+    except IntegrityError as e:
+        db_session.rollback()
+        # Concurrent request created pending transfer after the check above
+        if is_unique_violation(e):
+            raise exceptions.ApplicationTransferExists(
+                f"Application with id: {application_id} already has pending transfer"
+            )
+        raise
+
+    return transfer
+
+
+def cancel_application_transfer(
+    db_session: Session, application_id: uuid.UUID
+) -> ApplicationTransferRequest:
+    transfer = get_pending_application_transfer(db_session, application_id)
+    if transfer is None:
+        raise exceptions.ApplicationTransferNotFound(
+            f"There are no pending transfer of application with id: {application_id}"
+        )
+
+    db_session.delete(transfer)
+    db_session.commit()
+
+    return transfer
+
+
+def accept_application_transfer(
+    db_session: Session, application_id: uuid.UUID, token: uuid.UUID
+) -> Application:
+    """
+    Moves application to the group it was transferred to.
+    """
+    transfer = (
+        db_session.query(ApplicationTransferRequest)
+        .filter(
+            ApplicationTransferRequest.application_id == application_id,
+            ApplicationTransferRequest.token == token,
+            ApplicationTransferRequest.accepted_at.is_(None),
+        )
+        .one_or_none()
+    )
+    if transfer is None:
+        raise exceptions.ApplicationTransferNotFound(
+            f"There are no pending transfer of application with id: {application_id}"
+        )
+    now = datetime.now(timezone.utc)
+    if transfer.expires_at <= now:
+        raise exceptions.ApplicationTransferExpired(
+            "Transfer of application has expired"
+        )
+
+    application = (
+        db_session.query(Application)
+        .filter(Application.id == application_id)
+        .one_or_none()
+    )
+    if application is None:
+        raise exceptions.ApplicationsNotFound(
+            f"There are no application with id: {application_id}"
+        )
+
+    previous_group_id = application.group_id
+    application.group_id = transfer.new_owner_id
+    transfer.accepted_at = now
+    db_session.add(application)
+    db_session.add(transfer)
+    create_audit_event(
+        db_session,
+        event_type="application_transferred",
+        actor_user_id=transfer.requester_user_id,
+        details={
+            "application_id": str(application_id),
+            "previous_group_id": str(previous_group_id),
+            "group_id": str(transfer.new_owner_id),
+        },
+    )
+    db_session.commit()
+
+    return application
+
+
+def get_group_owner_emails(db_session: Session, group_id: uuid.UUID) -> List[str]:
+    owners = (
+        db_session.query(User.email)
+        .join(GroupUser, GroupUser.user_id == User.id)
+        .filter(GroupUser.group_id == group_id, GroupUser.user_type == Role.owner)
+        .all()
+    )
+    return [owner.email for owner in owners]
+
+
+def send_application_transfer_email(
+    application_id: uuid.UUID,
+    application_name: str,
+    token: uuid.UUID,
+    email: str,
+    requester_email: str,
+) -> None:
+    """
+    Send link to accept application transfer to owner of new group.
+    """
+    transfer_link = application_transfer_link_from_env(str(application_id), str(token))
+    message = Mail(
+        from_email=BUGOUT_FROM_EMAIL,
+        to_emails=email,
+        subject="Bugout.dev application transfer",
+        html_content=(
+            f"{requester_email} transfers application {application_name} to your "
+            f"group!\nAccept url: {transfer_link}"
+        ),
+    )
+
+    try:
+        sg = SendGridAPIClient(SENDGRID_API_KEY)
+        response = sg.send(message)
+    except Exception as e:
+        logger.exception(e)
+        raise
+
+
+def create_service_account(
+    db_session: Session, application_id: uuid.UUID, name: str
+) -> ServiceAccount:
+    service_account = ServiceAccount(application_id=application_id, name=name)
+    db_session.add(service_account)
+    db_session.commit()
+
+    return service_account
+
+
+def get_service_accounts(
+    db_session: Session, application_id: uuid.UUID
+) -> List[ServiceAccount]:
+    return (
+        db_session.query(ServiceAccount)
+        .filter(ServiceAccount.application_id == application_id)
+        .order_by(ServiceAccount.created_at)
+        .all()
+    )
+
+
+def get_service_account(
+    db_session: Session, application_id: uuid.UUID, service_account_id: uuid.UUID
+) -> ServiceAccount:
+    service_account = (
+        db_session.query(ServiceAccount)
+        .filter(
+            ServiceAccount.id == service_account_id,
+            ServiceAccount.application_id == application_id,
+        )
+        .one_or_none()
+    )
+    if service_account is None:
+        raise exceptions.ServiceAccountNotFound(
+            f"There are no service account with id: {service_account_id}"
+        )
+
+    return service_account
+
+
+def delete_service_account(
+    db_session: Session, application_id: uuid.UUID, service_account_id: uuid.UUID
+) -> ServiceAccount:
+    """
+    Deletes service account, its tokens are deleted by cascade.
+    """
+    service_account = get_service_account(
+        db_session, application_id, service_account_id
+    )
+    db_session.delete(service_account)
+    db_session.commit()
+
+    return service_account
+
+
+# Reservation of request in flight expires after this period, so key is not locked for
+# the whole TTL if worker dies before the response is recorded
+IDEMPOTENCY_RESERVATION_SECONDS = 60
+
+
+def get_idempotency_key(
+    session: Session, key: str, scope: str
+) -> Optional[IdempotencyKey]:
+    """
+    Returns not expired record of idempotency key in the caller scope.
+    """
+    query = session.query(IdempotencyKey).filter(
+        IdempotencyKey.key == key,
+        IdempotencyKey.scope == scope,
+        IdempotencyKey.expires_at > datetime.now(timezone.utc),
+    )
+    return query.one_or_none()
+
+
+def reserve_idempotency_key(
+    session: Session, key: str, scope: str, endpoint: str
+) -> Optional[IdempotencyKey]:
+    """
+    Reserves idempotency key before request is processed. Expired record with the same
+    key is replaced.
+
+    Returns None if the key is already reserved or has recorded response.
+    """
+    session.query(IdempotencyKey).filter(
+        IdempotencyKey.key == key,
+        IdempotencyKey.scope == scope,
+        IdempotencyKey.expires_at <= datetime.now(timezone.utc),
+    ).delete(synchronize_session=False)
+
+    idempotency_key = IdempotencyKey(
+        key=key,
+        scope=scope,
+        endpoint=endpoint,
+        expires_at=datetime.now(timezone.utc)
+        + timedelta(seconds=IDEMPOTENCY_RESERVATION_SECONDS),
+    )
+    try:
+        session.add(idempotency_key)
+        session.commit()
+    except IntegrityError as e:
+        session.rollback()
+        if is_unique_violation(e):
+            return None
+        raise
+
+    return idempotency_key
+
+
+def complete_idempotency_key(
+    session: Session,
+    idempotency_key: IdempotencyKey,
+    response_status: int,
+    response_body: bytes,
+    response_headers: List[List[str]],
+) -> IdempotencyKey:
+    """
+    Records response for reserved idempotency key, it is replayed for
+    BROOD_IDEMPOTENCY_TTL_HOURS.
+    """
+    idempotency_key.response_status = response_status
+    idempotency_key.response_body = response_body
+    idempotency_key.response_headers = response_headers
+    idempotency_key.expires_at = datetime.now(timezone.utc) + timedelta(
+        hours=IDEMPOTENCY_TTL_HOURS
+    )
+    session.commit()
+    return idempotency_key
+
+
+def release_idempotency_key(session: Session, idempotency_key: IdempotencyKey) -> None:
+    """
+    Removes reservation of request which failed, so client could retry it.
+    """
+    session.delete(idempotency_key)
+    session.commit()
@@ -1,15 +1,23 @@
 """
 The Brood HTTP API
 """
+import asyncio
+import base64
+import json
+from datetime import datetime, timezone
 import logging
-from typing import Any, Dict, List, Optional
+import sys
+from typing import Any, Dict, Iterable, Iterator, List, Optional, Set, Tuple, Union
 import uuid
 
 from fastapi import (
     BackgroundTasks,
+    Body,
+    Cookie,
     Depends,
     FastAPI,
     Form,
+    Header,
     HTTPException,
     Path,
     Query,
@@ -17,8 +25,12 @@ from fastapi import (
     Response,
     status,
 )
-from fastapi.middleware.cors import CORSMiddleware
+from fastapi.encoders import jsonable_encoder
+from fastapi.exceptions import RequestValidationError
+from fastapi.responses import StreamingResponse
 from fastapi.security import OAuth2PasswordRequestForm
+from starlette.exceptions import HTTPException as StarletteHTTPException
+from sqlalchemy.orm import Session
 import stripe  # type: ignore
 
 from . import actions
@@ -26,29 +38,119 @@ from . import data
 from . import exceptions
 from . import subscriptions
 from . import models
+from . import passkeys
+from . import tasks
 from .middleware import (
+    AccessLogPathFilter,
+    ApplicationHeadersMiddleware,
+    ConcurrencyLimitMiddleware,
+    DebugLoggingMiddleware,
+    DynamicCORSMiddleware,
+    FaultInjectionMiddleware,
+    IdempotencyMiddleware,
+    InFlightMiddleware,
+    JSON_MEDIA_TYPE,
+    MessagePackMiddleware,
+    MethodOverrideMiddleware,
+    RateLimitMiddleware,
+    RequestIDMiddleware,
+    ResponseHashMiddleware,
+    SecurityHeadersMiddleware,
+    SlowRequestLoggingMiddleware,
+    SubdomainRoutingMiddleware,
+    UTF8JSONResponse,
+    client_ip,
+    evict_application_headers,
+    load_fault_rules,
+    http_exception_handler,
+    validation_exception_handler,
     oauth2_scheme,
+    oauth2_scheme_manual,
+    request_audit_details,
     autogenerated_user_token_check,
+    get_application_id,
+    get_current_token,
     get_current_user,
+    location_path,
+    is_token_impersonated,
+    reject_impersonated_changes,
     is_token_restricted,
     is_token_restricted_or_installation,
     get_current_user_or_installation,
 )
-from .external import yield_db_session_from_env
-from .version import BROOD_VERSION
+from .cache import CacheMiss
+from .changelog import load_changelog
+from .config_watcher import config_watcher
+from .draining import drain_state
+from .external import (
+    SessionLocal,
+    cache,
+    engine,
+    pool_probe,
+    yield_db_session_from_env,
+)
+from .i18n import LocalizedHTTPException
+from .logs import setup_logging
+from .ratelimit import TokenBucketLimiter
+from .tracing import setup_tracing
+from .version import BROOD_COMMIT_HASH, BROOD_VERSION, PYTHON_VERSION
 from .settings import (
     group_invite_link_from_env,
-    ORIGINS,
+    ADMIN_STATS_CACHE_TTL_SECONDS,
+    ALLOW_METHOD_OVERRIDE,
+    BASE_DOMAIN,
+    CONFIG_LISTEN,
+    CONFIG_RELOAD_INTERVAL_SECONDS,
+    CORS_MAX_AGE_SECONDS,
+    DB_POOL_PROBE_INTERVAL_SECONDS,
+    DEBUG,
+    DEBUG_BODIES,
+    DEBUG_MAX_BODY_LOG_BYTES,
+    LOG_EXCLUDE_PATHS,
+    LOG_FORMAT,
+    LOG_LEVEL,
+    SLOW_REQUEST_THRESHOLD_MS,
     STRIPE_SIGNING_SECRET,
     REQUIRE_EMAIL_VERIFICATION,
     SEND_EMAIL_WELCOME,
     DOCS_TARGET_PATH,
+    FAULT_CONFIG_FILE,
+    FAULT_INJECTION,
+    FAULT_SEED,
+    HASH_MAX_RESPONSE_BYTES,
+    MAX_CONCURRENT_REQUESTS,
+    RESPONSE_HASH_ENABLED,
+    SECURITY_HEADERS,
+    SECURITY_HEADERS_ENABLED,
+    TOKEN_CLEANUP_DISABLED,
+    TOKEN_INTROSPECTION_CACHE_TTL_SECONDS,
+    LIST_COUNT_CACHE_TTL_SECONDS,
+    USER_AVAILABILITY_RATE_LIMIT,
+    validate_settings,
 )
+from .resources import actions as resources_actions
 from .resources.api import app as resources_api
-
-logging.basicConfig(level=logging.INFO)
+from .resources.events import resource_events_hub
+
+setup_logging(LOG_LEVEL, LOG_FORMAT)
+if DEBUG:
+    # Only Brood loggers, libraries like SQLAlchemy stay at INFO level
+    logging.getLogger("brood").setLevel(logging.DEBUG)
+if DEBUG_BODIES:
+    logging.getLogger("brood.middleware.bodies").setLevel(logging.DEBUG)
+if LOG_EXCLUDE_PATHS:
+    logging.getLogger("uvicorn.access").addFilter(
+        AccessLogPathFilter(LOG_EXCLUDE_PATHS)
+    )
 logger = logging.getLogger(__name__)
 
+# Fail fast on misconfiguration instead of failing on the first request
+settings_errors = validate_settings()
+if settings_errors:
+    for settings_error in settings_errors:
+        logger.error(f"Invalid configuration: {settings_error}")
+    sys.exit(1)
+
 tags_metadata = [
     {"name": "users", "description": "Operations with users."},
     {"name": "tokens", "description": "Operations with user tokens."},
@@ -65,33 +167,161 @@ app = FastAPI(
     openapi_url="/openapi.json",
     docs_url=None,
     redoc_url=f"/{DOCS_TARGET_PATH}",
+    default_response_class=UTF8JSONResponse,
+    dependencies=[Depends(reject_impersonated_changes)],
 )
 
-# CORS settings
+# Added before CORS middleware, so 429 responses carry CORS headers and browsers could
+# read them. Always installed, as limit could be enabled at runtime
+app.add_middleware(RateLimitMiddleware, get_limit=config_watcher.rate_limit)
+
+# CORS settings, allowed origins could be reloaded at runtime. Access-Control-Max-Age is
+# set on preflight responses only
 app.add_middleware(
-    CORSMiddleware,
-    allow_origins=ORIGINS,
+    DynamicCORSMiddleware,
+    get_origins=config_watcher.cors_allowed_origins,
     allow_credentials=True,
     allow_methods=["*"],
     allow_headers=["*"],
+    max_age=CORS_MAX_AGE_SECONDS,
 )
 
+app.add_middleware(IdempotencyMiddleware)
+# Wraps idempotency middleware, so replayed responses are encoded as requested too
+app.add_middleware(MessagePackMiddleware)
+app.add_middleware(ApplicationHeadersMiddleware)
+if BASE_DOMAIN != "":
+    app.add_middleware(SubdomainRoutingMiddleware, base_domain=BASE_DOMAIN)
+# Rejects requests over the limit before any work is done, including token lookups
+if MAX_CONCURRENT_REQUESTS > 0:
+    app.add_middleware(ConcurrencyLimitMiddleware, limit=MAX_CONCURRENT_REQUESTS)
+if FAULT_INJECTION:
+    assert FAULT_CONFIG_FILE is not None
+    fault_rules = load_fault_rules(FAULT_CONFIG_FILE)
+    logger.warning(
+        f"FAULT INJECTION IS ENABLED with {len(fault_rules)} rules from "
+        f"{FAULT_CONFIG_FILE}, requests will fail on purpose"
+    )
+    app.add_middleware(FaultInjectionMiddleware, rules=fault_rules, seed=FAULT_SEED)
+# Inside request ID middleware, so logged bodies could be matched with requests
+if DEBUG_BODIES:
+    app.add_middleware(
+        DebugLoggingMiddleware,
+        max_body_bytes=DEBUG_MAX_BODY_LOG_BYTES,
+        exclude_paths=LOG_EXCLUDE_PATHS,
+    )
+# Effective method is set before rate limiting, idempotency and routing see the request
+if ALLOW_METHOD_OVERRIDE:
+    app.add_middleware(MethodOverrideMiddleware)
+# Replaces access log of uvicorn, inside request ID middleware to log request IDs
+if SLOW_REQUEST_THRESHOLD_MS > 0:
+    logging.getLogger("uvicorn.access").setLevel(logging.WARNING)
+    app.add_middleware(
+        SlowRequestLoggingMiddleware,
+        threshold_ms=SLOW_REQUEST_THRESHOLD_MS,
+        exclude_paths=LOG_EXCLUDE_PATHS,
+    )
+app.add_middleware(RequestIDMiddleware)
+# Hashes final body, including error responses rendered by request ID middleware
+if RESPONSE_HASH_ENABLED:
+    app.add_middleware(ResponseHashMiddleware, max_bytes=HASH_MAX_RESPONSE_BYTES)
+# Outermost of Brood middlewares, so responses generated by other middlewares carry headers too
+if SECURITY_HEADERS_ENABLED:
+    app.add_middleware(SecurityHeadersMiddleware, headers=SECURITY_HEADERS)
+# Counts every request, including ones rejected by other middlewares
+app.add_middleware(InFlightMiddleware)
+
+# Tracing middleware wraps the others, so request ID is attached to the request span
+setup_tracing(app, engine)
+
+app.add_exception_handler(StarletteHTTPException, http_exception_handler)
+app.add_exception_handler(RequestValidationError, validation_exception_handler)
+
 app.mount("/resources", resources_api)
 
 
+# Event loop keeps only weak references to tasks, so running tasks are referenced here
+periodic_tasks: Set[asyncio.Task] = set()
+
+
+@app.on_event("startup")
+async def start_background_tasks() -> None:
+    if not TOKEN_CLEANUP_DISABLED:
+        periodic_tasks.add(asyncio.create_task(tasks.token_reaper()))
+    if CONFIG_RELOAD_INTERVAL_SECONDS > 0:
+        periodic_tasks.add(asyncio.create_task(tasks.config_reloader()))
+    if CONFIG_LISTEN:
+        tasks.start_config_listener()
+    if DB_POOL_PROBE_INTERVAL_SECONDS > 0:
+        periodic_tasks.add(asyncio.create_task(tasks.db_pool_prober()))
+
+
+@app.on_event("shutdown")
+async def stop_background_tasks() -> None:
+    for task in periodic_tasks:
+        task.cancel()
+    periodic_tasks.clear()
+    # Listener threads hold database connections, they exit within their wait timeout
+    config_watcher.stop()
+    resource_events_hub.stop()
+
+
 @app.get("/ping", response_model=data.PingResponse)
 async def ping() -> data.PingResponse:
     return data.PingResponse(status="ok")
 
 
+@app.get("/health", response_model=data.HealthResponse)
+async def health(response: Response) -> data.HealthResponse:
+    """
+    Responds with 503 if worker is shutting down or the last database pool probe failed.
+    in_flight is the number of requests processed by the worker, including this one.
+    """
+    in_flight = drain_state.in_flight
+    if drain_state.draining:
+        response.status_code = 503
+        return data.HealthResponse(status="draining", in_flight=in_flight)
+
+    if DB_POOL_PROBE_INTERVAL_SECONDS == 0:
+        return data.HealthResponse(status="ok", in_flight=in_flight)
+
+    db_pool = data.DBPoolHealthResponse(**pool_probe.status())
+    if db_pool.healthy is False:
+        response.status_code = 503
+        return data.HealthResponse(
+            status="unhealthy", in_flight=in_flight, db_pool=db_pool
+        )
+    return data.HealthResponse(status="ok", in_flight=in_flight, db_pool=db_pool)
+
+
 @app.get("/version", response_model=data.VersionResponse)
 async def version() -> data.VersionResponse:
-    return data.VersionResponse(version=BROOD_VERSION)
+    return data.VersionResponse(
+        version=BROOD_VERSION,
+        commit_hash=BROOD_COMMIT_HASH,
+        python_version=PYTHON_VERSION,
+    )
+
+
+@app.get("/changelog", response_model=List[data.ChangelogEntry])
+async def changelog_handler(limit: int = Query(5, ge=1)) -> List[data.ChangelogEntry]:
+    """
+    Get version history, newest first.
 
+    - **limit** (integer): Maximum number of versions to return
+    """
+    try:
+        entries = load_changelog()
+    except Exception as err:
+        logger.error(f"Unable to load changelog: {str(err)}", extra={"error": err})
+        raise HTTPException(status_code=500)
+    return entries[:limit]
 
-@app.post("/user", tags=["users"], response_model=data.UserResponse)
+
+@app.post("/user", tags=["users"], status_code=201, response_model=data.UserResponse)
 async def create_user_handler(
     request: Request,
+    response: Response,
     background_tasks: BackgroundTasks,
     username: str = Form(...),
     email: str = Form(...),
@@ -102,18 +332,20 @@ async def create_user_handler(
     db_session=Depends(yield_db_session_from_env),
 ) -> data.UserResponse:
     """
-    Create new user.
+    Create new user. Response has status 201 and Location header with path of the user.
 
     - **username** (string): Username
     - **email** (string): New user email
     - **password** (string): New user password
     - **first_name** (string, null): User first name
     - **last_name** (string, null): User last name
-    - **application_id** (uuid, null): External application user belongs to
+    - **application_id** (uuid, null): External application user belongs to, could be passed
+    with application ID header as well
     """
     # If correct BOT_INSTALLATION_TOKEN_HEADER is provided with request it triggers
     # autogenerated user creation.
     autogenerated_user = autogenerated_user_token_check(request)
+    application_id = get_application_id(request, application_id)
 
     try:
         user = actions.create_user(
@@ -126,11 +358,24 @@ async def create_user_handler(
             last_name=last_name,
             application_id=application_id,
         )
+    except actions.UserEmailNormalizedExists:
+        raise LocalizedHTTPException(status_code=409, code="email_exists_normalized")
     except actions.UserAlreadyExists:
         raise HTTPException(
             status_code=409,
             detail="There are conflict when adding a user to the database",
         )
+    except actions.UsernameReserved:
+        raise HTTPException(
+            status_code=422,
+            detail=[
+                {
+                    "loc": ["body", "username"],
+                    "msg": "reserved",
+                    "type": "value_error.reserved",
+                }
+            ],
+        )
     except actions.UsernameInvalidParameters:
         raise HTTPException(
             status_code=422,
@@ -141,10 +386,15 @@ async def create_user_handler(
             status_code=422,
             detail=invalid_password_error.generic_error_message,
         )
+    except actions.EmailDomainBlocked:
+        raise LocalizedHTTPException(status_code=422, code="email_domain_blocked")
+    except actions.EmailDomainNotAllowed:
+        raise LocalizedHTTPException(status_code=422, code="email_domain_not_allowed")
     except Exception as e:
-        logger.error(e)
+        logger.error(e, extra={"error": e})
         raise HTTPException(status_code=500)
 
+    response.headers["Location"] = location_path(request, f"/user/{user.id}")
     if autogenerated_user:
         return user
 
@@ -168,23 +418,41 @@ async def create_user_handler(
 
 @app.post("/token", tags=["tokens"], response_model=data.TokenResponse)
 async def create_token_handler(
+    request: Request,
     form_data: OAuth2PasswordRequestForm = Depends(),
     token_type: Optional[models.TokenType] = Form(models.TokenType.bugout),
     token_note: Optional[str] = Form(None),
     restricted: bool = Form(False),
     application_id: Optional[uuid.UUID] = Form(None),
+    token_ttl: Optional[int] = Form(None),
+    login_type: Optional[data.LoginType] = Form(None),
+    token_name: Optional[str] = Form(None),
+    scopes: Optional[str] = Form(None),
+    include: Optional[str] = Query(None),
     db_session=Depends(yield_db_session_from_env),
-) -> data.TokenResponse:
+) -> Any:
     """
     Generates new token.
     By default type is "bugout" and note is "Bugout login token".
 
-    - **username** (string): Username
+    - **username** (string): Username or email
     - **password** (string): User password
     - **token_type** (string): Token type
     - **token_note** (string, null): Short token description
     - **restricted** (boolean, null): If True, token will be created with restrictions
+    - **application_id** (uuid, null): Application user belongs to, could be passed with
+    application ID header as well. Token is bound to this application and rejected in
+    requests with application ID header of other application
+    - **token_ttl** (integer, null): Token time to live in seconds, server default is applied if not provided
+    - **login_type** (string, null): Look up user only by username or only by email, by default
+    username containing @ is treated as email
+    - **token_name** (string, null): Token name unique among user tokens, up to 64
+    letters, digits or dashes
+    - **scopes** (string, null): Space separated list of token scopes, by default all
+    scopes except token:exchange, which is granted only if requested
+    - **include** (string, null): Pass "user" in query string to embed user in response
     """
+    application_id = get_application_id(request, application_id)
     try:
         token = actions.login(
             session=db_session,
@@ -194,28 +462,56 @@ async def create_token_handler(
             token_note=token_note,
             restricted=restricted,
             application_id=application_id,
+            token_ttl=token_ttl,
+            login_type=login_type,
+            audit_details=request_audit_details(request),
+            token_name=token_name,
+            scopes=scopes.split() if scopes is not None else None,
         )
     except actions.UserNotFound:
-        raise HTTPException(status_code=404, detail="No user with that username")
+        raise HTTPException(
+            status_code=404, detail="No user with that username or email"
+        )
     except actions.UserIncorrectPassword:
         raise HTTPException(status_code=401, detail="Incorrect password")
+    except actions.TokenTTLExceeded as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except actions.TokenInvalidParameters as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except actions.TokenNameExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+    if include == "user":
+        # Response model of the route knows nothing about user field
+        return UTF8JSONResponse(
+            content=jsonable_encoder(data.TokenUserResponse.from_orm(token))
+        )
     return token
 
 
-@app.post("/token/restricted", tags=["tokens"], response_model=data.TokenResponse)
+@app.post(
+    "/token/restricted",
+    tags=["tokens"],
+    status_code=201,
+    response_model=data.TokenResponse,
+)
 async def create_token_restricted_handler(
     token_restricted: bool = Depends(is_token_restricted),
     current_user: models.User = Depends(get_current_user),
     token_type: Optional[models.TokenType] = Form(models.TokenType.bugout),
     token_note: Optional[str] = Form("Bugout restricted token"),
+    token_ttl: Optional[int] = Form(None),
     db_session=Depends(yield_db_session_from_env),
 ) -> data.TokenResponse:
     """
     Generates new restricted token.
     By default type is "bugout" and note is "Bugout restricted token".
 
+    Response has no Location header, as token ID is the token itself.
+
     - **token_type** (string): Token type
     - **token_note** (string): Short token description
+    - **token_ttl** (integer, null): Token time to live in seconds, server default is applied if not provided
     """
     if token_restricted:
         raise HTTPException(
@@ -229,16 +525,34 @@ async def create_token_restricted_handler(
             token_type=token_type,
             token_note=token_note,
             restricted=True,
+            token_ttl=token_ttl,
         )
     except actions.UserNotFound:
         raise HTTPException(status_code=404, detail="No user with that username")
     except actions.UserIncorrectPassword:
         raise HTTPException(status_code=401, detail="Incorrect password")
+    except actions.TokenTTLExceeded as e:
+        raise HTTPException(status_code=400, detail=str(e))
     return token
 
 
+def token_introspection_cache_key(token_id: uuid.UUID) -> str:
+    return f"brood:token_introspection:{token_id}"
+
+
+def evict_token_introspection(token_id: uuid.UUID) -> None:
+    try:
+        cache.delete(token_introspection_cache_key(token_id))
+    except Exception as err:
+        logger.error(
+            f"Unable to evict token introspection from cache: {str(err)}",
+            extra={"error": err},
+        )
+
+
 @app.delete("/token", tags=["tokens"])
 async def delete_token_handler(
+    request: Request,
     access_token: uuid.UUID = Depends(oauth2_scheme),
     target_token: Optional[uuid.UUID] = Form(None),
     db_session=Depends(yield_db_session_from_env),
@@ -250,7 +564,10 @@ async def delete_token_handler(
     """
     try:
         token = actions.revoke_token(
-            session=db_session, token=access_token, target=target_token
+            session=db_session,
+            token=access_token,
+            target=target_token,
+            audit_details=request_audit_details(request),
         )
     except actions.TokenNotFound:
         raise HTTPException(status_code=404, detail="Given token does not exist")
@@ -259,6 +576,7 @@ async def delete_token_handler(
     except exceptions.AccessTokenUnauthorized as e:
         raise HTTPException(status_code=404, detail=str(e))
 
+    evict_token_introspection(token.id)
     return token.id
 
 
@@ -266,7 +584,9 @@ async def delete_token_handler(
 @app.post("/revoke/{access_token}", include_in_schema=False)
 @app.delete("/token/{access_token}", tags=["tokens"])
 async def delete_token_by_id_handler(
-    access_token: uuid.UUID, db_session=Depends(yield_db_session_from_env)
+    request: Request,
+    access_token: uuid.UUID,
+    db_session=Depends(yield_db_session_from_env),
 ) -> uuid.UUID:
     """
     Revoke token by ID.
@@ -274,7 +594,11 @@ async def delete_token_by_id_handler(
     - **access_token** (uuid): Token ID
     """
     try:
-        token = actions.revoke_token(session=db_session, token=access_token)
+        token = actions.revoke_token(
+            session=db_session,
+            token=access_token,
+            audit_details=request_audit_details(request),
+        )
     except actions.TokenNotFound:
         raise HTTPException(status_code=404, detail="Given token does not exist")
     except exceptions.RestrictedTokenUnauthorized as e:
@@ -282,9 +606,50 @@ async def delete_token_by_id_handler(
     except exceptions.AccessTokenUnauthorized as e:
         raise HTTPException(status_code=404, detail=str(e))
 
+    evict_token_introspection(token.id)
     return token.id
 
 
+@app.post(
+    "/tokens/{token_id}/rotate", tags=["tokens"], response_model=data.TokenResponse
+)
+async def rotate_token_handler(
+    token_id: uuid.UUID = Path(...),
+    current_token: models.Token = Depends(get_current_token),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenResponse:
+    """
+    Revoke token and issue new one with the same type, note and lifetime. New token is
+    returned only in this response. Users and service accounts could rotate their own
+    tokens.
+
+    - **token_id** (uuid): Token ID to rotate
+    """
+    if current_token.restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to rotate tokens.",
+        )
+    if current_token.group_id is not None:
+        raise LocalizedHTTPException(status_code=403, code="group_token_not_allowed")
+
+    try:
+        token = actions.rotate_token(
+            db_session, token_id=token_id, current_token=current_token
+        )
+    except actions.TokenNotFound:
+        raise HTTPException(status_code=404, detail="Given token does not exist")
+    except exceptions.AccessTokenUnauthorized:
+        raise HTTPException(status_code=404, detail="Given token does not exist")
+    except exceptions.RestrictedTokenUnauthorized as e:
+        raise HTTPException(status_code=403, detail=str(e))
+    except actions.TokenTTLExceeded as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+    evict_token_introspection(token_id)
+    return token
+
+
 @app.put("/token", tags=["tokens"], response_model=data.TokenResponse)
 async def update_token_handler(
     access_token: uuid.UUID = Form(...),
@@ -317,6 +682,294 @@ async def update_token_handler(
     return token
 
 
+@app.post(
+    "/token/validate", tags=["tokens"], response_model=data.TokenValidationResponse
+)
+async def validate_token_handler(
+    validation_request: data.TokenValidationRequest = Body(...),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenValidationResponse:
+    """
+    Validate token for external services. Token is looked up by ID without fetching its user.
+
+    Intended for machine-to-machine calls, access should be restricted to mTLS at the ingress.
+
+    - **token** (string): Token ID to validate
+    """
+    try:
+        token_id = uuid.UUID(validation_request.token)
+    except ValueError:
+        return data.TokenValidationResponse(valid=False, reason="invalid")
+
+    try:
+        token = actions.get_token(session=db_session, token=token_id)
+    except actions.TokenNotFound:
+        return data.TokenValidationResponse(valid=False, reason="not_found")
+
+    if not token.active:
+        return data.TokenValidationResponse(valid=False, reason="inactive")
+    if actions.is_token_expired(token):
+        return data.TokenValidationResponse(valid=False, reason="expired")
+
+    return data.TokenValidationResponse(
+        valid=True,
+        user_id=token.user_id,
+        service_account_id=token.service_account_id,
+        group_id=token.group_id,
+        impersonated_by=token.impersonated_by,
+        scopes=actions.token_scopes(token),
+        expires_at=token.expires_at,
+    )
+
+
+@app.get(
+    "/token/verify",
+    tags=["tokens"],
+    response_model=data.TokenVerificationResponse,
+    response_model_exclude_none=True,
+)
+async def verify_token_handler(
+    access_token: Optional[str] = Depends(oauth2_scheme_manual),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenVerificationResponse:
+    """
+    Pre-flight check of caller token, returns if it is valid and seconds until it
+    expires.
+
+    Unlike other endpoints, request is not rate limited and not recorded in audit log
+    for impersonation tokens. Missing or unknown tokens are reported as invalid.
+    """
+    if access_token is None:
+        return data.TokenVerificationResponse(valid=False)
+    try:
+        token_id = uuid.UUID(access_token)
+    except ValueError:
+        return data.TokenVerificationResponse(valid=False)
+
+    try:
+        token = actions.get_token(session=db_session, token=token_id)
+    except actions.TokenNotFound:
+        return data.TokenVerificationResponse(valid=False)
+    if not token.active or actions.is_token_expired(token):
+        return data.TokenVerificationResponse(valid=False)
+
+    expires_in: Optional[int] = None
+    if token.expires_at is not None:
+        expires_in = int(
+            (token.expires_at - datetime.now(timezone.utc)).total_seconds()
+        )
+    return data.TokenVerificationResponse(valid=True, expires_in=expires_in)
+
+
+@app.post(
+    "/token/introspect",
+    tags=["tokens"],
+    response_model=data.TokenIntrospectionResponse,
+    response_model_exclude_none=True,
+)
+async def introspect_token_handler(
+    access_token: uuid.UUID = Depends(oauth2_scheme),
+    token: Optional[str] = Form(None),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenIntrospectionResponse:
+    """
+    Token introspection analogous to RFC 7662. Caller token requires token:introspect scope.
+
+    Expired, revoked or unknown tokens are reported as inactive without any metadata.
+
+    - **token** (string): Token ID to introspect
+    """
+    try:
+        caller_token = actions.get_token(session=db_session, token=access_token)
+    except actions.TokenNotFound:
+        raise HTTPException(status_code=404, detail="Access token not found")
+    if not caller_token.active or actions.is_token_expired(caller_token):
+        raise HTTPException(status_code=403, detail="Token has expired")
+    if "token:introspect" not in actions.token_scopes(caller_token):
+        raise HTTPException(
+            status_code=403,
+            detail="Token is not authorized to introspect tokens.",
+        )
+
+    if token is None or token == "":
+        raise HTTPException(status_code=400, detail="Token to introspect is required")
+    try:
+        token_id = uuid.UUID(token)
+    except ValueError:
+        return data.TokenIntrospectionResponse(active=False)
+
+    cache_key = token_introspection_cache_key(token_id)
+    try:
+        return data.TokenIntrospectionResponse.parse_raw(cache.get(cache_key))
+    except CacheMiss:
+        pass
+    except Exception as err:
+        logger.error(
+            f"Unable to read token introspection from cache: {str(err)}",
+            extra={"error": err},
+        )
+
+    try:
+        token_object = actions.get_token(session=db_session, token=token_id)
+    except actions.TokenNotFound:
+        return data.TokenIntrospectionResponse(active=False)
+    if not token_object.active or actions.is_token_expired(token_object):
+        return data.TokenIntrospectionResponse(active=False)
+
+    # Group tokens are not bound to application
+    application_id: Optional[uuid.UUID] = None
+    if token_object.service_account is not None:
+        application_id = token_object.service_account.application_id
+    elif token_object.user is not None:
+        application_id = token_object.user.application_id
+    introspection = data.TokenIntrospectionResponse(
+        active=True,
+        user_id=token_object.user_id,
+        service_account_id=token_object.service_account_id,
+        group_id=token_object.group_id,
+        impersonated_by=token_object.impersonated_by,
+        scopes=actions.token_scopes(token_object),
+        token_type=token_object.token_type,
+        expires_at=token_object.expires_at,
+        application_id=application_id,
+    )
+    # Cached introspection must not outlive the token
+    cache_ttl = TOKEN_INTROSPECTION_CACHE_TTL_SECONDS
+    if token_object.expires_at is not None:
+        seconds_to_expire = (
+            token_object.expires_at - datetime.now(timezone.utc)
+        ).total_seconds()
+        cache_ttl = min(cache_ttl, int(seconds_to_expire))
+    try:
+        if cache_ttl > 0:
+            cache.set(cache_key, introspection.json(), ttl=cache_ttl)
+    except Exception as err:
+        logger.error(
+            f"Unable to cache token introspection: {str(err)}", extra={"error": err}
+        )
+
+    return introspection
+
+
+@app.post("/token/exchange", tags=["tokens"], response_model=data.TokenResponse)
+async def exchange_token_handler(
+    request: Request,
+    access_token: uuid.UUID = Depends(oauth2_scheme),
+    target_application_id: uuid.UUID = Form(...),
+    scopes: Optional[str] = Form(None),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenResponse:
+    """
+    Exchanges caller token for a short-lived token bound to another application.
+    Caller token requires token:exchange scope, which is granted only on explicit
+    request, and its owner must have access to the application.
+
+    Derived token has only scopes which caller token has and could not be exchanged
+    or rotated further.
+
+    - **target_application_id** (uuid): Application ID derived token is bound to
+    - **scopes** (string, null): Space separated list of requested scopes, by default
+    all scopes of caller token
+    """
+    try:
+        caller_token = actions.get_token(session=db_session, token=access_token)
+    except actions.TokenNotFound:
+        raise HTTPException(status_code=404, detail="Access token not found")
+    if not caller_token.active or actions.is_token_expired(caller_token):
+        raise HTTPException(status_code=403, detail="Token has expired")
+    if caller_token.impersonated_by is not None:
+        raise HTTPException(
+            status_code=403, detail="Impersonation tokens could not be exchanged"
+        )
+
+    requested_scopes: Optional[List[str]] = None
+    if scopes is not None:
+        requested_scopes = scopes.split()
+
+    try:
+        token = actions.exchange_token(
+            db_session,
+            caller_token,
+            target_application_id,
+            requested_scopes=requested_scopes,
+            audit_details=request_audit_details(request),
+        )
+    except exceptions.AccessTokenUnauthorized as e:
+        raise HTTPException(status_code=403, detail=str(e))
+    except exceptions.ApplicationsNotFound:
+        raise HTTPException(status_code=404, detail="Application not found")
+    except Exception as err:
+        logger.error(
+            f"Unhandled error during token exchange: {str(err)}", extra={"error": err}
+        )
+        raise HTTPException(status_code=500)
+
+    return token
+
+
+@app.get("/token/by-name/{name}", tags=["tokens"], response_model=data.TokenResponse)
+async def get_token_by_name_handler(
+    name: str = Path(...),
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenResponse:
+    """
+    Get token of current user by its name.
+
+    - **name** (string): Token name
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to get user tokens.",
+        )
+    try:
+        token = actions.get_token_by_name(
+            db_session, user_id=current_user.id, name=name
+        )
+    except actions.TokenNotFound:
+        raise HTTPException(status_code=404, detail="Given token does not exist")
+
+    return token
+
+
+@app.patch("/token/{token_id}", tags=["tokens"], response_model=data.TokenResponse)
+async def update_token_name_handler(
+    token_id: uuid.UUID = Path(...),
+    name: str = Form(...),
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenResponse:
+    """
+    Rename token of current user.
+
+    - **token_id** (uuid): Token ID
+    - **name** (string): Token name unique among user tokens, up to 64 letters, digits
+    or dashes
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to update tokens.",
+        )
+    try:
+        token = actions.update_token_name(
+            db_session, user_id=current_user.id, token_id=token_id, name=name
+        )
+    except actions.TokenNotFound:
+        raise HTTPException(status_code=404, detail="Given token does not exist")
+    except exceptions.AccessTokenUnauthorized:
+        raise HTTPException(status_code=404, detail="Given token does not exist")
+    except actions.TokenInvalidParameters as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except actions.TokenNameExists as e:
+        raise HTTPException(status_code=409, detail=str(e))
+
+    return token
+
+
 @app.get("/token/types", tags=["tokens"])
 async def get_token_types_handler(
     _: models.User = Depends(get_current_user),
@@ -365,11 +1018,14 @@ async def get_tokens_handler(
 
 @app.get("/user", tags=["users"], response_model=data.UserResponse)
 async def get_user_handler(
+    response: Response,
     current_user: models.User = Depends(get_current_user),
     db_session=Depends(yield_db_session_from_env),
 ) -> data.UserResponse:
     """
     Get current user.
+
+    Response contains ETag header which could be passed as If-Match header to update user.
     """
     try:
         user = actions.get_user(
@@ -383,74 +1039,260 @@ async def get_user_handler(
         logger.error("Unhandled error")
         raise HTTPException(status_code=500)
 
+    response.headers["ETag"] = actions.user_etag(user)
     return user
 
 
-@app.get("/user/find", tags=["users"], response_model=data.UserResponse)
-async def find_user_handler(
-    token_restricted: bool = Depends(is_token_restricted_or_installation),
-    _: Optional[models.User] = Depends(get_current_user_or_installation),
+user_availability_limiter = TokenBucketLimiter(
+    capacity=USER_AVAILABILITY_RATE_LIMIT,
+    refill_rate=USER_AVAILABILITY_RATE_LIMIT / 60,
+)
+
+
+@app.get(
+    "/user/available", tags=["users"], response_model=data.UserAvailabilityResponse
+)
+async def user_availability_handler(
+    request: Request,
     username: Optional[str] = Query(None),
     email: Optional[str] = Query(None),
-    user_id: Optional[uuid.UUID] = Query(None),
     application_id: Optional[uuid.UUID] = Query(None),
     db_session=Depends(yield_db_session_from_env),
-) -> data.UserResponse:
+) -> data.UserAvailabilityResponse:
     """
-    Search for users.
+    Check if username or email is available for registration. Only one of them could be checked
+    per request and requests are rate limited per IP to prevent enumeration of users.
 
     - **username** (string, null): Username
     - **email** (string, null): User email
-    - **user_id** (uuid, null): User ID
-    - **application_id** (uuid, null): Application ID
+    - **application_id** (uuid, null): Application ID, could be passed with application ID
+    header as well
     """
-    if token_restricted:
+    if not user_availability_limiter.allow(client_ip(request)):
         raise HTTPException(
-            status_code=403,
-            detail="Restricted tokens are not authorized to find users.",
+            status_code=429,
+            detail="Too many requests, try again later",
+            headers={"Retry-After": str(user_availability_limiter.retry_after())},
+        )
+
+    if (username is None) == (email is None):
+        raise HTTPException(
+            status_code=400,
+            detail="You must specify exactly one of the following query parameters: username,email",
         )
+    application_id = get_application_id(request, application_id)
+
+    if username is not None:
+        try:
+            actions.verify_username_not_reserved(username)
+        except actions.UsernameReserved:
+            return data.UserAvailabilityResponse(available=False)
 
     try:
-        user = actions.get_user(
+        actions.get_user(
             session=db_session,
             username=username,
             email=email,
-            user_id=user_id,
             application_id=application_id,
         )
-    except actions.UserInvalidParameters:
-        raise HTTPException(
-            status_code=400,
-            detail="You must specify one of the following query parameters: username,email",
-        )
     except actions.UserNotFound:
-        raise HTTPException(status_code=404, detail="No users matched your query")
-    return data.UserResponse(
-        id=user.id,
-        username=user.username,
-        verified=user.verified,
-        created_at=user.created_at,
-        updated_at=user.updated_at,
-        autogenerated=user.autogenerated,
-        application_id=user.application_id,
-    )
+        return data.UserAvailabilityResponse(available=True)
 
+    return data.UserAvailabilityResponse(available=False)
 
-@app.get("/user/{user_id}", tags=["users"], response_model=data.UserResponse)
-async def get_user_by_id_handler(
-    user_id: uuid.UUID = Path(...),
-    current_user: models.User = Depends(get_current_user),
-    db_session=Depends(yield_db_session_from_env),
-) -> data.UserResponse:
-    """
-    Get user by ID.
 
-    - **user_id** (uuid, null): User ID
-    """
-    if user_id != current_user.id:
-        raise HTTPException(
-            status_code=403, detail="You do not have permission to view this resource"
-        )
+user_export_limiter = TokenBucketLimiter(capacity=1, refill_rate=1 / 3600)
+
+
+def json_array_chunks(items: Iterable[Dict[str, Any]]) -> Iterator[str]:
+    yield "["
+    for index, item in enumerate(items):
+        yield ("," if index > 0 else "") + json.dumps(item)
+    yield "]"
+
+
+def user_export_chunks(user_id: uuid.UUID) -> Iterator[str]:
+    # Response is streamed after request dependencies are closed, so it uses own session
+    db_session = SessionLocal()
+    try:
+        user = actions.get_user(db_session, user_id=user_id)
+        profile = actions.user_as_json_dict(user)
+        del profile["tokens"]
+        profile.update(
+            {
+                "first_name": user.first_name,
+                "last_name": user.last_name,
+                "application_id": str(user.application_id)
+                if user.application_id is not None
+                else None,
+                "profile": user.profile,
+            }
+        )
+        yield '{"profile": ' + json.dumps(profile)
+
+        emails = [
+            {
+                "email": user.email,
+                "normalized_email": user.normalized_email,
+                "verified": user.verified,
+            }
+        ]
+        yield ', "emails": ' + json.dumps(emails)
+
+        yield ', "groups": '
+        yield from json_array_chunks(
+            {**actions.group_users_as_json_dict(group), "group_name": group.group_name}
+            for group in actions.get_groups_for_user(db_session, user_id)
+        )
+
+        # Token ID is the access token itself, only metadata is exported
+        yield ', "tokens": '
+        yield from json_array_chunks(
+            {key: value for key, value in token.items() if key != "id"}
+            for token in (actions.token_as_json_dict(token) for token in user.tokens)
+        )
+
+        yield ', "resources": '
+        yield from json_array_chunks(
+            {
+                "id": str(resource.id),
+                "application_id": str(resource.application_id),
+                "resource_data": resource.resource_data,
+                "created_at": str(resource.created_at),
+            }
+            for resource in resources_actions.iter_user_resources(db_session, user_id)
+        )
+
+        yield ', "audit_events": '
+        yield from json_array_chunks(
+            actions.audit_event_as_json_dict(audit_event)
+            for audit_event in actions.iter_user_audit_events(db_session, user_id)
+        )
+        yield "}"
+    finally:
+        db_session.close()
+
+
+@app.get("/user/export", tags=["users"])
+async def export_user_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+) -> StreamingResponse:
+    """
+    Export all data of current user: profile, emails, groups, tokens metadata, resources
+    and account events. Export could be requested once per hour.
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to export user data.",
+        )
+    if not user_export_limiter.allow(str(current_user.id)):
+        raise HTTPException(
+            status_code=429,
+            detail="User data could be exported once per hour",
+            headers={"Retry-After": str(user_export_limiter.retry_after())},
+        )
+
+    return StreamingResponse(
+        user_export_chunks(current_user.id), media_type=JSON_MEDIA_TYPE
+    )
+
+
+def user_viewer_role(
+    user: models.User, caller: Union[models.User, bool]
+) -> data.UserViewerRole:
+    """
+    Installation token callers (caller is True) are treated as public.
+    """
+    if not isinstance(caller, models.User):
+        return data.UserViewerRole.public
+    if caller.is_admin or caller.is_super_admin:
+        return data.UserViewerRole.admin
+    if caller.id == user.id:
+        return data.UserViewerRole.self
+    return data.UserViewerRole.public
+
+
+def redact_user(user: models.User, role: data.UserViewerRole) -> data.UserResponse:
+    """
+    Builds user response with set of fields visible to the caller role. Public callers
+    do not see email, admin flags and profile, user itself does not see admin flags.
+    """
+    user_response = data.UserResponse.from_orm(user)
+    if role != data.UserViewerRole.admin:
+        user_response.is_admin = None
+        user_response.is_super_admin = None
+    if role == data.UserViewerRole.public:
+        user_response.email = None
+        user_response.normalized_email = None
+        user_response.profile = None
+    return user_response
+
+
+@app.get("/user/find", tags=["users"], response_model=data.UserResponse)
+async def find_user_handler(
+    token_restricted: bool = Depends(is_token_restricted_or_installation),
+    current_user: Union[models.User, bool] = Depends(get_current_user_or_installation),
+    username: Optional[str] = Query(None),
+    email: Optional[str] = Query(None),
+    user_id: Optional[uuid.UUID] = Query(None),
+    application_id: Optional[uuid.UUID] = Query(None),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.UserResponse:
+    """
+    Search for users.
+
+    - **username** (string, null): Username
+    - **email** (string, null): User email
+    - **user_id** (uuid, null): User ID
+    - **application_id** (uuid, null): Application ID
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to find users.",
+        )
+
+    try:
+        user = actions.get_user(
+            session=db_session,
+            username=username,
+            email=email,
+            user_id=user_id,
+            application_id=application_id,
+        )
+    except actions.UserInvalidParameters:
+        raise HTTPException(
+            status_code=400,
+            detail="You must specify one of the following query parameters: username,email",
+        )
+    except actions.UserNotFound:
+        raise HTTPException(status_code=404, detail="No users matched your query")
+
+    return redact_user(user, user_viewer_role(user, current_user))
+
+
+@app.get("/user/{user_id}", tags=["users"], response_model=data.UserResponse)
+async def get_user_by_id_handler(
+    user_id: uuid.UUID = Path(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.UserResponse:
+    """
+    Get user by ID. Available for the user itself and admins, admin flags are visible
+    only to admins.
+
+    - **user_id** (uuid, null): User ID
+    """
+    if (
+        user_id != current_user.id
+        and not current_user.is_admin
+        and not current_user.is_super_admin
+    ):
+        raise HTTPException(
+            status_code=403, detail="You do not have permission to view this resource"
+        )
     try:
         user = actions.get_user(session=db_session, user_id=user_id)
     except actions.UserInvalidParameters:
@@ -458,7 +1300,7 @@ async def get_user_by_id_handler(
     except actions.UserNotFound:
         raise HTTPException(status_code=404, detail="No user with that user id")
 
-    return user
+    return redact_user(user, user_viewer_role(user, current_user))
 
 
 @app.post("/confirm", tags=["users"], response_model=data.UserResponse)
@@ -568,6 +1410,7 @@ async def reset_password_confirmation_handler(
 )
 @app.post("/password/change", tags=["users"], response_model=data.UserResponse)
 async def change_password_handler(
+    request: Request,
     token_restricted: bool = Depends(is_token_restricted),
     current_user: models.User = Depends(get_current_user),
     new_password: str = Form(...),
@@ -592,6 +1435,7 @@ async def change_password_handler(
             new_password=new_password,
             current_password=current_password,
             user_id=current_user.id,
+            audit_details=request_audit_details(request),
         )
     except actions.UserInvalidParameters:
         raise HTTPException(status_code=400, detail="Invalid user parameters")
@@ -603,82 +1447,790 @@ async def change_password_handler(
             detail=invalid_password_error.generic_error_message,
         )
 
-    return user
+    return user
+
+
+@app.post("/user/me/password", tags=["users"], status_code=204)
+async def change_my_password_handler(
+    request: Request,
+    access_token: uuid.UUID = Depends(oauth2_scheme),
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+    old_password: str = Form(...),
+    new_password: str = Form(...),
+    db_session=Depends(yield_db_session_from_env),
+) -> Response:
+    """
+    Change password of current user, all other sessions of the user are logged out.
+
+    - **old_password** (string): Current user password
+    - **new_password** (string): New user password
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to change passwords.",
+        )
+
+    try:
+        actions.change_password(
+            db_session,
+            new_password=new_password,
+            current_password=old_password,
+            user_id=current_user.id,
+            audit_details=request_audit_details(request),
+        )
+    except actions.UserIncorrectPassword:
+        raise HTTPException(status_code=403, detail={"code": "wrong_password"})
+    except actions.PasswordInvalidParameters as invalid_password_error:
+        raise HTTPException(
+            status_code=422,
+            detail=invalid_password_error.generic_error_message,
+        )
+
+    revoked_tokens = actions.revoke_user_tokens(
+        db_session, user_id=current_user.id, except_token=access_token
+    )
+    for token_id in revoked_tokens:
+        evict_token_introspection(token_id)
+
+    return Response(status_code=204)
+
+
+def webauthn_options_response(options_json: str, session_id: str) -> Response:
+    """
+    Responds with WebAuthn options and sets cookie with session of the ceremony.
+    """
+    response = Response(content=options_json, media_type="application/json")
+    response.set_cookie(
+        passkeys.WEBAUTHN_SESSION_COOKIE,
+        session_id,
+        max_age=passkeys.WEBAUTHN_CHALLENGE_TTL_SECONDS,
+        httponly=True,
+        secure=True,
+        samesite="none",
+    )
+    return response
+
+
+@app.post("/user/me/webauthn/register/begin", tags=["users"])
+async def webauthn_register_begin_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> Response:
+    """
+    Starts passkey registration for current user. Returns
+    PublicKeyCredentialCreationOptions to be passed to navigator.credentials.create(),
+    challenge expires in 5 minutes.
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to register passkeys.",
+        )
+
+    credentials = actions.get_webauthn_credentials(db_session, current_user.id)
+    options_json, challenge = passkeys.registration_options(current_user, credentials)
+    try:
+        session_id = passkeys.store_challenge(
+            passkeys.REGISTRATION_CEREMONY, challenge, current_user.id
+        )
+    except Exception as err:
+        logger.error(
+            f"Unable to store WebAuthn challenge: {str(err)}", extra={"error": err}
+        )
+        raise HTTPException(status_code=500)
+
+    return webauthn_options_response(options_json, session_id)
+
+
+@app.post(
+    "/user/me/webauthn/register/complete",
+    tags=["users"],
+    response_model=data.WebAuthnCredentialResponse,
+)
+async def webauthn_register_complete_handler(
+    request: Request,
+    response: Response,
+    credential: Dict[str, Any] = Body(...),
+    webauthn_session: Optional[str] = Cookie(
+        None, alias=passkeys.WEBAUTHN_SESSION_COOKIE
+    ),
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.WebAuthnCredentialResponse:
+    """
+    Completes passkey registration with response of navigator.credentials.create().
+
+    - **credential** (dict): Registration credential in JSON
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to register passkeys.",
+        )
+
+    try:
+        challenge = passkeys.pop_challenge(
+            webauthn_session, passkeys.REGISTRATION_CEREMONY
+        )
+    except exceptions.WebAuthnChallengeNotFound as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    if challenge.user_id != current_user.id:
+        raise HTTPException(
+            status_code=400, detail="WebAuthn challenge was issued for another user"
+        )
+    try:
+        verified_credential = passkeys.verify_registration(
+            credential, challenge.challenge
+        )
+    except exceptions.WebAuthnVerificationFailed as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+    webauthn_credential = actions.create_webauthn_credential(
+        db_session,
+        user_id=current_user.id,
+        credential_id=verified_credential.credential_id,
+        public_key=verified_credential.public_key,
+        sign_count=verified_credential.sign_count,
+        aaguid=verified_credential.aaguid,
+        audit_details=request_audit_details(request),
+    )
+    response.delete_cookie(passkeys.WEBAUTHN_SESSION_COOKIE)
+    return webauthn_credential
+
+
+@app.post("/auth/webauthn/login/begin", tags=["users"])
+async def webauthn_login_begin_handler(
+    request: Request,
+    username: str = Form(...),
+    login_type: Optional[data.LoginType] = Form(None),
+    application_id: Optional[uuid.UUID] = Form(None),
+    db_session=Depends(yield_db_session_from_env),
+) -> Response:
+    """
+    Starts passwordless login with passkey. Returns PublicKeyCredentialRequestOptions
+    to be passed to navigator.credentials.get(), challenge expires in 5 minutes.
+
+    Unknown users and users without passkeys receive options of the same shape, so the
+    response does not reveal if user exists.
+
+    - **username** (string): Username or email
+    - **login_type** (string, null): Look up user only by username or only by email
+    - **application_id** (uuid, null): Application user belongs to, could be passed with
+    application ID header as well
+    """
+    application_id = get_application_id(request, application_id)
+    user_id: Optional[uuid.UUID] = None
+    credentials: List[models.WebAuthnCredential] = []
+    try:
+        user = actions.get_user_by_login(
+            db_session, username, login_type=login_type, application_id=application_id
+        )
+        user_id = user.id
+        credentials = actions.get_webauthn_credentials(db_session, user.id)
+    except actions.UserNotFound:
+        pass
+
+    if credentials:
+        options_json, challenge = passkeys.authentication_options(credentials)
+    else:
+        options_json, challenge = passkeys.decoy_authentication_options(
+            username, application_id
+        )
+    try:
+        session_id = passkeys.store_challenge(
+            passkeys.AUTHENTICATION_CEREMONY,
+            challenge,
+            user_id,
+            application_id=application_id,
+        )
+    except Exception as err:
+        logger.error(
+            f"Unable to store WebAuthn challenge: {str(err)}", extra={"error": err}
+        )
+        raise HTTPException(status_code=500)
+
+    return webauthn_options_response(options_json, session_id)
+
+
+@app.post(
+    "/auth/webauthn/login/complete", tags=["users"], response_model=data.TokenResponse
+)
+async def webauthn_login_complete_handler(
+    request: Request,
+    response: Response,
+    credential: Dict[str, Any] = Body(...),
+    webauthn_session: Optional[str] = Cookie(
+        None, alias=passkeys.WEBAUTHN_SESSION_COOKIE
+    ),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenResponse:
+    """
+    Completes passwordless login with response of navigator.credentials.get() and
+    generates new token.
+
+    - **credential** (dict): Authentication credential in JSON
+    """
+    try:
+        challenge = passkeys.pop_challenge(
+            webauthn_session, passkeys.AUTHENTICATION_CEREMONY
+        )
+    except exceptions.WebAuthnChallengeNotFound as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    try:
+        webauthn_credential = actions.get_webauthn_credential(
+            db_session, passkeys.assertion_credential_id(credential)
+        )
+        if webauthn_credential.user_id != challenge.user_id:
+            raise exceptions.WebAuthnVerificationFailed(
+                "Credential belongs to another user"
+            )
+        sign_count = passkeys.verify_authentication(
+            credential, challenge.challenge, webauthn_credential
+        )
+    except (
+        exceptions.WebAuthnCredentialNotFound,
+        exceptions.WebAuthnVerificationFailed,
+    ) as e:
+        if challenge.user_id is not None:
+            actions.record_login_attempt(
+                db_session,
+                user_id=challenge.user_id,
+                success=False,
+                audit_details=request_audit_details(request),
+            )
+            db_session.commit()
+        raise HTTPException(status_code=401, detail=str(e))
+
+    try:
+        token = actions.webauthn_login(
+            db_session,
+            webauthn_credential,
+            sign_count,
+            application_id=challenge.application_id,
+            audit_details=request_audit_details(request),
+        )
+    except actions.TokenTTLExceeded as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    response.delete_cookie(passkeys.WEBAUTHN_SESSION_COOKIE)
+    return token
+
+
+# Audit event details never returned to users
+ACTIVITY_REDACTED_DETAILS = {"token", "token_id", "access_token", "password"}
+
+
+def encode_activity_cursor(
+    event: Union[models.AuditEvent, models.LoginHistory]
+) -> str:
+    raw_cursor = f"{event.created_at.isoformat()}|{event.id}"
+    return base64.urlsafe_b64encode(raw_cursor.encode()).decode()
+
+
+def decode_activity_cursor(cursor: str) -> Tuple[datetime, uuid.UUID]:
+    raw_cursor = base64.urlsafe_b64decode(cursor.encode()).decode()
+    created_at, _, event_id = raw_cursor.partition("|")
+    return datetime.fromisoformat(created_at), uuid.UUID(event_id)
+
+
+@app.get("/user/me/activity", tags=["users"], response_model=data.ActivityListResponse)
+async def get_user_activity_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    limit: int = Query(20, ge=1, le=100),
+    cursor: Optional[str] = Query(None),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ActivityListResponse:
+    """
+    Get account events of current user (logins, password changes, admin flag changes),
+    newest first.
+
+    - **limit** (integer): Maximum number of events to return
+    - **cursor** (string, null): next_cursor from previous page
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to view user activity.",
+        )
+
+    decoded_cursor = None
+    if cursor is not None:
+        try:
+            decoded_cursor = decode_activity_cursor(cursor)
+        except Exception:
+            raise HTTPException(status_code=400, detail="Invalid cursor")
+
+    events = actions.get_user_activity(
+        db_session, user_id=current_user.id, limit=limit, cursor=decoded_cursor
+    )
+
+    activity = data.ActivityListResponse()
+    for event in events:
+        details = {
+            key: value
+            for key, value in (event.details or {}).items()
+            if key not in ACTIVITY_REDACTED_DETAILS
+        }
+        activity.events.append(
+            data.ActivityEventResponse(
+                action=event.event_type,
+                created_at=event.created_at,
+                ip=details.pop("ip", None),
+                device=details.pop("device", None),
+                request_id=details.pop("request_id", None),
+                details=details,
+            )
+        )
+    if len(events) == limit:
+        activity.next_cursor = encode_activity_cursor(events[-1])
+    return activity
+
+
+@app.get(
+    "/user/me/login-history",
+    tags=["users"],
+    response_model=data.LoginHistoryListResponse,
+)
+async def get_user_login_history_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    limit: int = Query(10, ge=1, le=100),
+    cursor: Optional[str] = Query(None),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.LoginHistoryListResponse:
+    """
+    Get successful and failed login attempts of current user, newest first.
+
+    - **limit** (integer): Maximum number of entries to return
+    - **cursor** (string, null): next_cursor from previous page
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to view login history.",
+        )
+
+    decoded_cursor = None
+    if cursor is not None:
+        try:
+            decoded_cursor = decode_activity_cursor(cursor)
+        except Exception:
+            raise HTTPException(status_code=400, detail="Invalid cursor")
+
+    entries = actions.get_login_history(
+        db_session, user_id=current_user.id, limit=limit, cursor=decoded_cursor
+    )
+
+    login_history = data.LoginHistoryListResponse(
+        entries=[
+            data.LoginHistoryEntryResponse(
+                created_at=entry.created_at,
+                ip=entry.ip,
+                user_agent=entry.user_agent,
+                success=entry.success,
+            )
+            for entry in entries
+        ]
+    )
+    if len(entries) == limit:
+        login_history.next_cursor = encode_activity_cursor(entries[-1])
+    return login_history
+
+
+@app.put("/user", tags=["users"], response_model=data.UserResponse)
+async def update_user_handler(
+    response: Response,
+    token_restricted: bool = Depends(is_token_restricted),
+    first_name: Optional[str] = Form(None),
+    last_name: Optional[str] = Form(None),
+    if_match: Optional[str] = Header(None),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.UserResponse:
+    """
+    Update user information.
+
+    - **first_name** (string): First user name
+    - **last_name** (string):  Last user name
+
+    If-Match header with ETag from previous user response makes update conditional, request
+    fails with 412 if user was modified since then.
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to update users.",
+        )
+
+    expected_updated_at = None
+    if if_match is not None:
+        if if_match != actions.user_etag(current_user):
+            raise HTTPException(
+                status_code=412, detail="User was modified, fetch it and try again"
+            )
+        expected_updated_at = current_user.updated_at
+
+    try:
+        user = actions.update_user(
+            db_session,
+            current_user.id,
+            first_name,
+            last_name,
+            expected_updated_at=expected_updated_at,
+        )
+    except actions.UserInvalidParameters:
+        raise HTTPException(status_code=400, detail="Invalid user parameters")
+    except actions.UserPreconditionFailed:
+        raise HTTPException(
+            status_code=412, detail="User was modified, fetch it and try again"
+        )
+    except Exception as err:
+        logger.error(
+            f"Unhandled error in update_user_handler: {str(err)}", extra={"error": err}
+        )
+        raise HTTPException(status_code=500)
+
+    response.headers["ETag"] = actions.user_etag(user)
+    return user
+
+
+@app.post(
+    "/user/delete/request",
+    tags=["users"],
+    response_model=data.UserDeletionConfirmationResponse,
+)
+async def request_user_deletion_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.UserDeletionConfirmationResponse:
+    """
+    Issue short-lived token to confirm deletion of current user, it should be passed to
+    DELETE /user/{user_id} in X-Delete-Confirmation header.
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to delete users.",
+        )
+
+    confirmation = actions.create_user_deletion_confirmation(
+        db_session, user_id=current_user.id
+    )
+    return data.UserDeletionConfirmationResponse(
+        confirmation_token=confirmation.id, expires_at=confirmation.expires_at
+    )
+
+
+@app.delete("/user/{user_id}", tags=["users"], response_model=data.UserResponse)
+async def delete_user_handler(
+    request: Request,
+    token_restricted: bool = Depends(is_token_restricted),
+    user_id: uuid.UUID = Path(...),
+    password: str = Form(None),
+    delete_confirmation: Optional[uuid.UUID] = Header(
+        None, alias="X-Delete-Confirmation"
+    ),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.UserResponse:
+    """
+    Delete user by ID. Regular user deletion impossible without provided password and
+    confirmation token from POST /user/delete/request in X-Delete-Confirmation header.
+
+    - **user_id** (uuid): User ID
+    - **password** (string): User password
+    """
+    # Autogenerated user deletion impossible without installation header.
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to delete users.",
+        )
+    if user_id != current_user.id:
+        raise HTTPException(
+            status_code=403, detail="You do not have permission to delete this resource"
+        )
+    autogenerated_user = autogenerated_user_token_check(request)
+    if autogenerated_user != current_user.autogenerated:
+        raise HTTPException(status_code=403, detail="Autogenerated user bypass failed")
+    deletion_confirmation: Optional[models.UserDeletionConfirmation] = None
+    if not current_user.autogenerated:
+        try:
+            deletion_confirmation = actions.check_user_deletion_confirmation(
+                db_session, user_id=user_id, confirmation_id=delete_confirmation
+            )
+        except actions.UserDeletionNotConfirmed as e:
+            raise HTTPException(status_code=403, detail=str(e))
+    token_ids = actions.get_user_token_ids(db_session, user_id)
+    try:
+        user = actions.delete_user(
+            session=db_session,
+            user_id=user_id,
+            current_password=password,
+            deletion_confirmation=deletion_confirmation,
+        )
+    except actions.UserInvalidParameters:
+        raise HTTPException(status_code=400, detail="Invalid user parameters")
+    except actions.UserNotFound:
+        raise HTTPException(status_code=404, detail="No user with that user id")
+    except actions.UserIncorrectPassword:
+        raise HTTPException(status_code=401, detail="Incorrect password")
+
+    for token_id in token_ids:
+        evict_token_introspection(token_id)
+    return user
+
+
+@app.patch("/user/{user_id}/profile", tags=["users"], response_model=data.UserResponse)
+async def update_user_profile_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    user_id: uuid.UUID = Path(...),
+    profile: Any = Body(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.UserResponse:
+    """
+    Replace user profile metadata like display name or avatar URL.
+
+    - **user_id** (uuid): User ID
+    - **profile** (object): JSON object up to 16 KiB
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to update users.",
+        )
+    if user_id != current_user.id:
+        raise HTTPException(
+            status_code=403, detail="You do not have permission to update this resource"
+        )
+    try:
+        user = actions.update_user_profile(db_session, user_id, profile)
+    except actions.UserInvalidParameters as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except actions.UserProfileTooLarge as e:
+        raise HTTPException(status_code=413, detail=str(e))
+    except actions.UserNotFound:
+        raise HTTPException(status_code=404, detail="No user with that user id")
+
+    return user
+
+
+@app.patch("/user/{user_id}/admin", tags=["users"], response_model=data.UserResponse)
+async def update_user_admin_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    user_id: uuid.UUID = Path(...),
+    is_admin: Optional[bool] = Form(None),
+    is_super_admin: Optional[bool] = Form(None),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.UserResponse:
+    """
+    Grant or revoke admin flags of user. Available only for super-admins.
+
+    - **user_id** (uuid): User ID
+    - **is_admin** (boolean, null): Admin flag
+    - **is_super_admin** (boolean, null): Super-admin flag, could not be revoked by user itself
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to manage admins.",
+        )
+    try:
+        user = actions.set_user_admin_flags(
+            session=db_session,
+            current_user=current_user,
+            user_id=user_id,
+            is_admin=is_admin,
+            is_super_admin=is_super_admin,
+        )
+    except actions.UserInvalidParameters:
+        raise HTTPException(status_code=400, detail="Invalid admin flags")
+    except actions.NoPermissions:
+        raise HTTPException(
+            status_code=403, detail="Only super-admins could manage admin flags"
+        )
+    except actions.SuperAdminSelfRevocation:
+        raise HTTPException(
+            status_code=403, detail="You could not revoke your own super-admin flag"
+        )
+    except actions.UserNotFound:
+        raise HTTPException(status_code=404, detail="No user with that user id")
+
+    return user
+
+
+USERS_EXPORT_FLUSH_ROWS = 100
+
+
+def users_export_lines() -> Iterator[str]:
+    # Response is streamed after request dependencies are closed, so it uses own session
+    db_session = SessionLocal()
+    try:
+        lines: List[str] = []
+        for user in actions.iter_users(db_session):
+            lines.append(data.UserResponse.from_orm(user).json(by_alias=True) + "\n")
+            if len(lines) >= USERS_EXPORT_FLUSH_ROWS:
+                yield "".join(lines)
+                lines = []
+        if lines:
+            yield "".join(lines)
+    finally:
+        db_session.close()
+
+
+@app.get("/admin/users/export", tags=["users"])
+async def export_users_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+) -> StreamingResponse:
+    """
+    Export all users as newline-delimited JSON, one user per line. Available only for
+    admins.
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to export users.",
+        )
+    if not current_user.is_admin and not current_user.is_super_admin:
+        raise HTTPException(status_code=403, detail="Only admins could export users")
+
+    return StreamingResponse(users_export_lines(), media_type="application/x-ndjson")
 
 
-@app.put("/user", tags=["users"], response_model=data.UserResponse)
-async def update_user_handler(
+@app.post("/admin/config/reload", tags=["users"], response_model=data.ConfigResponse)
+async def reload_config_handler(
     token_restricted: bool = Depends(is_token_restricted),
-    first_name: Optional[str] = Form(None),
-    last_name: Optional[str] = Form(None),
     current_user: models.User = Depends(get_current_user),
-    db_session=Depends(yield_db_session_from_env),
-) -> data.UserResponse:
+) -> data.ConfigResponse:
     """
-    Update user information.
+    Reload CORS origins and rate limit from database. Available only for admins.
 
-    - **first_name** (string): First user name
-    - **last_name** (string):  Last user name
+    Config is reloaded immediately only in the worker which handled the request, other
+    workers pick it up on next periodic reload.
     """
     if token_restricted:
         raise HTTPException(
             status_code=403,
-            detail="Restricted tokens are not authorized to update users.",
+            detail="Restricted tokens are not authorized to reload config.",
         )
+    if not current_user.is_admin and not current_user.is_super_admin:
+        raise HTTPException(status_code=403, detail="Only admins could reload config")
 
     try:
-        user = actions.update_user(db_session, current_user.id, first_name, last_name)
-    except actions.UserInvalidParameters:
-        raise HTTPException(status_code=400, detail="Invalid user parameters")
+        await asyncio.get_event_loop().run_in_executor(None, config_watcher.reload)
+    except ValueError as err:
+        raise HTTPException(status_code=400, detail=str(err))
     except Exception as err:
-        logger.error(f"Unhandled error in update_user_handler: {str(err)}")
+        logger.error(
+            f"Unhandled error during config reload: {str(err)}", extra={"error": err}
+        )
         raise HTTPException(status_code=500)
 
-    return user
+    return data.ConfigResponse(**config_watcher.config())
 
 
-@app.delete("/user/{user_id}", tags=["users"], response_model=data.UserResponse)
-async def delete_user_handler(
+@app.post(
+    "/admin/impersonate/{user_id}", tags=["users"], response_model=data.TokenResponse
+)
+async def impersonate_user_handler(
     request: Request,
-    token_restricted: bool = Depends(is_token_restricted),
     user_id: uuid.UUID = Path(...),
-    password: str = Form(None),
+    token_restricted: bool = Depends(is_token_restricted),
+    token_impersonated: bool = Depends(is_token_impersonated),
     current_user: models.User = Depends(get_current_user),
     db_session=Depends(yield_db_session_from_env),
-) -> data.UserResponse:
+) -> data.TokenResponse:
     """
-    Delete user by ID. Regular user deletion impossible without provided password.
+    Issue short-lived token to act as the user for support. Available only for
+    super-admins.
 
-    - **user_id** (uuid): User ID
-    - **password** (string): User password
+    Token carries **impersonated_by** with ID of super-admin. Its issuance and every
+    request made with it are recorded in audit log. It is not authorized to delete the
+    account, change password or issue other tokens.
+
+    - **user_id** (uuid): User ID to impersonate
     """
-    # Autogenerated user deletion impossible without installation header.
-    if token_restricted:
+    if token_restricted or token_impersonated:
         raise HTTPException(
             status_code=403,
-            detail="Restricted tokens are not authorized to delete users.",
+            detail="Restricted and impersonation tokens are not authorized to impersonate users.",
         )
-    if user_id != current_user.id:
+    if not current_user.is_super_admin:
         raise HTTPException(
-            status_code=403, detail="You do not have permission to delete this resource"
+            status_code=403, detail="Only super-admins could impersonate users"
         )
-    autogenerated_user = autogenerated_user_token_check(request)
-    if autogenerated_user != current_user.autogenerated:
-        raise HTTPException(status_code=403, detail="Autogenerated user bypass failed")
+
     try:
-        user = actions.delete_user(
-            session=db_session,
+        token = actions.impersonate_user(
+            db_session,
+            admin=current_user,
             user_id=user_id,
-            current_password=password,
+            audit_details=request_audit_details(request),
         )
-    except actions.UserInvalidParameters:
-        raise HTTPException(status_code=400, detail="Invalid user parameters")
     except actions.UserNotFound:
         raise HTTPException(status_code=404, detail="No user with that user id")
-    except actions.UserIncorrectPassword:
-        raise HTTPException(status_code=401, detail="Incorrect password")
+    except actions.TokenTTLExceeded as e:
+        raise HTTPException(status_code=400, detail=str(e))
 
-    return user
+    logger.info(f"User {user_id} impersonated by super-admin {current_user.id}")
+    return token
+
+
+ADMIN_STATS_CACHE_KEY = "brood:admin_stats"
+
+
+@app.get("/admin/stats", tags=["users"], response_model=data.AdminStatsResponse)
+async def get_admin_stats_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.AdminStatsResponse:
+    """
+    Get number of users, verified users, active tokens, groups and resources. Available
+    only for admins.
+
+    Counts are served from cache and could be stale for a short period, **computed_at**
+    tells when they were counted.
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to view stats.",
+        )
+    if not current_user.is_admin and not current_user.is_super_admin:
+        raise HTTPException(status_code=403, detail="Only admins could view stats")
+
+    if ADMIN_STATS_CACHE_TTL_SECONDS > 0:
+        try:
+            return data.AdminStatsResponse.parse_raw(cache.get(ADMIN_STATS_CACHE_KEY))
+        except CacheMiss:
+            pass
+        except Exception as err:
+            logger.error(
+                f"Unable to read admin stats from cache: {str(err)}",
+                extra={"error": err},
+            )
+
+    stats = actions.get_stats(db_session)
+    if ADMIN_STATS_CACHE_TTL_SECONDS > 0:
+        try:
+            cache.set(
+                ADMIN_STATS_CACHE_KEY, stats.json(), ttl=ADMIN_STATS_CACHE_TTL_SECONDS
+            )
+        except Exception as err:
+            logger.error(
+                f"Unable to cache admin stats: {str(err)}", extra={"error": err}
+            )
+
+    return stats
 
 
 # TODO(kompotkot): DEPRECATED @app.get("/group/find")
@@ -818,7 +2370,9 @@ async def get_groups_handler(
     try:
         groups_list = actions.get_groups_for_user(db_session, user_id=current_user.id)
     except Exception as e:
-        logger.error(f"Error getting list of groups for user: {str(e)}")
+        logger.error(
+            f"Error getting list of groups for user: {str(e)}", extra={"error": e}
+        )
         raise HTTPException(status_code=500)
 
     groups_response = data.GroupUserListResponse(groups=groups_list)
@@ -826,9 +2380,18 @@ async def get_groups_handler(
 
 
 # TODO(kompotkot): DEPRECATED @app.post("/group")
-@app.post("/groups", tags=["groups"], response_model=data.GroupResponse)
-@app.post("/group", include_in_schema=False, response_model=data.GroupResponse)
+@app.post(
+    "/groups", tags=["groups"], status_code=201, response_model=data.GroupResponse
+)
+@app.post(
+    "/group",
+    include_in_schema=False,
+    status_code=201,
+    response_model=data.GroupResponse,
+)
 async def create_group_handler(
+    request: Request,
+    response: Response,
     token_restricted: bool = Depends(is_token_restricted),
     group_name: str = Form(...),
     parent: uuid.UUID = Form(None),
@@ -836,7 +2399,8 @@ async def create_group_handler(
     db_session=Depends(yield_db_session_from_env),
 ) -> data.GroupResponse:
     """
-    Creates group as a group owner.
+    Creates group as a group owner. Response has status 201 and Location header with
+    path of the group.
 
     - **group_name** (string): Group name
     - **parent** (uuid): Group parent if exists
@@ -870,6 +2434,7 @@ async def create_group_handler(
     except Exception as e:
         raise HTTPException(status_code=500)
 
+    response.headers["Location"] = location_path(request, f"/groups/{group.id}")
     return data.GroupResponse(
         id=group.id,
         name=group.name,
@@ -958,6 +2523,13 @@ async def set_user_in_group_handler(
     return group_user_response
 
 
+def group_users_count_cache_key(
+    group_id: uuid.UUID, user_type: Optional[models.Role] = None
+) -> str:
+    role = user_type.value if user_type is not None else "all"
+    return f"brood:group_users_count:{group_id}:{role}"
+
+
 # TODO(kompotkot): DEPRECATED @app.get("/group/{group_id}/users")
 @app.get(
     "/groups/{group_id}/users", tags=["groups"], response_model=data.UsersListResponse
@@ -970,13 +2542,27 @@ async def set_user_in_group_handler(
 async def get_group_members_handler(
     token_restricted: bool = Depends(is_token_restricted),
     group_id: uuid.UUID = Path(...),
+    role: Optional[models.Role] = Query(None),
+    limit: Optional[int] = Query(None, ge=1),
+    offset: int = Query(0, ge=0),
+    exact_count: bool = Query(False),
     current_user: models.User = Depends(get_current_user),
     db_session=Depends(yield_db_session_from_env),
 ) -> data.UsersListResponse:
     """
-    Get list of all group members.
+    Get list of group members with roles and time they joined the group. Available for
+    group members only.
+
+    Total number of matching members is returned in **total**. By default it is served
+    from cache and could be stale for a short period after membership changes, which
+    spares COUNT query on every page. Pass **exact_count** to always count members in
+    the database. **count_is_exact** tells which one was returned.
 
     - **group_id** (uuid): Group ID
+    - **role** (string, null): Return only members with this role
+    - **limit** (integer, null): Maximum number of members to return
+    - **offset** (integer): Number of members to skip
+    - **exact_count** (boolean): Count members in the database instead of cached total
     """
     if token_restricted:
         raise HTTPException(
@@ -990,13 +2576,47 @@ async def get_group_members_handler(
             db_session, user_id=current_user.id, group_id=group_id
         )
         group_users_response = actions.get_group_users(
-            db_session, group_user.group_id, group_user.group_name
+            db_session,
+            group_user.group_id,
+            group_user.group_name,
+            user_type=role,
+            limit=limit,
+            offset=offset,
         )
     except actions.GroupNotFound:
         raise HTTPException(
             status_code=404,
             detail="No group with that group id or you do not have permission to view this resource",
         )
+
+    cache_key = group_users_count_cache_key(group_user.group_id, role)
+    if not exact_count:
+        try:
+            group_users_response.total = int(cache.get(cache_key))
+            group_users_response.count_is_exact = False
+        except CacheMiss:
+            pass
+        except Exception as err:
+            logger.error(
+                f"Unable to read group users count from cache: {str(err)}",
+                extra={"error": err},
+            )
+    if group_users_response.total is None:
+        group_users_response.total = actions.count_group_users(
+            db_session, group_user.group_id, user_type=role
+        )
+        group_users_response.count_is_exact = True
+        try:
+            cache.set(
+                cache_key,
+                str(group_users_response.total),
+                ttl=LIST_COUNT_CACHE_TTL_SECONDS,
+            )
+        except Exception as err:
+            logger.error(
+                f"Unable to cache group users count: {str(err)}", extra={"error": err}
+            )
+
     return group_users_response
 
 
@@ -1103,6 +2723,125 @@ async def set_group_name_handler(
     return group
 
 
+def group_response(group: models.Group) -> data.GroupResponse:
+    return data.GroupResponse(
+        id=group.id,
+        name=group.name,
+        autogenerated=group.autogenerated,
+        subscriptions=[
+            subscription_plan.subscription_plan_id
+            for subscription_plan in group.subscriptions
+        ],
+        parent=group.parent,
+        created_at=group.created_at,
+        updated_at=group.updated_at,
+    )
+
+
+def ensure_group_parent_permissions(
+    db_session: Session,
+    user_id: uuid.UUID,
+    group_id: uuid.UUID,
+    parent_id: Optional[uuid.UUID] = None,
+) -> None:
+    """
+    Only owner of the group could change its parent. New parent group should be
+    owned or administrated by the same user.
+    """
+    group_ids = [group_id] if parent_id is None else [group_id, parent_id]
+    for checked_group_id in group_ids:
+        try:
+            group_user = actions.check_user_type_in_group(
+                db_session, user_id=user_id, group_id=checked_group_id
+            )
+        except actions.GroupNotFound:
+            raise HTTPException(
+                status_code=404,
+                detail="No group with that group id or you do not have permission to view this resource",
+            )
+        if group_user.user_type != models.Role.owner and (
+            checked_group_id == group_id or group_user.user_type != models.Role.admin
+        ):
+            raise HTTPException(
+                status_code=403,
+                detail="You do not have permission to change group parent",
+            )
+
+
+@app.put(
+    "/groups/{group_id}/parent", tags=["groups"], response_model=data.GroupResponse
+)
+async def set_group_parent_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    group_id: uuid.UUID = Path(...),
+    parent_id: uuid.UUID = Form(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.GroupResponse:
+    """
+    Set parent of the group.
+
+    - **group_id** (uuid): Group ID
+    - **parent_id** (uuid): Parent group ID
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to change group parents.",
+        )
+
+    ensure_group_parent_permissions(
+        db_session, user_id=current_user.id, group_id=group_id, parent_id=parent_id
+    )
+
+    try:
+        group = actions.set_group_parent(
+            session=db_session, group_id=group_id, parent_id=parent_id
+        )
+    except actions.GroupParentCycle:
+        raise HTTPException(
+            status_code=400, detail="Provided parent creates a loop in group hierarchy"
+        )
+    except actions.GroupInvalidParameters:
+        raise HTTPException(status_code=400, detail="Invalid group parent id")
+    except actions.GroupNotFound:
+        raise HTTPException(status_code=404, detail="No group with that id")
+
+    return group_response(group)
+
+
+@app.delete(
+    "/groups/{group_id}/parent", tags=["groups"], response_model=data.GroupResponse
+)
+async def delete_group_parent_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    group_id: uuid.UUID = Path(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.GroupResponse:
+    """
+    Clear parent of the group, group becomes top level group.
+
+    - **group_id** (uuid): Group ID
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to change group parents.",
+        )
+
+    ensure_group_parent_permissions(
+        db_session, user_id=current_user.id, group_id=group_id
+    )
+
+    try:
+        group = actions.set_group_parent(session=db_session, group_id=group_id)
+    except actions.GroupNotFound:
+        raise HTTPException(status_code=404, detail="No group with that id")
+
+    return group_response(group)
+
+
 # TODO(kompotkot): DEPRECATED @app.delete("/group/{group_id}/role")
 @app.delete(
     "/groups/{group_id}/role", tags=["groups"], response_model=data.GroupUserResponse
@@ -1223,6 +2962,7 @@ async def delete_group_handler(
             status_code=403, detail="You do not have permission to delete this resource"
         )
 
+    token_ids = actions.get_group_token_ids(db_session, group_id)
     try:
         group = actions.delete_group(
             session=db_session, group_id=group_id, current_user=current_user
@@ -1233,6 +2973,8 @@ async def delete_group_handler(
         raise HTTPException(
             status_code=403, detail="You do not have permission to delete this resource"
         )
+    for token_id in token_ids:
+        evict_token_introspection(token_id)
 
     return data.GroupResponse(
         id=group.id,
@@ -1248,6 +2990,158 @@ async def delete_group_handler(
     )
 
 
+def check_group_admin(
+    db_session: Session, group_id: uuid.UUID, user_id: uuid.UUID, action: str
+) -> None:
+    """
+    Raises 404 if user is not in the group and 403 if user is not its owner or admin.
+    """
+    try:
+        group_user = actions.check_user_type_in_group(
+            db_session, user_id=user_id, group_id=group_id
+        )
+    except actions.GroupNotFound:
+        raise HTTPException(
+            status_code=404,
+            detail="No group with that group id or you do not have permission to view this resource",
+        )
+    if (
+        group_user.user_type != models.Role.owner
+        and group_user.user_type != models.Role.admin
+    ):
+        raise HTTPException(
+            status_code=403, detail=f"You do not have permission to {action}"
+        )
+
+
+def group_token_response(token: models.Token) -> data.GroupTokenResponse:
+    return data.GroupTokenResponse(
+        fingerprint=actions.token_fingerprint(token.id),
+        group_id=token.group_id,
+        note=token.note,
+        scopes=token.scopes or [],
+        created_at=token.created_at,
+        expires_at=token.expires_at,
+    )
+
+
+@app.post(
+    "/groups/{group_id}/token",
+    tags=["groups"],
+    status_code=201,
+    response_model=data.TokenResponse,
+)
+async def create_group_token_handler(
+    request: Request,
+    token_restricted: bool = Depends(is_token_restricted),
+    token_impersonated: bool = Depends(is_token_impersonated),
+    group_id: uuid.UUID = Path(...),
+    scopes: str = Form(...),
+    token_note: Optional[str] = Form(None),
+    token_ttl: Optional[int] = Form(None),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenResponse:
+    """
+    Generate token owned by the group for CI/CD and scheduled jobs, token keeps working
+    when members leave the group. Available only for owners and admins of the group.
+
+    Token value is returned only in this response. Group tokens are rejected by
+    endpoints which act on behalf of a user.
+
+    - **group_id** (uuid): Group ID
+    - **scopes** (string): Space-separated scopes: identify, api, token:introspect
+    - **token_note** (string, null): Short token description
+    - **token_ttl** (integer, null): Token time to live in seconds, BROOD_GROUP_TOKEN_MAX_TTL_DAYS by default and at most
+    """
+    if token_restricted or token_impersonated:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted and impersonation tokens are not authorized to create group tokens.",
+        )
+    check_group_admin(db_session, group_id, current_user.id, "create group tokens")
+
+    try:
+        token = actions.create_group_token(
+            db_session,
+            group_id=group_id,
+            scopes=scopes.split(),
+            created_by=current_user.id,
+            token_note=token_note,
+            token_ttl=token_ttl,
+            audit_details=request_audit_details(request),
+        )
+    except (actions.TokenInvalidParameters, actions.TokenTTLExceeded) as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+    return token
+
+
+@app.get(
+    "/groups/{group_id}/token",
+    tags=["groups"],
+    response_model=data.GroupTokensListResponse,
+)
+async def list_group_tokens_handler(
+    group_id: uuid.UUID = Path(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.GroupTokensListResponse:
+    """
+    List active tokens of the group without token values. Available only for owners and
+    admins of the group.
+
+    - **group_id** (uuid): Group ID
+    """
+    check_group_admin(db_session, group_id, current_user.id, "view group tokens")
+
+    tokens = actions.get_group_tokens(db_session, group_id)
+    return data.GroupTokensListResponse(
+        tokens=[group_token_response(token) for token in tokens]
+    )
+
+
+@app.delete(
+    "/groups/{group_id}/token/{fingerprint}",
+    tags=["groups"],
+    response_model=data.GroupTokenResponse,
+)
+async def revoke_group_token_handler(
+    request: Request,
+    token_restricted: bool = Depends(is_token_restricted),
+    group_id: uuid.UUID = Path(...),
+    fingerprint: str = Path(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.GroupTokenResponse:
+    """
+    Revoke token of the group. Available only for owners and admins of the group.
+
+    - **group_id** (uuid): Group ID
+    - **fingerprint** (string): Token fingerprint from list of group tokens
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to revoke group tokens.",
+        )
+    check_group_admin(db_session, group_id, current_user.id, "revoke group tokens")
+
+    try:
+        token = actions.revoke_group_token(
+            db_session,
+            group_id=group_id,
+            fingerprint=fingerprint,
+            revoked_by=current_user.id,
+            audit_details=request_audit_details(request),
+        )
+    except actions.TokenNotFound:
+        raise HTTPException(status_code=404, detail="Given token does not exist")
+
+    evict_token_introspection(token.id)
+    return group_token_response(token)
+
+
 @app.get(
     "/groups/{group_id}/invites",
     tags=["groups"],
@@ -1548,7 +3442,7 @@ async def stripe_webhook_handler(
     except stripe.error.SignatureVerificationError as e:
         raise HTTPException(status_code=400, detail="Stripe event signature fail")
     except ValueError as e:
-        logger.error(repr(e))
+        logger.error(repr(e), extra={"error": e})
         raise HTTPException(status_code=400, detail="Stripe event process error")
 
     try:
@@ -1700,7 +3594,7 @@ async def add_subscription_handler(
             detail="Group subscription already attached to group",
         )
     except Exception as e:
-        logger.error(repr(e))
+        logger.error(repr(e), extra={"error": e})
         raise HTTPException(status_code=500, detail="Stripe customer/session error")
 
     return subscription_response
@@ -1932,6 +3826,77 @@ async def list_applications_handler(
     )
 
 
+@app.patch(
+    "/applications/{application_id}/headers",
+    tags=["applications"],
+    response_model=data.ApplicationResponse,
+)
+async def update_application_headers_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    application_id: uuid.UUID = Path(...),
+    headers: Dict[str, str] = Body(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ApplicationResponse:
+    """
+    Replace custom headers set on responses to requests on behalf of application. Available
+    only for owners of application group. X-Brood-*, Access-Control-*, Set-Cookie,
+    security, content and hop-by-hop headers are reserved.
+
+    - **application_id** (uuid): Application ID
+    - **headers** (object): Header names mapped to values, e.g. {"Cache-Control": "no-store"}
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to update applications.",
+        )
+
+    try:
+        applications = actions.get_applications(
+            db_session, application_id=application_id
+        )
+        if len(applications) == 0:
+            raise exceptions.ApplicationsNotFound(
+                f"There are no application with id: {application_id}"
+            )
+        group_user = actions.check_user_type_in_group(
+            db_session, user_id=current_user.id, group_id=applications[0].group_id
+        )
+    except exceptions.ApplicationsNotFound:
+        raise HTTPException(status_code=404, detail="No application with that id")
+    except actions.GroupNotFound:
+        raise HTTPException(
+            status_code=404,
+            detail="You do not have permission to view this resource",
+        )
+    if group_user.user_type != models.Role.owner:
+        raise HTTPException(
+            status_code=403,
+            detail="Only application group owners could update application headers",
+        )
+
+    try:
+        application = actions.update_application_headers(
+            db_session, application_id, headers
+        )
+    except exceptions.ApplicationHeadersInvalid as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except Exception as e:
+        logger.error(e, extra={"error": e})
+        raise HTTPException(status_code=500)
+
+    evict_application_headers(application.id)
+
+    return data.ApplicationResponse(
+        id=application.id,
+        group_id=application.group_id,
+        name=application.name,
+        description=application.description,
+        response_headers=application.response_headers,
+    )
+
+
 @app.delete(
     "/applications/{application_id}",
     tags=["applications"],
@@ -1957,13 +3922,361 @@ async def delete_application_handler(
     try:
         groups_list = actions.get_groups_for_user(db_session, user_id=current_user.id)
         groups_ids = [group.group_id for group in groups_list]
+        token_ids = actions.get_service_account_token_ids(db_session, application_id)
         application = actions.delete_application(db_session, application_id, groups_ids)
     except exceptions.ApplicationsNotFound:
         raise HTTPException(status_code=404, detail="No application with that id")
     except Exception as e:
-        logger.error(e)
+        logger.error(e, extra={"error": e})
+        raise HTTPException(status_code=500)
+    for token_id in token_ids:
+        evict_token_introspection(token_id)
+
+    return data.ApplicationResponse(
+        id=application.id,
+        group_id=application.group_id,
+        name=application.name,
+        description=application.description,
+    )
+
+
+def check_application_group_user(
+    db_session: Session,
+    application_id: uuid.UUID,
+    user_id: uuid.UUID,
+    owner_only: bool = False,
+) -> models.Application:
+    """
+    Returns application if user is member of application group. With owner_only user
+    must be owner of the group.
+    """
+    try:
+        applications = actions.get_applications(
+            db_session, application_id=application_id
+        )
+        if len(applications) == 0:
+            raise exceptions.ApplicationsNotFound(
+                f"There are no application with id: {application_id}"
+            )
+        group_user = actions.check_user_type_in_group(
+            db_session, user_id=user_id, group_id=applications[0].group_id
+        )
+    except exceptions.ApplicationsNotFound:
+        raise HTTPException(status_code=404, detail="No application with that id")
+    except actions.GroupNotFound:
+        raise HTTPException(
+            status_code=404,
+            detail="You do not have permission to view this resource",
+        )
+    if owner_only and group_user.user_type != models.Role.owner:
+        raise HTTPException(
+            status_code=403,
+            detail="Only application group owners could perform this operation",
+        )
+    return applications[0]
+
+
+@app.post(
+    "/applications/{application_id}/service-accounts",
+    tags=["applications"],
+    response_model=data.ServiceAccountResponse,
+)
+async def create_service_account_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    token_impersonated: bool = Depends(is_token_impersonated),
+    application_id: uuid.UUID = Path(...),
+    name: str = Form(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ServiceAccountResponse:
+    """
+    Create service account for machine-to-machine tokens which are not tied to any user.
+    Available only for owners of application group.
+
+    - **application_id** (uuid): Application ID
+    - **name** (string): Service account name
+    """
+    if token_restricted or token_impersonated:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted and impersonation tokens are not authorized to manage service accounts.",
+        )
+    check_application_group_user(
+        db_session, application_id, current_user.id, owner_only=True
+    )
+
+    try:
+        service_account = actions.create_service_account(
+            db_session, application_id, name
+        )
+    except Exception as e:
+        logger.error(e, extra={"error": e})
+        raise HTTPException(status_code=500)
+
+    return data.ServiceAccountResponse.from_orm(service_account)
+
+
+@app.get(
+    "/applications/{application_id}/service-accounts",
+    tags=["applications"],
+    response_model=data.ServiceAccountsListResponse,
+)
+async def list_service_accounts_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    application_id: uuid.UUID = Path(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ServiceAccountsListResponse:
+    """
+    Return service accounts of application. Available for application group members.
+
+    - **application_id** (uuid): Application ID
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to manage service accounts.",
+        )
+    check_application_group_user(db_session, application_id, current_user.id)
+
+    service_accounts = actions.get_service_accounts(db_session, application_id)
+
+    return data.ServiceAccountsListResponse(
+        service_accounts=[
+            data.ServiceAccountResponse.from_orm(service_account)
+            for service_account in service_accounts
+        ]
+    )
+
+
+@app.delete(
+    "/applications/{application_id}/service-accounts/{service_account_id}",
+    tags=["applications"],
+    response_model=data.ServiceAccountResponse,
+)
+async def delete_service_account_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    application_id: uuid.UUID = Path(...),
+    service_account_id: uuid.UUID = Path(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ServiceAccountResponse:
+    """
+    Delete service account together with its tokens. Available only for owners of
+    application group.
+
+    - **application_id** (uuid): Application ID
+    - **service_account_id** (uuid): Service account ID
+    """
+    if token_restricted:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted tokens are not authorized to manage service accounts.",
+        )
+    check_application_group_user(
+        db_session, application_id, current_user.id, owner_only=True
+    )
+
+    try:
+        token_ids = actions.get_service_account_token_ids(
+            db_session, application_id, service_account_id
+        )
+        service_account = actions.delete_service_account(
+            db_session, application_id, service_account_id
+        )
+    except exceptions.ServiceAccountNotFound:
+        raise HTTPException(status_code=404, detail="No service account with that id")
+    except Exception as e:
+        logger.error(e, extra={"error": e})
+        raise HTTPException(status_code=500)
+    for token_id in token_ids:
+        evict_token_introspection(token_id)
+
+    return data.ServiceAccountResponse.from_orm(service_account)
+
+
+@app.post(
+    "/applications/{application_id}/service-accounts/{service_account_id}/token",
+    tags=["applications"],
+    response_model=data.TokenResponse,
+)
+async def create_service_account_token_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    token_impersonated: bool = Depends(is_token_impersonated),
+    application_id: uuid.UUID = Path(...),
+    service_account_id: uuid.UUID = Path(...),
+    token_note: Optional[str] = Form(None),
+    token_ttl: Optional[int] = Form(None),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.TokenResponse:
+    """
+    Generate token of service account, token has no user and is bound to application.
+    Available only for owners of application group.
+
+    Service account tokens are rejected by endpoints which act on behalf of a user.
+
+    - **application_id** (uuid): Application ID
+    - **service_account_id** (uuid): Service account ID
+    - **token_note** (string, null): Short token description
+    - **token_ttl** (integer, null): Token time to live in seconds, server default is applied if not provided
+    """
+    if token_restricted or token_impersonated:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted and impersonation tokens are not authorized to manage service accounts.",
+        )
+    check_application_group_user(
+        db_session, application_id, current_user.id, owner_only=True
+    )
+
+    try:
+        service_account = actions.get_service_account(
+            db_session, application_id, service_account_id
+        )
+        token = actions.create_token(
+            session=db_session,
+            user_id=None,
+            token_note=token_note,
+            token_ttl=token_ttl,
+            bound_application_id=service_account.application_id,
+            service_account_id=service_account.id,
+        )
+    except exceptions.ServiceAccountNotFound:
+        raise HTTPException(status_code=404, detail="No service account with that id")
+    except actions.TokenTTLExceeded as e:
+        raise HTTPException(status_code=400, detail=str(e))
+
+    return token
+
+
+@app.post(
+    "/applications/{application_id}/transfer",
+    tags=["applications"],
+    response_model=data.ApplicationTransferResponse,
+)
+async def create_application_transfer_handler(
+    background_tasks: BackgroundTasks,
+    token_restricted: bool = Depends(is_token_restricted),
+    token_impersonated: bool = Depends(is_token_impersonated),
+    application_id: uuid.UUID = Path(...),
+    group_id: uuid.UUID = Form(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ApplicationTransferResponse:
+    """
+    Request transfer of application to another group. Owners of the group receive link
+    to accept the transfer. Available only for owners of application group.
+
+    - **application_id** (uuid): Application ID
+    - **group_id** (uuid): Group ID application is transferred to
+    """
+    if token_restricted or token_impersonated:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted and impersonation tokens are not authorized to transfer applications.",
+        )
+    application = check_application_group_user(
+        db_session, application_id, current_user.id, owner_only=True
+    )
+    if application.group_id == group_id:
+        raise HTTPException(
+            status_code=400, detail="Application already belongs to this group"
+        )
+
+    try:
+        transfer = actions.create_application_transfer(
+            db_session,
+            application_id=application_id,
+            requester_user_id=current_user.id,
+            new_group_id=group_id,
+        )
+        owner_emails = actions.get_group_owner_emails(db_session, group_id)
+    except exceptions.ApplicationTransferExists:
+        raise HTTPException(
+            status_code=409, detail="Application already has pending transfer"
+        )
+    except actions.GroupNotFound:
+        raise HTTPException(status_code=404, detail="No group with that id")
+    except Exception as e:
+        logger.error(e, extra={"error": e})
         raise HTTPException(status_code=500)
 
+    for email in owner_emails:
+        background_tasks.add_task(
+            actions.send_application_transfer_email,
+            application_id=application.id,
+            application_name=application.name,
+            token=transfer.token,
+            email=email,
+            requester_email=current_user.email,
+        )
+
+    return data.ApplicationTransferResponse.from_orm(transfer)
+
+
+@app.delete(
+    "/applications/{application_id}/transfer",
+    tags=["applications"],
+    response_model=data.ApplicationTransferResponse,
+)
+async def cancel_application_transfer_handler(
+    token_restricted: bool = Depends(is_token_restricted),
+    token_impersonated: bool = Depends(is_token_impersonated),
+    application_id: uuid.UUID = Path(...),
+    current_user: models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ApplicationTransferResponse:
+    """
+    Cancel pending transfer of application. Available only for owners of application
+    group.
+
+    - **application_id** (uuid): Application ID
+    """
+    if token_restricted or token_impersonated:
+        raise HTTPException(
+            status_code=403,
+            detail="Restricted and impersonation tokens are not authorized to transfer applications.",
+        )
+    check_application_group_user(
+        db_session, application_id, current_user.id, owner_only=True
+    )
+
+    try:
+        transfer = actions.cancel_application_transfer(db_session, application_id)
+    except exceptions.ApplicationTransferNotFound:
+        raise HTTPException(status_code=404, detail="No pending transfer")
+
+    return data.ApplicationTransferResponse.from_orm(transfer)
+
+
+@app.post(
+    "/applications/{application_id}/transfer/accept",
+    tags=["applications"],
+    response_model=data.ApplicationResponse,
+)
+async def accept_application_transfer_handler(
+    application_id: uuid.UUID = Path(...),
+    token: uuid.UUID = Query(...),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ApplicationResponse:
+    """
+    Accept transfer of application with token sent to owners of new group.
+
+    - **application_id** (uuid): Application ID
+    - **token** (uuid): Transfer token
+    """
+    try:
+        application = actions.accept_application_transfer(
+            db_session, application_id, token
+        )
+    except exceptions.ApplicationTransferNotFound:
+        raise HTTPException(status_code=404, detail="No pending transfer")
+    except exceptions.ApplicationTransferExpired as e:
+        raise HTTPException(status_code=403, detail=str(e))
+    except exceptions.ApplicationsNotFound:
+        raise HTTPException(status_code=404, detail="No application with that id")
+
     return data.ApplicationResponse(
         id=application.id,
         group_id=application.group_id,
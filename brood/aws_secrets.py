@@ -0,0 +1,58 @@
+"""
+Loading of Brood settings from AWS Secrets Manager.
+
+Secret should contain JSON object with settings names as keys, for example:
+{"BROOD_DB_URI": "postgresql://...", "STRIPE_SECRET_KEY": "..."}
+"""
+import json
+import logging
+import os
+from typing import Any, Dict, Optional
+
+logger = logging.getLogger(__name__)
+
+# Only keys with these prefixes are treated as Brood settings
+SETTINGS_PREFIXES = ("BROOD_", "BUGOUT_", "SENDGRID_", "STRIPE_", "MOONSTREAM_")
+
+
+class SecretsManagerClient:
+    """
+    Interface of AWS Secrets Manager client used to fetch secrets, implemented by boto3
+    secretsmanager client.
+    """
+
+    def get_secret_value(self, SecretId: str) -> Dict[str, Any]:
+        raise NotImplementedError()
+
+
+def load_secrets_from_aws(
+    secret_arn: str, client: Optional[SecretsManagerClient] = None
+) -> Dict[str, str]:
+    """
+    Fetches secret and sets its settings as environment variables. Variables set
+    in environment are not overridden.
+
+    Returns settings which were applied from the secret.
+    """
+    if client is None:
+        # Imported lazily, so boto3 is required only for deployments which use it
+        import boto3  # type: ignore
+
+        client = boto3.client("secretsmanager")
+
+    response = client.get_secret_value(SecretId=secret_arn)
+    secret = json.loads(response["SecretString"])
+    if not isinstance(secret, dict):
+        raise ValueError("AWS secret must be JSON object")
+
+    applied: Dict[str, str] = {}
+    for name, value in secret.items():
+        if not name.startswith(SETTINGS_PREFIXES):
+            logger.warning(f"Skipping unknown setting {name} from AWS secret")
+            continue
+        if name in os.environ:
+            continue
+        os.environ[name] = str(value)
+        applied[name] = str(value)
+    logger.info(f"Loaded {len(applied)} settings from AWS secret")
+    return applied
@@ -0,0 +1,140 @@
+"""
+Key-value cache used by Brood API.
+
+Production deployments use Redis, local development could run with in-memory cache.
+"""
+import logging
+import threading
+import time
+from typing import Any, Dict, Optional, Tuple
+
+from .settings import CACHE_BACKEND, REDIS_URL
+
+logger = logging.getLogger(__name__)
+
+MEMORY_CACHE_EVICTION_INTERVAL_SECONDS = 60
+
+
+class CacheMiss(Exception):
+    """
+    Raised when requested key is absent in cache or its value has expired.
+    """
+
+
+class CacheClient:
+    """
+    Interface for cache backends.
+    """
+
+    def get(self, key: str) -> str:
+        raise NotImplementedError()
+
+    def set(self, key: str, value: str, ttl: Optional[int] = None) -> None:
+        raise NotImplementedError()
+
+    def delete(self, key: str) -> None:
+        raise NotImplementedError()
+
+
+class MemoryCache(CacheClient):
+    """
+    Cache stored in process memory, intended for development environments without Redis.
+
+    Values are not shared between uvicorn workers.
+    """
+
+    def __init__(
+        self, eviction_interval: int = MEMORY_CACHE_EVICTION_INTERVAL_SECONDS
+    ) -> None:
+        # Maps key to pair of value and expiration timestamp (None for non-expiring keys)
+        self._entries: Dict[str, Tuple[str, Optional[float]]] = {}
+        self._lock = threading.Lock()
+        self._eviction_interval = eviction_interval
+        self._stopped = threading.Event()
+        self._evictor = threading.Thread(
+            target=self._evict_loop, name="brood-memory-cache-evictor", daemon=True
+        )
+        self._evictor.start()
+
+    def get(self, key: str) -> str:
+        with self._lock:
+            entry = self._entries.get(key)
+            if entry is None:
+                raise CacheMiss(key)
+            value, expires_at = entry
+            if expires_at is not None and expires_at <= time.monotonic():
+                del self._entries[key]
+                raise CacheMiss(key)
+        return value
+
+    def set(self, key: str, value: str, ttl: Optional[int] = None) -> None:
+        expires_at = time.monotonic() + ttl if ttl is not None else None
+        with self._lock:
+            self._entries[key] = (value, expires_at)
+
+    def delete(self, key: str) -> None:
+        with self._lock:
+            self._entries.pop(key, None)
+
+    def evict_expired(self) -> int:
+        """
+        Removes expired entries and returns number of evicted keys.
+        """
+        now = time.monotonic()
+        with self._lock:
+            expired_keys = [
+                key
+                for key, (_, expires_at) in self._entries.items()
+                if expires_at is not None and expires_at <= now
+            ]
+            for key in expired_keys:
+                del self._entries[key]
+        return len(expired_keys)
+
+    def stop(self) -> None:
+        self._stopped.set()
+
+    def _evict_loop(self) -> None:
+        while not self._stopped.wait(self._eviction_interval):
+            try:
+                self.evict_expired()
+            except Exception as err:
+                logger.error(
+                    f"Unable to evict expired cache entries: {str(err)}",
+                    extra={"error": err},
+                )
+
+
+class RedisCache(CacheClient):
+    """
+    Cache backed by Redis server.
+    """
+
+    def __init__(self, redis_url: str) -> None:
+        # Imported lazily, so redis package is required only for deployments which use it
+        import redis  # type: ignore
+
+        self._client: Any = redis.Redis.from_url(redis_url, decode_responses=True)
+
+    def get(self, key: str) -> str:
+        value = self._client.get(key)
+        if value is None:
+            raise CacheMiss(key)
+        return value
+
+    def set(self, key: str, value: str, ttl: Optional[int] = None) -> None:
+        self._client.set(key, value, ex=ttl)
+
+    def delete(self, key: str) -> None:
+        self._client.delete(key)
+
+
+def cache_from_env() -> CacheClient:
+    """
+    Returns in-memory cache if BROOD_CACHE_BACKEND is set to "memory" or BROOD_REDIS_URL is
+    not set, otherwise Redis cache.
+    """
+    if CACHE_BACKEND == "memory" or REDIS_URL is None:
+        logger.info("Using in-memory cache backend")
+        return MemoryCache()
+    return RedisCache(REDIS_URL)
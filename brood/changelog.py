@@ -0,0 +1,52 @@
+"""
+Version history of Brood parsed from CHANGELOG.md shipped with the package.
+"""
+from functools import lru_cache
+import os
+import re
+from typing import List
+
+from . import data
+
+CHANGELOG_PATH = os.path.join(os.path.dirname(__file__), "CHANGELOG.md")
+
+VERSION_HEADING_REGEX = re.compile(
+    r"^## \[(?P<version>[^\]]+)\](?:\s+-\s+(?P<date>\d{4}-\d{2}-\d{2}))?\s*$"
+)
+
+
+def parse_changelog(content: str) -> List[data.ChangelogEntry]:
+    """
+    Parses changelog in Keep a Changelog format. Every "## [version] - date" heading
+    starts new entry, list items of its "### Added", "### Changed", etc. sections are
+    collected to changes of the entry. Indented lines continue previous list item.
+    """
+    entries: List[data.ChangelogEntry] = []
+    for line_number, line in enumerate(content.splitlines(), start=1):
+        if line.startswith("## "):
+            match = VERSION_HEADING_REGEX.match(line)
+            if match is None:
+                raise ValueError(f"Invalid version heading on line {line_number}")
+            entries.append(
+                data.ChangelogEntry(
+                    version=match.group("version"), date=match.group("date")
+                )
+            )
+        elif line.startswith("- ") or line.startswith("* "):
+            if len(entries) == 0:
+                raise ValueError(f"Change outside of version on line {line_number}")
+            entries[-1].changes.append(line[2:].strip())
+        elif line.startswith(" ") and line.strip() != "":
+            if len(entries) == 0 or len(entries[-1].changes) == 0:
+                continue
+            entries[-1].changes[-1] += f" {line.strip()}"
+    return entries
+
+
+@lru_cache(maxsize=None)
+def load_changelog() -> List[data.ChangelogEntry]:
+    """
+    Changelog does not change during process lifetime, so it is parsed only once.
+    """
+    with open(CHANGELOG_PATH, encoding="utf-8") as ifp:
+        return parse_changelog(ifp.read())
@@ -0,0 +1,111 @@
+"""
+Circuit breaker to fail fast when database is unavailable.
+"""
+import logging
+import threading
+import time
+from enum import Enum
+from typing import Callable, Optional, TypeVar
+
+logger = logging.getLogger(__name__)
+
+T = TypeVar("T")
+
+
+class CircuitState(Enum):
+    closed = "closed"
+    open = "open"
+    half_open = "half_open"
+
+
+class CircuitOpen(Exception):
+    """
+    Raised when circuit is open and calls are rejected without reaching the database.
+    """
+
+
+class CircuitBreaker:
+    """
+    Counts consecutive failures and opens the circuit when they reach the threshold. After
+    open_duration seconds circuit becomes half-open and lets one probe call through, successful
+    probe closes circuit and failed one opens it again.
+    """
+
+    def __init__(self, threshold: int, open_duration: int) -> None:
+        self.threshold = threshold
+        self.open_duration = open_duration
+        self.failures = 0
+        self.state = CircuitState.closed
+        self.last_opened: Optional[float] = None
+        # Time when probe was let through in half-open state
+        self._probe_started: Optional[float] = None
+        self._lock = threading.Lock()
+
+    def allow(self) -> bool:
+        """
+        Raises CircuitOpen if call should be rejected. Returns True if call is let through
+        as half-open probe, caller should pass it to release_probe when done.
+        """
+        with self._lock:
+            if self.state == CircuitState.closed:
+                return False
+            if self.state == CircuitState.open:
+                if (
+                    self.last_opened is not None
+                    and time.monotonic() - self.last_opened < self.open_duration
+                ):
+                    raise CircuitOpen()
+                self.state = CircuitState.half_open
+                self._probe_started = None
+            # Half-open state lets through only one probe at a time, probe which did not
+            # report back within open_duration is considered lost
+            now = time.monotonic()
+            if (
+                self._probe_started is not None
+                and now - self._probe_started < self.open_duration
+            ):
+                raise CircuitOpen()
+            self._probe_started = now
+            return True
+
+    def release_probe(self) -> None:
+        """
+        Lets next call probe half-open circuit if probe finished without reporting success
+        or failure, for example request which did not query the database.
+        """
+        with self._lock:
+            if self.state == CircuitState.half_open:
+                self._probe_started = None
+
+    def record_success(self) -> None:
+        with self._lock:
+            if self.state != CircuitState.closed:
+                logger.info("Database circuit breaker closed")
+            self.failures = 0
+            self.state = CircuitState.closed
+            self._probe_started = None
+
+    def record_failure(self) -> None:
+        with self._lock:
+            self.failures += 1
+            self._probe_started = None
+            if self.state == CircuitState.half_open or self.failures >= self.threshold:
+                if self.state != CircuitState.open:
+                    logger.error(
+                        f"Database circuit breaker opened after {self.failures} failures"
+                    )
+                self.state = CircuitState.open
+                self.last_opened = time.monotonic()
+
+    def call(self, fn: Callable[[], T]) -> T:
+        """
+        Calls fn through circuit breaker, exceptions raised by fn are counted as failures.
+        """
+        self.allow()
+        try:
+            result = fn()
+        except Exception:
+            self.record_failure()
+            raise
+        self.record_success()
+        return result
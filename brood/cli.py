@@ -22,6 +22,7 @@ from .models import (
     KVBrood,
     Application,
 )
+from .settings import DB_URI, validate_db_uri
 
 
 def print_user(user: User) -> None:
@@ -65,7 +66,13 @@ def users_create_handler(args: argparse.Namespace) -> None:
     """
     session = SessionLocal()
     try:
-        user = actions.create_user(session, args.username, args.email, args.password)
+        user = actions.create_user(
+            session,
+            args.username,
+            args.email,
+            args.password,
+            bypass_registration_policy=args.force,
+        )
 
         if args.verified:
             user.verified = True
@@ -124,11 +131,11 @@ def users_forcepassword_handler(args: argparse.Namespace) -> None:
     Handler for "users forcepassword" subcommand.
     """
     session = SessionLocal()
-    password_context = actions.get_password_context()
     try:
-        new_password_hash = password_context.hash(args.new_password)
+        new_password_hash, password_peppered = actions.hash_password(args.new_password)
         user = actions.get_user(session, args.username, args.email)
         user.password_hash = new_password_hash
+        user.password_peppered = password_peppered
         session.add(user)
         session.commit()
         print_user(user)
@@ -136,6 +143,21 @@ def users_forcepassword_handler(args: argparse.Namespace) -> None:
         session.close()
 
 
+def users_admin_handler(args: argparse.Namespace) -> None:
+    """
+    Handler for "users admin" subcommand.
+    """
+    session = SessionLocal()
+    try:
+        user = actions.get_user(session, args.username, args.email)
+        user = actions.update_admin_flags(
+            session, user, is_admin=args.admin, is_super_admin=args.super_admin
+        )
+        print_user(user)
+    finally:
+        session.close()
+
+
 def limits_get_group_limit_handler(args: argparse.Namespace) -> None:
     """
     Handler for "users get_group_limit" subcommand.
@@ -718,6 +740,11 @@ def main() -> None:
         action="store_true",
         help="Set this flag to create a verified user",
     )
+    parser_users_create.add_argument(
+        "--force",
+        action="store_true",
+        help="Set this flag to allow reserved username and email from blocked or not allowed domain",
+    )
     parser_users_create.set_defaults(func=users_create_handler)
 
     parser_users_get = subcommands_users.add_parser("get", description="Get Brood user")
@@ -785,6 +812,33 @@ def main() -> None:
     parser_users_forcepassword.add_argument("new_password", help="New password")
     parser_users_forcepassword.set_defaults(func=users_forcepassword_handler)
 
+    parser_users_admin = subcommands_users.add_parser(
+        "admin", description="Set admin flags of user"
+    )
+    parser_users_admin.add_argument(
+        "-u",
+        "--username",
+        help="Username of the user to set admin flags for",
+    )
+    parser_users_admin.add_argument(
+        "-e",
+        "--email",
+        help="Email of the user to set admin flags for",
+    )
+    parser_users_admin.add_argument(
+        "--admin",
+        type=lambda x: bool(strtobool(x)),
+        default=None,
+        help="Admin flag",
+    )
+    parser_users_admin.add_argument(
+        "--super-admin",
+        type=lambda x: bool(strtobool(x)),
+        default=None,
+        help="Super-admin flag",
+    )
+    parser_users_admin.set_defaults(func=users_admin_handler)
+
     parser_limits = subcommands.add_parser("limits", description="Brood limits")
     parser_limits.set_defaults(func=lambda _: parser_limits.print_help())
     subcommands_limits = parser_limits.add_subparsers(
@@ -1256,6 +1310,10 @@ def main() -> None:
     parser_applications_migrate.set_defaults(func=application_migrate_handler)
 
     args = parser.parse_args()
+    # Otherwise commands would fail connecting to placeholder database
+    db_uri_error = validate_db_uri(DB_URI)
+    if db_uri_error is not None:
+        parser.error(db_uri_error)
     args.func(args)
 
 
@@ -0,0 +1,134 @@
+"""
+Settings which could be changed without restart of Brood API.
+
+Values are stored in kv_brood table under the same keys as environment variables and
+override environment values. Every worker polls the table periodically and optionally
+listens for notifications about changes in the table to reload immediately.
+"""
+import hashlib
+import json
+import logging
+import select
+import threading
+from typing import Any, Dict, List, Optional
+
+from . import actions
+from .external import SessionLocal, engine
+from .settings import ORIGINS, RATE_LIMIT
+
+logger = logging.getLogger(__name__)
+
+CORS_ALLOWED_ORIGINS_KEY = "BROOD_CORS_ALLOWED_ORIGINS"
+RATE_LIMIT_KEY = "BROOD_RATE_LIMIT"
+
+# Channel notified by trigger on kv_brood table
+CONFIG_NOTIFY_CHANNEL = "brood_config"
+CONFIG_KEYS = {CORS_ALLOWED_ORIGINS_KEY, RATE_LIMIT_KEY}
+
+
+class ConfigWatcher:
+    """
+    Holds current CORS origins and rate limit. Config dictionary is replaced as a whole
+    on reload, so readers always see consistent values without locking.
+    """
+
+    def __init__(self) -> None:
+        self._config: Dict[str, Any] = {
+            "cors_allowed_origins": ORIGINS,
+            "rate_limit": RATE_LIMIT,
+        }
+        self._config_hash: Optional[str] = None
+        self._stop = threading.Event()
+
+    def cors_allowed_origins(self) -> List[str]:
+        return self._config["cors_allowed_origins"]
+
+    def rate_limit(self) -> int:
+        return self._config["rate_limit"]
+
+    def config(self) -> Dict[str, Any]:
+        return dict(self._config)
+
+    def reload(self) -> bool:
+        """
+        Reads settings from database and applies them if they changed. Returns True if
+        config was updated.
+        """
+        db_session = SessionLocal()
+        try:
+            raw_origins = actions.get_kv_variable(
+                db_session, kv_key=CORS_ALLOWED_ORIGINS_KEY
+            )
+            raw_rate_limit = actions.get_kv_variable(db_session, kv_key=RATE_LIMIT_KEY)
+        finally:
+            db_session.close()
+
+        config = {
+            "cors_allowed_origins": raw_origins.kv_value.split(",")
+            if raw_origins is not None
+            else ORIGINS,
+            "rate_limit": int(raw_rate_limit.kv_value)
+            if raw_rate_limit is not None
+            else RATE_LIMIT,
+        }
+        if config["rate_limit"] < 0:
+            raise ValueError(f"{RATE_LIMIT_KEY} must not be negative")
+
+        config_hash = hashlib.sha256(
+            json.dumps(config, sort_keys=True).encode()
+        ).hexdigest()
+        if config_hash == self._config_hash:
+            return False
+        self._config = config
+        self._config_hash = config_hash
+        logger.info("Reloaded CORS origins and rate limit settings")
+        return True
+
+    def stop(self) -> None:
+        """
+        Makes listen return within its wait timeout.
+        """
+        self._stop.set()
+
+    def listen(self, wait_timeout_seconds: float = 5.0) -> None:
+        """
+        Blocks and reloads config on every notification about change of config keys in
+        kv_brood table until stop is called. Raises if connection to database fails, so
+        caller could fall back to polling.
+        """
+        # Connection is detached from the pool, it is held open by the listener
+        connection = engine.raw_connection()
+        connection.detach()
+        dbapi_connection = connection.connection
+        try:
+            dbapi_connection.autocommit = True
+            cursor = dbapi_connection.cursor()
+            cursor.execute(f"LISTEN {CONFIG_NOTIFY_CHANNEL}")
+            cursor.close()
+            logger.info(f"Listening for config changes on {CONFIG_NOTIFY_CHANNEL}")
+
+            while not self._stop.is_set():
+                readable, _, _ = select.select(
+                    [dbapi_connection], [], [], wait_timeout_seconds
+                )
+                if not readable:
+                    continue
+                dbapi_connection.poll()
+                changed_keys = set()
+                while dbapi_connection.notifies:
+                    notify = dbapi_connection.notifies.pop(0)
+                    changed_keys.add(notify.payload)
+                if not changed_keys & CONFIG_KEYS:
+                    continue
+                try:
+                    self.reload()
+                except Exception as err:
+                    logger.error(
+                        f"Config reload on notification failed: {str(err)}",
+                        extra={"error": err},
+                    )
+        finally:
+            connection.close()
+
+
+config_watcher = ConfigWatcher()
@@ -3,12 +3,14 @@ Pydantic schemas for the Brood HTTP API
 """
 from datetime import datetime
 from enum import Enum, unique
-from typing import List, Optional
+from typing import Any, Dict, List, Optional
 import uuid
 
-from pydantic import BaseModel, Field, validator
+from pydantic import BaseModel, Extra, Field, root_validator, validator
 
 from .models import Role, TokenType
+from .naming import snake_case
+from .settings import JSON_STRICT
 
 
 @unique
@@ -19,12 +21,43 @@ class SubscriptionSessionType(Enum):
     none = None
 
 
+@unique
+class LoginType(Enum):
+    username = "username"
+    email = "email"
+
+
+@unique
+class UserViewerRole(Enum):
+    """
+    Relation of the caller to the user in response, defines which fields are visible.
+    """
+
+    public = "public"
+    self = "self"
+    admin = "admin"
+
+
 @unique
 class SubscriptionPlanType(Enum):
     seats = "seats"
     events = "events"
 
 
+class RequestModel(BaseModel):
+    """
+    Base schema for JSON request bodies, unknown fields are rejected in strict mode.
+    Fields are accepted both in snake_case and camelCase.
+    """
+
+    class Config:
+        extra = Extra.forbid if JSON_STRICT else Extra.ignore
+
+    @root_validator(pre=True)
+    def snake_case_fields(cls, values):
+        return {snake_case(key): value for key, value in values.items()}
+
+
 class PingResponse(BaseModel):
     """
     Schema for ping response
@@ -33,12 +66,42 @@ class PingResponse(BaseModel):
     status: str
 
 
+class DBPoolHealthResponse(BaseModel):
+    healthy: Optional[bool] = None
+    last_probe_at: Optional[datetime] = None
+    idle_connections: int = 0
+    dead_connections: int = 0
+    error: Optional[str] = None
+
+
+class HealthResponse(BaseModel):
+    """
+    Schema for health check response, db_pool is reported only if pool probe is enabled
+    """
+
+    status: str
+    in_flight: int = 0
+    db_pool: Optional[DBPoolHealthResponse] = None
+
+
 class VersionResponse(BaseModel):
     """
     Schema for responses on /version endpoint
     """
 
     version: str
+    commit_hash: str = "unknown"
+    python_version: str = "unknown"
+
+
+class ChangelogEntry(BaseModel):
+    """
+    Schema for version in changelog, date is empty for unreleased changes
+    """
+
+    version: str
+    date: Optional[str] = None
+    changes: List[str] = Field(default_factory=list)
 
 
 class TokenResponse(BaseModel):
@@ -51,13 +114,22 @@ class TokenResponse(BaseModel):
 
     id: uuid.UUID
     access_token: Optional[uuid.UUID]
-    user_id: uuid.UUID
+    user_id: Optional[uuid.UUID]
     active: bool
     token_type: Optional[TokenType]
     note: Optional[str]
+    name: Optional[str] = None
     created_at: datetime
     updated_at: datetime
     restricted: bool
+    expires_at: Optional[datetime] = None
+    region: Optional[str] = None
+    bound_application_id: Optional[uuid.UUID] = None
+    service_account_id: Optional[uuid.UUID] = None
+    group_id: Optional[uuid.UUID] = None
+    impersonated_by: Optional[uuid.UUID] = None
+    scopes: Optional[List[str]] = None
+    derived_from_token_id: Optional[uuid.UUID] = None
 
     class Config:
         orm_mode = True
@@ -67,6 +139,73 @@ class TokenResponse(BaseModel):
         return values["id"]
 
 
+class ConfigResponse(BaseModel):
+    """
+    Schema for settings which could be reloaded at runtime
+    """
+
+    cors_allowed_origins: List[str] = Field(default_factory=list)
+    rate_limit: int
+
+
+class AdminStatsResponse(BaseModel):
+    """
+    Schema for entity counts on admin dashboards
+    """
+
+    users: int
+    verified_users: int
+    active_tokens: int
+    groups: int
+    resources: int
+    computed_at: datetime
+
+
+class TokenValidationRequest(RequestModel):
+    token: str
+
+
+class TokenValidationResponse(BaseModel):
+    """
+    Schema for token validation by external services
+    """
+
+    valid: bool
+    reason: Optional[str] = None
+    user_id: Optional[uuid.UUID] = None
+    service_account_id: Optional[uuid.UUID] = None
+    group_id: Optional[uuid.UUID] = None
+    impersonated_by: Optional[uuid.UUID] = None
+    scopes: List[str] = Field(default_factory=list)
+    expires_at: Optional[datetime] = None
+
+
+class TokenVerificationResponse(BaseModel):
+    """
+    Schema for pre-flight check of caller token, expires_in is empty for tokens without
+    expiration
+    """
+
+    valid: bool
+    expires_in: Optional[int] = None
+
+
+class TokenIntrospectionResponse(BaseModel):
+    """
+    Schema for token introspection analogous to RFC 7662, inactive tokens have only active field
+    """
+
+    active: bool
+    user_id: Optional[uuid.UUID] = None
+    service_account_id: Optional[uuid.UUID] = None
+    group_id: Optional[uuid.UUID] = None
+    impersonated_by: Optional[uuid.UUID] = None
+    scopes: Optional[List[str]] = None
+    token_type: Optional[TokenType] = None
+    expires_at: Optional[datetime] = None
+    application_id: Optional[uuid.UUID] = None
+
+
 class UserResponse(BaseModel):
     """
     Schema for a registered user
@@ -83,6 +222,9 @@ class UserResponse(BaseModel):
     updated_at: Optional[datetime] = None
     autogenerated: Optional[bool] = None
     application_id: Optional[uuid.UUID] = None
+    is_admin: Optional[bool] = None
+    is_super_admin: Optional[bool] = None
+    profile: Optional[Dict[str, Any]] = None
 
     class Config:
         orm_mode = True
@@ -90,6 +232,49 @@ class UserResponse(BaseModel):
         allow_population_by_field_name = True
 
 
+class TokenUserResponse(TokenResponse):
+    """
+    Schema for a token issued on login together with the user it belongs to
+    """
+
+    user: UserResponse
+
+
+class UserAvailabilityResponse(BaseModel):
+    available: bool
+
+
+class ActivityEventResponse(BaseModel):
+    action: str
+    created_at: datetime
+    ip: Optional[str] = None
+    device: Optional[str] = None
+    request_id: Optional[str] = None
+    details: Dict[str, Any] = Field(default_factory=dict)
+
+
+class ActivityListResponse(BaseModel):
+    events: List[ActivityEventResponse] = Field(default_factory=list)
+    next_cursor: Optional[str] = None
+
+
+class LoginHistoryEntryResponse(BaseModel):
+    created_at: datetime
+    ip: Optional[str] = None
+    user_agent: Optional[str] = None
+    success: bool
+
+
+class LoginHistoryListResponse(BaseModel):
+    entries: List[LoginHistoryEntryResponse] = Field(default_factory=list)
+    next_cursor: Optional[str] = None
+
+
+class UserDeletionConfirmationResponse(BaseModel):
+    confirmation_token: uuid.UUID
+    expires_at: datetime
+
+
 class UserInListResponse(BaseModel):
     """
     Represents users in list of group members.
@@ -99,6 +284,7 @@ class UserInListResponse(BaseModel):
     username: str
     email: str
     user_type: Role
+    joined_at: Optional[datetime] = None
 
 
 class UsersListResponse(BaseModel):
@@ -111,6 +297,10 @@ class UsersListResponse(BaseModel):
     users: List[UserInListResponse] = Field(default_factory=list)
     num_users: int
     num_seats: int
+    total: Optional[int] = None
+    count_is_exact: Optional[bool] = None
+    limit: Optional[int] = None
+    offset: int = 0
 
 
 class ResetPasswordResponse(BaseModel):
@@ -197,6 +387,24 @@ class GroupListResponse(BaseModel):
     groups: List[GroupResponse] = Field(default_factory=list)
 
 
+class GroupTokenResponse(BaseModel):
+    """
+    Group token in list, token value is returned only once on creation. Fingerprint
+    identifies the token to revoke it.
+    """
+
+    fingerprint: str
+    group_id: uuid.UUID
+    note: Optional[str] = None
+    scopes: List[str] = Field(default_factory=list)
+    created_at: datetime
+    expires_at: datetime
+
+
+class GroupTokensListResponse(BaseModel):
+    tokens: List[GroupTokenResponse] = Field(default_factory=list)
+
+
 class GroupUserResponse(BaseModel):
     """
     Joint Group and GroupUsers schema.
@@ -269,7 +477,42 @@ class ApplicationResponse(BaseModel):
     group_id: uuid.UUID
     name: str
     description: Optional[str] = None
+    response_headers: Optional[Dict[str, str]] = None
 
 
 class ApplicationsListResponse(BaseModel):
     applications: List[ApplicationResponse] = Field(default_factory=list)
+
+
+class ApplicationTransferResponse(BaseModel):
+    id: uuid.UUID
+    application_id: uuid.UUID
+    new_owner_type: str
+    new_owner_id: uuid.UUID
+    expires_at: datetime
+    created_at: datetime
+
+    class Config:
+        orm_mode = True
+
+
+class WebAuthnCredentialResponse(BaseModel):
+    id: uuid.UUID
+    created_at: datetime
+
+    class Config:
+        orm_mode = True
+
+
+class ServiceAccountResponse(BaseModel):
+    id: uuid.UUID
+    name: str
+    application_id: uuid.UUID
+    created_at: datetime
+
+    class Config:
+        orm_mode = True
+
+
+class ServiceAccountsListResponse(BaseModel):
+    service_accounts: List[ServiceAccountResponse] = Field(default_factory=list)
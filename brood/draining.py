@@ -0,0 +1,36 @@
+"""
+State of graceful shutdown of a worker.
+
+On shutdown signal worker is marked as draining first, so health check reports it as not
+ready and load balancer stops routing new requests to it, while requests in flight are
+completed.
+
+Long-lived streams never complete on their own, they register callbacks to be ended when
+draining starts.
+"""
+from typing import Callable, List
+
+
+class DrainState:
+    def __init__(self) -> None:
+        self.draining = False
+        # Requests are dispatched in a single event loop, plain counter is enough
+        self.in_flight = 0
+        self._callbacks: List[Callable[[], None]] = []
+
+    def on_draining(self, callback: Callable[[], None]) -> None:
+        """
+        Registers callback called once when draining starts, it could be called from
+        signal handler outside of the event loop.
+        """
+        self._callbacks.append(callback)
+
+    def start_draining(self) -> None:
+        if self.draining:
+            return
+        self.draining = True
+        for callback in self._callbacks:
+            callback()
+
+
+drain_state = DrainState()
@@ -20,3 +20,51 @@ class ApplicationsNotFound(Exception):
     """
     Raised when application with the given parameters is not found in the database.
     """
+
+
+class ApplicationTransferNotFound(Exception):
+    """
+    Raised when there is no pending transfer of application with the given parameters.
+    """
+
+
+class ApplicationTransferExists(Exception):
+    """
+    Raised when application already has pending transfer.
+    """
+
+
+class ApplicationTransferExpired(Exception):
+    """
+    Raised when transfer of application is accepted after its expiration time.
+    """
+
+
+class ServiceAccountNotFound(Exception):
+    """
+    Raised when service account with the given parameters is not found in the database.
+    """
+
+
+class WebAuthnChallengeNotFound(Exception):
+    """
+    Raised when WebAuthn ceremony is completed without challenge or after it expired.
+    """
+
+
+class WebAuthnVerificationFailed(Exception):
+    """
+    Raised when WebAuthn authenticator response could not be verified.
+    """
+
+
+class WebAuthnCredentialNotFound(Exception):
+    """
+    Raised when WebAuthn credential is not found in the database.
+    """
+
+
+class ApplicationHeadersInvalid(ValueError):
+    """
+    Raised when application response headers have invalid names or values.
+    """
@@ -1,18 +1,85 @@
 """
 Connections to external services
 """
-from sqlalchemy import create_engine
+from fastapi import HTTPException
+from sqlalchemy import create_engine, event
+from sqlalchemy.engine import ExceptionContext
+from sqlalchemy.exc import OperationalError
 from sqlalchemy.orm.session import Session, sessionmaker
 
-from .settings import DB_URI
+from .cache import cache_from_env
+from .circuit_breaker import CircuitBreaker, CircuitOpen
+from .pool_probe import PoolProbe
+from .settings import (
+    CB_FAILURE_THRESHOLD,
+    CB_OPEN_DURATION_SECONDS,
+    DB_STATEMENT_TIMEOUT_MS,
+    DB_URI,
+    validate_db_uri,
+)
 
 
-if DB_URI is None:
-    raise ValueError("BROOD_DB_URI environment variable not set")
-engine = create_engine(DB_URI)
+# Malformed URI is reported by validate_settings together with other misconfigurations,
+# engine does not connect until the first query, so placeholder URI is never used
+DB_URI_PLACEHOLDER = "postgresql:///brood"
+engine = create_engine(
+    DB_URI if validate_db_uri(DB_URI) is None else DB_URI_PLACEHOLDER  # type: ignore
+)
 SessionLocal = sessionmaker(autocommit=False, autoflush=False, bind=engine)
 
 
+@event.listens_for(engine, "connect")
+def set_statement_timeout(dbapi_connection, connection_record) -> None:
+    # Runs for every new pooled connection, so runaway queries are aborted by the server
+    if DB_STATEMENT_TIMEOUT_MS > 0:
+        cursor = dbapi_connection.cursor()
+        cursor.execute(f"SET statement_timeout = {DB_STATEMENT_TIMEOUT_MS}")
+        cursor.close()
+        # Otherwise setting is reverted by rollback when connection returns to the pool
+        dbapi_connection.commit()
+
+
+cache = cache_from_env()
+
+pool_probe = PoolProbe(engine)
+
+db_circuit_breaker = CircuitBreaker(
+    threshold=CB_FAILURE_THRESHOLD, open_duration=CB_OPEN_DURATION_SECONDS
+)
+
+
+# SQLSTATE codes of server shutting down or not accepting connections, class 08 is
+# checked separately
+UNAVAILABLE_SQLSTATES = {"57P01", "57P02", "57P03"}
+
+
+def is_connection_error(context: ExceptionContext) -> bool:
+    """
+    Checks if database error is caused by connectivity problem. Errors like constraint
+    violations or queries cancelled by statement_timeout are not.
+    """
+    if context.is_disconnect:
+        return True
+    if not isinstance(context.sqlalchemy_exception, OperationalError):
+        return False
+    # Errors raised before connection is established have no SQLSTATE
+    pgcode = getattr(context.original_exception, "pgcode", None)
+    return pgcode is None or pgcode.startswith("08") or pgcode in UNAVAILABLE_SQLSTATES
+
+
+@event.listens_for(engine, "handle_error")
+def record_db_failure(context: ExceptionContext) -> None:
+    if is_connection_error(context):
+        db_circuit_breaker.record_failure()
+
+
+@event.listens_for(engine, "after_cursor_execute")
+def record_db_success(
+    conn, cursor, statement, parameters, context, executemany
+) -> None:
+    db_circuit_breaker.record_success()
+
+
 def yield_db_session_from_env() -> Session:
     """
     Creates an active database session using configuration from the environment and yields it as
@@ -20,9 +87,19 @@ def yield_db_session_from_env() -> Session:
     https://fastapi.tiangolo.com/tutorial/sql-databases/#create-a-dependency
 
     Behaves identically to db_session_from_env in all other respects.
+
+    Responds with 503 without touching the database while database circuit breaker is open.
     """
+    try:
+        probe = db_circuit_breaker.allow()
+    except CircuitOpen:
+        raise HTTPException(
+            status_code=503, detail="Database is temporarily unavailable"
+        )
     session = SessionLocal()
     try:
         yield session
     finally:
         session.close()
+        if probe:
+            db_circuit_breaker.release_probe()
@@ -0,0 +1,100 @@
+"""
+Localized messages for user-facing errors.
+
+Errors carry stable machine-readable code, human-readable detail is picked from MESSAGES
+by locale requested in Accept-Language header.
+"""
+from typing import Dict, List, Optional, Tuple
+
+from fastapi import HTTPException
+
+DEFAULT_LOCALE = "en"
+
+MESSAGES: Dict[str, Dict[str, str]] = {
+    "en": {
+        "validation_error": "Request parameters are invalid",
+        "unknown_field": "Request body contains unknown fields",
+        "invalid_path_parameter": "Path parameters are malformed",
+        "not_authenticated": "Not authenticated",
+        "token_not_found": "Access token not found",
+        "token_expired": "Token has expired",
+        "token_bound_to_another_application": "Token is bound to another application",
+        "token_application_required": "Token is bound to application, provide its ID",
+        "service_account_token_not_allowed": "Service account tokens are not allowed",
+        "group_token_not_allowed": "Group tokens are not allowed",
+        "email_exists_normalized": "User with this email address already exists",
+        "email_domain_blocked": "Registration with this email domain is blocked",
+        "email_domain_not_allowed": "Registration with this email domain is not allowed",
+    },
+    "es": {
+        "validation_error": "Los parámetros de la solicitud no son válidos",
+        "unknown_field": "El cuerpo de la solicitud contiene campos desconocidos",
+        "invalid_path_parameter": "Los parámetros de la ruta no son válidos",
+        "not_authenticated": "No autenticado",
+        "token_not_found": "Token de acceso no encontrado",
+        "token_expired": "El token ha caducado",
+        "token_bound_to_another_application": "El token pertenece a otra aplicación",
+        "token_application_required": "El token pertenece a una aplicación, indique su ID",
+        "service_account_token_not_allowed": "No se permiten tokens de cuentas de servicio",
+        "group_token_not_allowed": "No se permiten tokens de grupo",
+        "email_exists_normalized": "Ya existe un usuario con esta dirección de correo",
+        "email_domain_blocked": "El registro con este dominio de correo está bloqueado",
+        "email_domain_not_allowed": "El registro con este dominio de correo no está permitido",
+    },
+}
+
+# Details of errors raised by FastAPI itself, they could not be raised with codes
+DETAIL_CODES = {"Not authenticated": "not_authenticated"}
+
+
+class LocalizedHTTPException(HTTPException):
+    """
+    HTTP exception with error code, detail is rendered in locale requested by client.
+    """
+
+    def __init__(
+        self, status_code: int, code: str, headers: Optional[Dict[str, str]] = None
+    ) -> None:
+        super().__init__(
+            status_code=status_code,
+            detail=MESSAGES[DEFAULT_LOCALE][code],
+            headers=headers,
+        )
+        self.code = code
+
+
+def parse_accept_language(accept_language: str) -> List[str]:
+    """
+    Returns primary language tags from Accept-Language header ordered by quality.
+    """
+    languages: List[Tuple[float, str]] = []
+    for language_range in accept_language.split(","):
+        tag, *params = [part.strip() for part in language_range.split(";")]
+        if tag == "":
+            continue
+        quality = 1.0
+        for param in params:
+            name, _, value = param.partition("=")
+            if name.strip() == "q":
+                try:
+                    quality = float(value)
+                except ValueError:
+                    quality = 0.0
+        if quality > 0:
+            languages.append((quality, tag.split("-")[0].lower()))
+    # Sort is stable, so languages with equal quality keep order from the header
+    languages.sort(key=lambda language: language[0], reverse=True)
+    return [tag for _, tag in languages]
+
+
+def negotiate_locale(accept_language: Optional[str]) -> str:
+    if accept_language is None:
+        return DEFAULT_LOCALE
+    for tag in parse_accept_language(accept_language):
+        if tag in MESSAGES:
+            return tag
+    return DEFAULT_LOCALE
+
+
+def localized_message(code: str, locale: str) -> str:
+    return MESSAGES.get(locale, {}).get(code, MESSAGES[DEFAULT_LOCALE][code])
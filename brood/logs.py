@@ -0,0 +1,53 @@
+"""
+Logging setup of Brood API workers.
+
+In json format every record is written as one JSON object per line, so logs could be
+parsed by aggregation tools. Context passed to loggers in extra argument is written as
+separate fields.
+"""
+from datetime import datetime, timezone
+import json
+import logging
+
+# Keys of extra argument of log calls which are written as fields of JSON record
+CONTEXT_FIELDS = ("request_id", "user_id", "error")
+
+
+class JSONFormatter(logging.Formatter):
+    def format(self, record: logging.LogRecord) -> str:
+        entry = {
+            "time": datetime.fromtimestamp(record.created, timezone.utc).isoformat(),
+            "level": record.levelname,
+            "logger": record.name,
+            "message": record.getMessage(),
+        }
+        for field in CONTEXT_FIELDS:
+            value = getattr(record, field, None)
+            if value is not None:
+                entry[field] = str(value)
+        if record.exc_info:
+            entry["exception"] = self.formatException(record.exc_info)
+        return json.dumps(entry)
+
+
+def setup_logging(level: str, log_format: str) -> None:
+    """
+    Configures root logger. In json format uvicorn and uvicorn.access loggers, which do
+    not propagate records to root logger, are switched to the same handler. uvicorn.error
+    propagates to uvicorn logger, so it has no handler of its own.
+    """
+    handler = logging.StreamHandler()
+    if log_format == "json":
+        handler.setFormatter(JSONFormatter())
+    else:
+        handler.setFormatter(logging.Formatter(logging.BASIC_FORMAT))
+    # Unknown level is reported by settings validation, which logs its errors itself
+    numeric_level = logging.getLevelName(level)
+    if not isinstance(numeric_level, int):
+        numeric_level = logging.INFO
+    logging.basicConfig(level=numeric_level, handlers=[handler])
+
+    if log_format == "json":
+        for name in ("uvicorn", "uvicorn.access"):
+            logging.getLogger(name).handlers = [handler]
+        logging.getLogger("uvicorn.error").handlers = []
@@ -1,17 +1,183 @@
-from typing import Optional, Union
-from uuid import UUID
+import asyncio
+import base64
+from collections import OrderedDict
+from datetime import datetime, timezone
+import hashlib
+import ipaddress
+import json
+import logging
+import random
+import re
+import time
+from typing import Any, Callable, Dict, List, Optional, Set, Union
+from uuid import UUID, uuid4
 
 from fastapi import (
     Depends,
+    Header,
     HTTPException,
     Request,
 )
+from fastapi.encoders import jsonable_encoder
+from fastapi.exceptions import RequestValidationError
+from fastapi.responses import JSONResponse
 from fastapi.security import OAuth2PasswordBearer
+from pydantic import BaseModel, Field, parse_file_as
+from starlette.applications import Starlette
+from starlette.concurrency import run_in_threadpool
+from starlette.exceptions import HTTPException as StarletteHTTPException
+from starlette.middleware.base import BaseHTTPMiddleware, RequestResponseEndpoint
+from starlette.middleware.cors import CORSMiddleware
+from starlette.datastructures import Headers
+from starlette.responses import Response
+from starlette.routing import Router
+from starlette.types import ASGIApp, Message, Receive, Scope, Send
 
 from . import actions
 from . import models
-from .external import yield_db_session_from_env
-from .settings import BOT_INSTALLATION_TOKEN, BOT_INSTALLATION_TOKEN_HEADER
+from .cache import CacheMiss
+from .draining import drain_state
+from .external import SessionLocal, cache, yield_db_session_from_env
+from .i18n import (
+    DETAIL_CODES,
+    LocalizedHTTPException,
+    localized_message,
+    negotiate_locale,
+)
+from .naming import camel_case, rename_keys
+from .ratelimit import TokenBucketLimiter
+from .tracing import set_request_id_attribute
+from .settings import (
+    APPLICATION_ID_HEADER,
+    BOT_INSTALLATION_TOKEN,
+    BOT_INSTALLATION_TOKEN_HEADER,
+    DOCS_TARGET_PATH,
+    JSON_NAMING,
+    TRUST_PROXY,
+    TRUSTED_PROXIES,
+)
+
+logger = logging.getLogger(__name__)
+# Separate logger, so bodies could be logged without enabling all debug logs
+body_logger = logging.getLogger(f"{__name__}.bodies")
+
+# Region client sent request to, compared with region token was issued in
+REGION_HEADER = "X-Brood-Region"
+
+REQUEST_ID_HEADER = "X-Request-ID"
+REQUEST_ID_REGEX = re.compile(r"^[A-Za-z0-9_.-]{1,128}$")
+
+APPLICATION_HEADERS_CACHE_TTL_SECONDS = 300
+APPLICATION_SLUG_CACHE_TTL_SECONDS = 300
+
+IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+IDEMPOTENCY_KEY_REGEX = re.compile(r"^[A-Za-z0-9_-]{1,64}$")
+
+FORWARDED_FOR_HEADER = "X-Forwarded-For"
+
+CONTENT_HASH_HEADER = "X-Content-SHA256"
+
+# Values of JSON fields and form parameters with these words in name are not logged
+SENSITIVE_JSON_VALUE_REGEX = re.compile(
+    r'("[^"]*(?:password|token|secret|key)[^"]*"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)',
+    re.IGNORECASE,
+)
+SENSITIVE_FORM_VALUE_REGEX = re.compile(
+    r"((?:^|&)[^=&]*(?:password|token|secret|key)[^=&]*=)[^&]*", re.IGNORECASE
+)
+
+
+def parse_trusted_proxies(
+    cidrs: List[str],
+) -> List[Union[ipaddress.IPv4Network, ipaddress.IPv6Network]]:
+    networks = []
+    for cidr in cidrs:
+        try:
+            networks.append(ipaddress.ip_network(cidr, strict=False))
+        except ValueError:
+            logger.error(f"Skipping invalid trusted proxy CIDR: {cidr}")
+    return networks
+
+
+trusted_proxy_networks = parse_trusted_proxies(TRUSTED_PROXIES)
+
+
+def is_trusted_proxy(address: str) -> bool:
+    try:
+        ip = ipaddress.ip_address(address)
+    except ValueError:
+        return False
+    return any(ip in network for network in trusted_proxy_networks)
+
+
+def client_ip(request: Request) -> str:
+    """
+    Returns IP address of the client which sent the request.
+
+    X-Forwarded-For is taken into account only if BROOD_TRUST_PROXY is enabled and
+    request came from a trusted proxy. Chain is walked from right to left skipping
+    trusted proxies, first address not from trusted proxies is the client. Addresses
+    added by the client itself are never reached, so they could not be spoofed.
+    """
+    remote_addr = request.client.host if request.client is not None else "unknown"
+    if not TRUST_PROXY or not trusted_proxy_networks:
+        return remote_addr
+    if not is_trusted_proxy(remote_addr):
+        return remote_addr
+
+    forwarded_for = ",".join(request.headers.getlist(FORWARDED_FOR_HEADER))
+    hops = [hop.strip() for hop in forwarded_for.split(",") if hop.strip() != ""]
+    client = remote_addr
+    for hop in reversed(hops):
+        try:
+            ipaddress.ip_address(hop)
+        except ValueError:
+            # Malformed entry could not be attributed to anyone, stop at last known hop
+            break
+        client = hop
+        if not is_trusted_proxy(hop):
+            break
+    return client
+
+
+JSON_MEDIA_TYPE = "application/json; charset=utf-8"
+MSGPACK_MEDIA_TYPE = "application/msgpack"
+
+
+class UTF8JSONResponse(JSONResponse):
+    """
+    JSON response with explicit charset in Content-Type header, so clients do not guess
+    encoding of non-ASCII usernames and emails.
+
+    Keys are rendered in camelCase if BROOD_JSON_NAMING is camel.
+    """
+
+    media_type = JSON_MEDIA_TYPE
+
+    def render(self, content: Any) -> bytes:
+        if JSON_NAMING == "camel":
+            content = rename_keys(content, camel_case)
+        return super().render(content)
+
+
+def request_audit_details(request: Request) -> Dict[str, Optional[str]]:
+    """
+    Returns client details of the request stored with audit events.
+    """
+    return {
+        "ip": client_ip(request),
+        "device": request.headers.get("User-Agent"),
+        "request_id": getattr(request.state, "request_id", None),
+    }
+
+
+def location_path(request: Request, path: str) -> str:
+    """
+    Returns path for Location header of created entity, prefixed with path the
+    application is mounted at.
+    """
+    return f"{request.scope.get('root_path', '')}{path}"
+
 
 # Login implementation follows:
 # https://fastapi.tiangolo.com/tutorial/security/simple-oauth2/
@@ -19,19 +185,188 @@ oauth2_scheme = OAuth2PasswordBearer(tokenUrl="token")
 oauth2_scheme_manual = OAuth2PasswordBearer(tokenUrl="token", auto_error=False)
 
 
-async def get_current_user(
+async def get_current_token(
+    request: Request,
     token: UUID = Depends(oauth2_scheme),
     db_session=Depends(yield_db_session_from_env),
-) -> models.User:
+    brood_region: Optional[str] = Header(None, alias=REGION_HEADER),
+) -> models.Token:
+    """
+    Returns active token of the caller, it belongs to user, service account or group.
+    Token ID is stored in request.state.token_id, service account ID in
+    request.state.service_account_id, group ID in request.state.group_id.
+
+    Requests with impersonation token are recorded in audit log, see
+    record_impersonated_request.
+    """
     try:
         token_object = actions.get_token(session=db_session, token=token)
     except actions.TokenNotFound:
-        raise HTTPException(status_code=404, detail="Access token not found")
-    if not token_object.active:
-        raise HTTPException(status_code=403, detail="Token has expired")
+        raise LocalizedHTTPException(status_code=404, code="token_not_found")
+    if not token_object.active or actions.is_token_expired(token_object):
+        raise LocalizedHTTPException(status_code=403, code="token_expired")
+    if token_object.bound_application_id is not None:
+        # Bound token is accepted only with its application in header or subdomain
+        application_id = get_application_id(request)
+        if application_id is None:
+            raise LocalizedHTTPException(
+                status_code=403, code="token_application_required"
+            )
+        if application_id != token_object.bound_application_id:
+            raise LocalizedHTTPException(
+                status_code=403, code="token_bound_to_another_application"
+            )
+    if (
+        brood_region is not None
+        and token_object.region is not None
+        and brood_region != token_object.region
+    ):
+        logger.info(
+            f"cross_region_token: token {token_object.id} issued in region {token_object.region} "
+            f"used in region {brood_region}"
+        )
+    request.state.token_id = str(token_object.id)
+    request.state.service_account_id = token_object.service_account_id
+    request.state.group_id = token_object.group_id
+    if token_object.impersonated_by is not None:
+        record_impersonated_request(request, db_session, token_object)
+    return token_object
+
+
+SAFE_METHODS = {"GET", "HEAD", "OPTIONS"}
+
+# Impersonation tokens could only read these routes, account and its tokens are changed
+# only by the user. Routes elsewhere which issue credentials or change ownership, like
+# group and service account tokens, check is_token_impersonated themselves
+IMPERSONATION_PROTECTED_PATH_PREFIXES = ("/user", "/token", "/password", "/profile")
+
+
+def impersonation_audit_cache_key(token_id: UUID) -> str:
+    return f"brood:impersonation_audited:{token_id}"
+
+
+def record_impersonated_request(
+    request: Request, db_session, token_object: models.Token
+) -> None:
+    """
+    Records request with impersonation token in audit log. Changes are recorded on every
+    request, reads only on the first read with the token, so browsing as the user does
+    not write audit events on every page.
+    """
+    if request.method in SAFE_METHODS:
+        cache_key = impersonation_audit_cache_key(token_object.id)
+        try:
+            cache.get(cache_key)
+            return
+        except CacheMiss:
+            pass
+        except Exception as err:
+            logger.error(
+                f"Unable to read impersonation audit mark: {str(err)}",
+                extra={"error": err},
+            )
+        ttl = 3600
+        if token_object.expires_at is not None:
+            remaining = token_object.expires_at - datetime.now(timezone.utc)
+            ttl = max(int(remaining.total_seconds()), 1)
+        try:
+            cache.set(cache_key, "1", ttl=ttl)
+        except Exception as err:
+            logger.error(
+                f"Unable to write impersonation audit mark: {str(err)}",
+                extra={"error": err},
+            )
+
+    actions.create_audit_event(
+        db_session,
+        event_type="impersonated_request",
+        actor_user_id=token_object.impersonated_by,
+        target_user_id=token_object.user_id,
+        details={
+            **request_audit_details(request),
+            "method": request.method,
+            "path": request.url.path,
+        },
+    )
+    db_session.commit()
+
+
+def is_impersonation_token(token_id: UUID) -> bool:
+    db_session = SessionLocal()
+    try:
+        token_object = actions.get_token(session=db_session, token=token_id)
+    except actions.TokenNotFound:
+        return False
+    finally:
+        db_session.close()
+    return token_object.impersonated_by is not None
+
+
+async def reject_impersonated_changes(request: Request) -> None:
+    """
+    Application-wide dependency which rejects impersonation tokens in requests changing
+    users and tokens, e.g. password change, token creation and account deletion.
+    """
+    if request.method in SAFE_METHODS or not request.url.path.startswith(
+        IMPERSONATION_PROTECTED_PATH_PREFIXES
+    ):
+        return
+    authorization = request.headers.get("Authorization", "")
+    scheme, _, raw_token = authorization.partition(" ")
+    if scheme.lower() != "bearer":
+        return
+    try:
+        token_id = UUID(raw_token)
+    except ValueError:
+        # Malformed tokens are rejected by authentication of the route
+        return
+
+    # Query is blocking, event loop should keep serving other requests meanwhile
+    if await run_in_threadpool(is_impersonation_token, token_id):
+        raise HTTPException(
+            status_code=403,
+            detail="Impersonation tokens are not authorized to change users and tokens.",
+        )
+
+
+async def get_current_user(
+    request: Request,
+    token: UUID = Depends(oauth2_scheme),
+    db_session=Depends(yield_db_session_from_env),
+    brood_region: Optional[str] = Header(None, alias=REGION_HEADER),
+) -> models.User:
+    token_object = await get_current_token(request, token, db_session, brood_region)
+    if token_object.group_id is not None:
+        raise LocalizedHTTPException(status_code=403, code="group_token_not_allowed")
+    if token_object.user is None:
+        raise LocalizedHTTPException(
+            status_code=403, code="service_account_token_not_allowed"
+        )
     return token_object.user
 
 
+def get_application_id(
+    request: Request, application_id: Optional[UUID] = None
+) -> Optional[UUID]:
+    """
+    Returns application ID provided explicitly with request parameters, otherwise looks for it in
+    the header configured by BROOD_APPLICATION_ID_HEADER.
+    """
+    if application_id is not None:
+        return application_id
+
+    application_id_header = request.headers.get(APPLICATION_ID_HEADER)
+    if application_id_header is None or application_id_header == "":
+        # Application resolved from subdomain by SubdomainRoutingMiddleware
+        return getattr(request.state, "application_id", None)
+    try:
+        return UUID(application_id_header)
+    except ValueError:
+        raise HTTPException(
+            status_code=400, detail=f"Invalid {APPLICATION_ID_HEADER} provided"
+        )
+
+
 def autogenerated_user_token_check(request: Request) -> bool:
     if BOT_INSTALLATION_TOKEN is None:
         raise ValueError("BOT_INSTALLATION_TOKEN environment variable must be set")
@@ -60,6 +395,7 @@ async def get_current_user_or_installation(
     request: Request,
     token: UUID = Depends(oauth2_scheme_manual),
     db_session=Depends(yield_db_session_from_env),
+    brood_region: Optional[str] = Header(None, alias=REGION_HEADER),
 ) -> Union[models.User, bool]:
     """
     Allow access if Bugout installation token provided, if not
@@ -69,7 +405,7 @@ async def get_current_user_or_installation(
     if autogenerated_user is True:
         return True
     elif autogenerated_user is False:
-        user = await get_current_user(token, db_session)
+        user = await get_current_user(request, token, db_session, brood_region)
         return user
 
     raise HTTPException(status_code=400, detail="Access denied")
@@ -102,3 +438,1039 @@ async def is_token_restricted(
     except actions.TokenNotFound:
         raise HTTPException(status_code=404, detail="Access token not found")
     return token_object.restricted
+
+
+async def is_token_impersonated(
+    token: UUID = Depends(oauth2_scheme),
+    db_session=Depends(yield_db_session_from_env),
+) -> bool:
+    """
+    Impersonation tokens are not authorized for destructive operations like account
+    deletion.
+    """
+    try:
+        token_object = actions.get_token(session=db_session, token=token)
+    except actions.TokenNotFound:
+        raise HTTPException(status_code=404, detail="Access token not found")
+    return token_object.impersonated_by is not None
+
+
+def internal_error_response(request_id: Optional[str]) -> Response:
+    """
+    Response for internal errors, carries only request ID which client could refer to in
+    bug reports, details of the error are written to logs.
+    """
+    return UTF8JSONResponse(
+        status_code=500,
+        content={"detail": "Internal server error", "request_id": request_id},
+    )
+
+
+class RequestIDMiddleware(BaseHTTPMiddleware):
+    """
+    Assigns request ID available as request.state.request_id and returns it in X-Request-ID
+    header. Valid request ID provided by client is reused.
+
+    Unhandled exceptions are logged with request ID and rendered as JSON error.
+    """
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        request_id = request.headers.get(REQUEST_ID_HEADER)
+        if request_id is None or REQUEST_ID_REGEX.match(request_id) is None:
+            request_id = str(uuid4())
+        request.state.request_id = request_id
+        set_request_id_attribute(request_id)
+
+        try:
+            response = await call_next(request)
+        except Exception:
+            logger.exception(
+                f"Unhandled exception, request ID: {request_id}",
+                extra={"request_id": request_id},
+            )
+            response = internal_error_response(request_id)
+        response.headers[REQUEST_ID_HEADER] = request_id
+        return response
+
+
+def application_headers_cache_key(application_id: UUID) -> str:
+    return f"app_headers:{application_id}"
+
+
+def evict_application_headers(application_id: UUID) -> None:
+    try:
+        cache.delete(application_headers_cache_key(application_id))
+    except Exception as err:
+        logger.error(
+            f"Unable to evict application headers from cache: {str(err)}",
+            extra={"error": err},
+        )
+
+
+def get_application_headers(application_id: UUID) -> Dict[str, str]:
+    """
+    Returns custom response headers of application, cached to avoid database query per request.
+    Only existing applications are cached, so arbitrary application IDs in header do not
+    fill the cache.
+    """
+    cache_key = application_headers_cache_key(application_id)
+    try:
+        return json.loads(cache.get(cache_key))
+    except CacheMiss:
+        pass
+
+    db_session = SessionLocal()
+    try:
+        applications = actions.get_applications(
+            db_session, application_id=application_id
+        )
+    finally:
+        db_session.close()
+
+    if len(applications) == 0:
+        return {}
+    headers: Dict[str, str] = applications[0].response_headers or {}
+    cache.set(cache_key, json.dumps(headers), ttl=APPLICATION_HEADERS_CACHE_TTL_SECONDS)
+    return headers
+
+
+def application_slug_cache_key(slug: str) -> str:
+    return f"app_slug:{slug}"
+
+
+def get_application_id_by_slug(slug: str) -> Optional[UUID]:
+    """
+    Returns ID of application registered with the slug, cached to avoid database query
+    per request. Only registered slugs are cached, so arbitrary Host headers do not
+    fill the cache.
+    """
+    cache_key = application_slug_cache_key(slug)
+    try:
+        return UUID(cache.get(cache_key))
+    except CacheMiss:
+        pass
+
+    db_session = SessionLocal()
+    try:
+        application_id = actions.get_application_id_by_slug(db_session, slug)
+    finally:
+        db_session.close()
+
+    if application_id is not None:
+        cache.set(
+            cache_key, str(application_id), ttl=APPLICATION_SLUG_CACHE_TTL_SECONDS
+        )
+    return application_id
+
+
+DNS_LABEL_REGEX = re.compile(r"^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$")
+
+
+def subdomain_slug(host: Optional[str], base_domain: str) -> Optional[str]:
+    """
+    Returns leftmost label of Host header if the rest of it is base domain and label is
+    valid DNS label. Port is ignored.
+    """
+    if host is None:
+        return None
+    hostname = host.rsplit(":", 1)[0].strip().rstrip(".").lower()
+    suffix = f".{base_domain}"
+    if not hostname.endswith(suffix):
+        return None
+    slug = hostname[: -len(suffix)]
+    if DNS_LABEL_REGEX.match(slug) is None:
+        return None
+    return slug
+
+
+class SubdomainRoutingMiddleware(BaseHTTPMiddleware):
+    """
+    Resolves application from subdomain of base domain and stores its ID in
+    request.state.application_id. Requests to unknown subdomains, to base domain itself
+    or without Host header are served without application.
+    """
+
+    def __init__(self, app, base_domain: str) -> None:
+        super().__init__(app)
+        self.base_domain = base_domain
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        request.state.application_id = None
+        slug = subdomain_slug(request.headers.get("host"), self.base_domain)
+        if slug is not None:
+            try:
+                # Lookup could query the database, it is kept off the event loop
+                request.state.application_id = await run_in_threadpool(
+                    get_application_id_by_slug, slug
+                )
+            except Exception as err:
+                logger.error(
+                    f"Unable to resolve application by subdomain: {str(err)}",
+                    extra={"error": err},
+                )
+        return await call_next(request)
+
+
+class ApplicationHeadersMiddleware(BaseHTTPMiddleware):
+    """
+    Sets custom headers of application, identified by application ID header or by
+    subdomain, on responses.
+    """
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        response = await call_next(request)
+
+        application_id_header = request.headers.get(APPLICATION_ID_HEADER)
+        if application_id_header is None:
+            application_id = getattr(request.state, "application_id", None)
+            if application_id is None:
+                return response
+        else:
+            try:
+                application_id = UUID(application_id_header)
+            except ValueError:
+                return response
+
+        try:
+            headers = await run_in_threadpool(get_application_headers, application_id)
+        except Exception as err:
+            logger.error(
+                f"Unable to get application headers: {str(err)}", extra={"error": err}
+            )
+            return response
+        for name, value in headers.items():
+            # Headers stored before they were reserved are not applied
+            if not actions.is_reserved_header(name):
+                response.headers[name] = value
+
+        return response
+
+
+def accept_quality(accept: str, media_types: Set[str]) -> float:
+    """
+    Returns highest quality value Accept header assigns to any of provided media types.
+    """
+    quality = 0.0
+    for accept_range in accept.split(","):
+        media_type, *params = [part.strip() for part in accept_range.split(";")]
+        if media_type.lower() not in media_types:
+            continue
+        range_quality = 1.0
+        for param in params:
+            name, _, value = param.partition("=")
+            if name.strip() == "q":
+                try:
+                    range_quality = float(value)
+                except ValueError:
+                    range_quality = 0.0
+        quality = max(quality, range_quality)
+    return quality
+
+
+class MessagePackMiddleware(BaseHTTPMiddleware):
+    """
+    Encodes JSON responses with MessagePack if client prefers it in Accept header, JSON
+    stays the default.
+
+    Streamed responses without Content-Length are passed as is, they could be too large
+    to buffer and are not a single JSON document anyway.
+    """
+
+    msgpack_media_types = {MSGPACK_MEDIA_TYPE, "application/x-msgpack"}
+    json_media_types = {"application/json", "application/*", "*/*"}
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        accept = request.headers.get("Accept", "")
+        msgpack_quality = accept_quality(accept, self.msgpack_media_types)
+        if msgpack_quality == 0 or msgpack_quality < accept_quality(
+            accept, self.json_media_types
+        ):
+            return await call_next(request)
+
+        response = await call_next(request)
+        if not response.headers.get("Content-Type", "").startswith("application/json"):
+            return response
+        if "content-length" not in response.headers:
+            return response
+
+        response_body = b""
+        async for chunk in response.body_iterator:  # type: ignore
+            response_body += chunk
+        headers = {
+            name: value
+            for name, value in response.headers.items()
+            if name not in {"content-length", "content-type"}
+        }
+        headers["Vary"] = "Accept"
+        try:
+            # Imported lazily, msgpack package is required only by deployments using it
+            import msgpack  # type: ignore
+
+            content = msgpack.packb(json.loads(response_body))
+            media_type = MSGPACK_MEDIA_TYPE
+        except Exception as err:
+            logger.error(
+                f"Unable to encode response with MessagePack: {str(err)}",
+                extra={"error": err},
+            )
+            content = response_body
+            media_type = JSON_MEDIA_TYPE
+        return Response(
+            content=content,
+            status_code=response.status_code,
+            headers=headers,
+            media_type=media_type,
+        )
+
+
+class SecurityHeadersMiddleware(BaseHTTPMiddleware):
+    """
+    Sets security headers on every response. Headers already set, for example custom
+    Content-Security-Policy of application, are not overridden.
+    """
+
+    def __init__(self, app, headers: Dict[str, str]) -> None:
+        super().__init__(app)
+        self.headers = headers
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        response = await call_next(request)
+        for name, value in self.headers.items():
+            # API documentation page loads scripts and styles
+            if name == "Content-Security-Policy" and request.url.path.endswith(
+                f"/{DOCS_TARGET_PATH}"
+            ):
+                continue
+            response.headers.setdefault(name, value)
+        return response
+
+
+class DynamicCORSMiddleware(CORSMiddleware):
+    """
+    CORS middleware with list of allowed origins which could be changed at runtime.
+    """
+
+    def __init__(self, app, get_origins: Callable[[], List[str]], **kwargs) -> None:
+        # Origins are always checked with is_allowed_origin. Wildcard is not passed to
+        # parent, otherwise it responds with Access-Control-Allow-Origin: * regardless
+        super().__init__(app, allow_origins=[], **kwargs)
+        self.get_origins = get_origins
+
+    def is_allowed_origin(self, origin: str) -> bool:
+        origins = self.get_origins()
+        return "*" in origins or origin in origins
+
+
+class RateLimitMiddleware(BaseHTTPMiddleware):
+    """
+    Limits requests per access token, or per client IP for requests without token. Every
+    response carries X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers.
+
+    Token is used as the key only after it was accepted by get_current_token. Requests
+    with unknown bearer tokens are limited per client IP, so random tokens do not bypass
+    the limit.
+    """
+
+    # Health checks, high-frequency machine-to-machine token validation and token
+    # pre-flight checks are not limited
+    exempt_paths = {"/ping", "/health", "/version", "/token/validate", "/token/verify"}
+
+    def __init__(self, app, get_limit: Callable[[], int]) -> None:
+        super().__init__(app)
+        self.get_limit = get_limit
+        self.limiter: Optional[TokenBucketLimiter] = None
+        # Tokens seen valid by this worker, oldest are evicted over max_validated_tokens
+        self.validated_tokens: "OrderedDict[str, None]" = OrderedDict()
+        self.max_validated_tokens = 10000
+
+    def mark_validated(self, raw_token: str) -> None:
+        self.validated_tokens[raw_token] = None
+        self.validated_tokens.move_to_end(raw_token)
+        while len(self.validated_tokens) > self.max_validated_tokens:
+            self.validated_tokens.popitem(last=False)
+
+    def current_limiter(self) -> Optional[TokenBucketLimiter]:
+        """
+        Returns limiter for current limit, buckets are reset when the limit changes.
+        """
+        limit = self.get_limit()
+        if limit <= 0:
+            return None
+        if self.limiter is None or self.limiter.capacity != limit:
+            self.limiter = TokenBucketLimiter(capacity=limit, refill_rate=limit / 60)
+        return self.limiter
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        limiter = self.current_limiter()
+        if limiter is None or request.url.path in self.exempt_paths:
+            return await call_next(request)
+
+        authorization = request.headers.get("Authorization", "")
+        scheme, _, raw_token = authorization.partition(" ")
+        has_token = scheme.lower() == "bearer" and raw_token != ""
+        if has_token and raw_token in self.validated_tokens:
+            key = f"token:{raw_token}"
+        else:
+            key = f"ip:{client_ip(request)}"
+
+        allowed, tokens = limiter.consume(key)
+        headers = {
+            "X-RateLimit-Limit": str(limiter.capacity),
+            "X-RateLimit-Remaining": str(int(tokens)),
+            "X-RateLimit-Reset": str(limiter.reset_at(tokens)),
+        }
+        if not allowed:
+            headers["Retry-After"] = str(limiter.retry_after())
+            return UTF8JSONResponse(
+                status_code=429,
+                content={"detail": "Too many requests, try again later"},
+                headers=headers,
+            )
+
+        response = await call_next(request)
+        if has_token and getattr(request.state, "token_id", None) == raw_token:
+            self.mark_validated(raw_token)
+        response.headers.update(headers)
+        return response
+
+
+class ResponseHashMiddleware(BaseHTTPMiddleware):
+    """
+    Adds X-Content-SHA256 header with base64-encoded SHA-256 digest of response body, so
+    clients could detect responses modified in transit.
+
+    Only responses with known Content-Length up to max_bytes are buffered and hashed,
+    streamed responses are passed as is.
+    """
+
+    def __init__(self, app, max_bytes: int) -> None:
+        super().__init__(app)
+        self.max_bytes = max_bytes
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        response = await call_next(request)
+        if request.method == "HEAD":
+            return response
+        content_length = response.headers.get("content-length")
+        if content_length is None or int(content_length) > self.max_bytes:
+            return response
+
+        body = b""
+        async for chunk in response.body_iterator:  # type: ignore
+            body += chunk
+        headers = dict(response.headers)
+        headers["content-length"] = str(len(body))
+        headers[CONTENT_HASH_HEADER] = base64.b64encode(
+            hashlib.sha256(body).digest()
+        ).decode()
+        return Response(
+            content=body,
+            status_code=response.status_code,
+            headers=headers,
+            media_type=response.media_type,
+        )
+
+
+class FaultRule(BaseModel):
+    """
+    Requests with path starting with path_prefix are delayed by latency_ms, error_rate
+    share of them is answered with status instead of being processed.
+    """
+
+    path_prefix: str
+    error_rate: float = Field(0.0, ge=0.0, le=1.0)
+    status: int = 500
+    latency_ms: int = Field(0, ge=0)
+
+
+def load_fault_rules(path: str) -> List[FaultRule]:
+    return parse_file_as(List[FaultRule], path)
+
+
+class FaultInjectionMiddleware(BaseHTTPMiddleware):
+    """
+    Injects latency and errors into matching requests for resilience testing. First rule
+    matching request path is applied.
+    """
+
+    def __init__(self, app, rules: List[FaultRule], seed: Optional[int] = None) -> None:
+        super().__init__(app)
+        self.rules = rules
+        # Own generator, so injected faults are reproducible with the same seed
+        self.random = random.Random(seed)
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        rule = next(
+            (
+                rule
+                for rule in self.rules
+                if request.url.path.startswith(rule.path_prefix)
+            ),
+            None,
+        )
+        if rule is None:
+            return await call_next(request)
+
+        if rule.latency_ms > 0:
+            await asyncio.sleep(rule.latency_ms / 1000)
+        if self.random.random() < rule.error_rate:
+            return UTF8JSONResponse(
+                status_code=rule.status, content={"detail": "Injected fault"}
+            )
+        return await call_next(request)
+
+
+def is_event_stream_start(message: Message) -> bool:
+    """
+    Checks if message starts response with server-sent events, such streams stay open
+    until client disconnects.
+    """
+    if message["type"] != "http.response.start":
+        return False
+    for name, value in message.get("headers", []):
+        if name.lower() == b"content-type":
+            return value.startswith(b"text/event-stream")
+    return False
+
+
+class ConcurrencyLimitMiddleware:
+    """
+    Bounds number of requests in flight in this worker. Requests above the limit are
+    rejected with 503 right away, so bursts do not pile up waiting for database pool.
+
+    Slot is held until response body is sent, so streamed responses are counted for
+    their whole duration. Server-sent event streams release the slot once started,
+    otherwise open streams would exhaust the limit.
+    """
+
+    retry_after_seconds = 1
+
+    def __init__(self, app: ASGIApp, limit: int) -> None:
+        self.app = app
+        self.limit = limit
+        # Requests are dispatched in a single event loop, plain counter is enough
+        self.in_flight = 0
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        if self.in_flight >= self.limit:
+            response = UTF8JSONResponse(
+                status_code=503,
+                content={"detail": "Server is busy, try again later"},
+                headers={"Retry-After": str(self.retry_after_seconds)},
+            )
+            await response(scope, receive, send)
+            return
+
+        self.in_flight += 1
+        released = False
+
+        async def send_wrapper(message: Message) -> None:
+            nonlocal released
+            if not released and is_event_stream_start(message):
+                released = True
+                self.in_flight -= 1
+            await send(message)
+
+        try:
+            await self.app(scope, receive, send_wrapper)
+        finally:
+            if not released:
+                self.in_flight -= 1
+
+
+class InFlightMiddleware:
+    """
+    Counts requests in flight in this worker, the count is reported by health check
+    while worker drains on shutdown. Server-sent event streams are not counted once
+    started, they are ended when draining starts.
+    """
+
+    def __init__(self, app: ASGIApp) -> None:
+        self.app = app
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        drain_state.in_flight += 1
+        released = False
+
+        async def send_wrapper(message: Message) -> None:
+            nonlocal released
+            if not released and is_event_stream_start(message):
+                released = True
+                drain_state.in_flight -= 1
+            await send(message)
+
+        try:
+            await self.app(scope, receive, send_wrapper)
+        finally:
+            if not released:
+                drain_state.in_flight -= 1
+
+
+def redact_body(body: bytes, max_bytes: int) -> str:
+    """
+    Replaces values of sensitive JSON fields and form parameters with "***". Body is
+    redacted before truncation, so cut values are not leaked either.
+    """
+    text = body.decode("utf-8", errors="replace")
+    text = SENSITIVE_JSON_VALUE_REGEX.sub(r'\1"***"', text)
+    text = SENSITIVE_FORM_VALUE_REGEX.sub(r"\1***", text)
+    if len(text) > max_bytes:
+        text = text[:max_bytes] + "...(truncated)"
+    return text
+
+
+class DebugLoggingMiddleware:
+    """
+    Logs request and response bodies at DEBUG level with sensitive values redacted.
+    Requests to exclude_paths are not logged. Response bodies of token endpoints are not
+    logged at all, as token ID is the bearer token.
+
+    Implemented as plain ASGI middleware, request body is read here and replayed to the
+    application, so handlers could read it again.
+    """
+
+    def __init__(
+        self,
+        app: ASGIApp,
+        max_body_bytes: int,
+        exclude_paths: Optional[Set[str]] = None,
+    ) -> None:
+        self.app = app
+        self.max_body_bytes = max_body_bytes
+        self.exclude_paths = exclude_paths or set()
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http" or scope["path"] in self.exclude_paths:
+            await self.app(scope, receive, send)
+            return
+
+        request_body = b""
+        more_body = True
+        while more_body:
+            message = await receive()
+            if message["type"] != "http.request":
+                break
+            request_body += message.get("body", b"")
+            more_body = message.get("more_body", False)
+
+        body_sent = False
+
+        async def replay_receive() -> Message:
+            nonlocal body_sent
+            if body_sent:
+                return await receive()
+            body_sent = True
+            return {"type": "http.request", "body": request_body, "more_body": False}
+
+        state = scope.get("state", {})
+        body_logger.debug(
+            f"Request {scope['method']} {scope['path']}, request ID: "
+            f"{state.get('request_id')}, body: "
+            f"{redact_body(request_body, self.max_body_bytes)}",
+            extra={"request_id": state.get("request_id")},
+        )
+
+        status_code = None
+        response_body = b""
+
+        async def logging_send(message: Message) -> None:
+            nonlocal status_code, response_body
+            if message["type"] == "http.response.start":
+                status_code = message["status"]
+            elif message["type"] == "http.response.body":
+                # Only beginning of the body is kept, the rest is truncated anyway
+                if len(response_body) <= self.max_body_bytes:
+                    response_body += message.get("body", b"")
+                if not message.get("more_body", False):
+                    if issues_credentials(scope["path"]):
+                        logged_body = "[not logged, response carries tokens]"
+                    else:
+                        logged_body = redact_body(response_body, self.max_body_bytes)
+                    body_logger.debug(
+                        f"Response {status_code} to {scope['method']} {scope['path']}, "
+                        f"request ID: {state.get('request_id')}, body: {logged_body}",
+                        extra={"request_id": state.get("request_id")},
+                    )
+            await send(message)
+
+        await self.app(scope, replay_receive, logging_send)
+
+
+class SlowRequestLoggingMiddleware:
+    """
+    Logs requests which took longer than threshold_ms tagged as slow_request and
+    requests failed with server errors, other requests are not logged. Requests to
+    exclude_paths are not logged at all.
+    """
+
+    def __init__(
+        self,
+        app: ASGIApp,
+        threshold_ms: int,
+        exclude_paths: Optional[Set[str]] = None,
+    ) -> None:
+        self.app = app
+        self.threshold_ms = threshold_ms
+        self.exclude_paths = exclude_paths or set()
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http" or scope["path"] in self.exclude_paths:
+            await self.app(scope, receive, send)
+            return
+
+        started_at = time.monotonic()
+        status_code: Optional[int] = None
+
+        async def status_send(message: Message) -> None:
+            nonlocal status_code
+            if message["type"] == "http.response.start":
+                status_code = message["status"]
+            await send(message)
+
+        try:
+            await self.app(scope, receive, status_send)
+        finally:
+            duration_ms = int((time.monotonic() - started_at) * 1000)
+            request_id = scope.get("state", {}).get("request_id")
+            if status_code is None or status_code >= 500:
+                logger.error(
+                    f"failed_request: {scope['method']} {scope['path']} responded "
+                    f"{status_code} in {duration_ms} ms, request ID: {request_id}",
+                    extra={"request_id": request_id},
+                )
+            elif duration_ms >= self.threshold_ms:
+                logger.warning(
+                    f"slow_request: {scope['method']} {scope['path']} responded "
+                    f"{status_code} in {duration_ms} ms, request ID: {request_id}",
+                    extra={"request_id": request_id},
+                )
+
+
+class AccessLogPathFilter(logging.Filter):
+    """
+    Drops uvicorn access log records of requests to excluded paths.
+    """
+
+    def __init__(self, exclude_paths: Set[str]) -> None:
+        super().__init__()
+        self.exclude_paths = exclude_paths
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        # Access log arguments are client address, method, path with query string,
+        # HTTP version and status code
+        if not isinstance(record.args, tuple) or len(record.args) < 3:
+            return True
+        path = str(record.args[2]).partition("?")[0]
+        return path not in self.exclude_paths
+
+
+METHOD_OVERRIDE_HEADER = "x-http-method-override"
+
+
+class MethodOverrideMiddleware:
+    """
+    Rewrites method of POST requests to the one from X-HTTP-Method-Override header, for
+    clients behind proxies which block DELETE, PATCH and PUT. Overrides on requests with
+    other methods and to other methods are rejected with 400.
+
+    Implemented as plain ASGI middleware, so routing and inner middlewares see effective
+    method.
+    """
+
+    allowed_methods = {"DELETE", "PATCH", "PUT"}
+
+    def __init__(self, app: ASGIApp) -> None:
+        self.app = app
+
+    async def __call__(self, scope: Scope, receive: Receive, send: Send) -> None:
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        override = Headers(scope=scope).get(METHOD_OVERRIDE_HEADER)
+        if override is None:
+            await self.app(scope, receive, send)
+            return
+
+        override = override.strip().upper()
+        if scope["method"] != "POST":
+            response = UTF8JSONResponse(
+                status_code=400,
+                content={"detail": "Method override is allowed only on POST requests"},
+            )
+            await response(scope, receive, send)
+            return
+        if override not in self.allowed_methods:
+            response = UTF8JSONResponse(
+                status_code=400,
+                content={
+                    "detail": "Method could be overridden only with DELETE, PATCH or PUT"
+                },
+            )
+            await response(scope, receive, send)
+            return
+
+        scope = dict(scope, method=override)
+        await self.app(scope, receive, send)
+
+
+class IdempotencyMiddleware(BaseHTTPMiddleware):
+    """
+    Replays recorded response for POST requests retried with the same Idempotency-Key header,
+    so network retries do not create duplicate resources.
+
+    Keys are scoped to the caller credential. Anonymous requests and endpoints which
+    issue credentials are not handled, so responses with tokens are never stored. Key
+    is reserved before the request is processed, concurrent retry is rejected with 409
+    until the first request completes.
+    """
+
+    async def dispatch(
+        self, request: Request, call_next: RequestResponseEndpoint
+    ) -> Response:
+        key = request.headers.get(IDEMPOTENCY_KEY_HEADER)
+        if request.method != "POST" or key is None:
+            return await call_next(request)
+
+        if IDEMPOTENCY_KEY_REGEX.match(key) is None:
+            return UTF8JSONResponse(
+                status_code=400,
+                content={
+                    "detail": f"{IDEMPOTENCY_KEY_HEADER} must be UUID or slug up to 64 characters"
+                },
+            )
+
+        endpoint = request.url.path
+        scope = idempotency_scope(request)
+        if scope is None or issues_credentials(endpoint):
+            return await call_next(request)
+
+        db_session = SessionLocal()
+        try:
+            reservation = actions.reserve_idempotency_key(
+                db_session, key, scope, endpoint
+            )
+            if reservation is None:
+                return self._replay(db_session, key, scope, endpoint)
+
+            try:
+                response = await call_next(request)
+            except Exception:
+                actions.release_idempotency_key(db_session, reservation)
+                raise
+            # Server errors and rate limited requests are not recorded, so client could
+            # retry them
+            if response.status_code >= 500 or response.status_code == 429:
+                actions.release_idempotency_key(db_session, reservation)
+                return response
+
+            response_body = b""
+            async for chunk in response.body_iterator:  # type: ignore
+                response_body += chunk
+            response_headers = [
+                [name.decode("latin-1"), value.decode("latin-1")]
+                for name, value in response.raw_headers
+            ]
+            try:
+                actions.complete_idempotency_key(
+                    db_session,
+                    reservation,
+                    response_status=response.status_code,
+                    response_body=response_body,
+                    response_headers=response_headers,
+                )
+            except Exception as err:
+                logger.error(
+                    f"Unable to record idempotency key: {str(err)}",
+                    extra={"error": err},
+                )
+
+            return recorded_response(
+                response.status_code, response_body, response_headers
+            )
+        finally:
+            db_session.close()
+
+    @staticmethod
+    def _replay(db_session, key: str, scope: str, endpoint: str) -> Response:
+        idempotency_key = actions.get_idempotency_key(db_session, key, scope)
+        if idempotency_key is None or idempotency_key.response_status is None:
+            return UTF8JSONResponse(
+                status_code=409,
+                content={
+                    "detail": f"Request with this {IDEMPOTENCY_KEY_HEADER} is in progress"
+                },
+                headers={"Retry-After": "1"},
+            )
+        if idempotency_key.endpoint != endpoint:
+            return UTF8JSONResponse(
+                status_code=422,
+                content={
+                    "detail": f"{IDEMPOTENCY_KEY_HEADER} was already used for another endpoint"
+                },
+            )
+        return recorded_response(
+            idempotency_key.response_status,
+            idempotency_key.response_body,
+            idempotency_key.response_headers or [],
+        )
+
+
+# Responses of these endpoints carry tokens, token ID is the token itself. They must
+# never be recorded or logged
+CREDENTIAL_PATH_PREFIXES = ("/token", "/auth/", "/admin/impersonate/")
+
+
+def issues_credentials(path: str) -> bool:
+    return path.startswith(CREDENTIAL_PATH_PREFIXES) or path.endswith("/token")
+
+
+def idempotency_scope(request: Request) -> Optional[str]:
+    """
+    Returns SHA-256 of the bearer token of the request, None for anonymous requests.
+    """
+    authorization = request.headers.get("Authorization", "")
+    scheme, _, raw_token = authorization.partition(" ")
+    if scheme.lower() != "bearer" or raw_token == "":
+        return None
+    return hashlib.sha256(raw_token.encode("utf-8")).hexdigest()
+
+
+def recorded_response(
+    status_code: int, body: bytes, headers: List[List[str]]
+) -> Response:
+    """
+    Builds response with headers as recorded, repeated headers like Set-Cookie are kept.
+    """
+    response = Response(content=body, status_code=status_code)
+    response.raw_headers = [
+        (name.encode("latin-1"), value.encode("latin-1")) for name, value in headers
+    ]
+    return response
+
+
+def is_unmatched_route(scope: Scope) -> bool:
+    """
+    Router sets endpoint in scope of matched routes. Mount sets mounted application as
+    endpoint, which is replaced only if one of its routes matches, so 404 with router
+    as endpoint is raised for unmatched path under the mount.
+    """
+    endpoint = scope.get("endpoint")
+    return endpoint is None or isinstance(endpoint, (Starlette, Router))
+
+
+async def http_exception_handler(
+    request: Request, exc: StarletteHTTPException
+) -> Response:
+    """
+    Responds to unknown routes with JSON error and the requested path, internal errors
+    with request ID only. Other HTTP exceptions are rendered as FastAPI does by default.
+    """
+    if exc.status_code == 404 and is_unmatched_route(request.scope):
+        return UTF8JSONResponse(
+            status_code=404,
+            content={"error": "not found", "path": request.url.path},
+        )
+    if exc.status_code == 500:
+        request_id = getattr(request.state, "request_id", None)
+        logger.error(
+            f"Internal server error on {request.method} {request.url.path}, "
+            f"request ID: {request_id}",
+            extra={"request_id": request_id},
+        )
+        return internal_error_response(request_id)
+    headers = getattr(exc, "headers", None)
+    code = getattr(exc, "code", None)
+    if code is None and isinstance(exc.detail, str):
+        code = DETAIL_CODES.get(exc.detail)
+    if code is not None:
+        locale = negotiate_locale(request.headers.get("Accept-Language"))
+        return UTF8JSONResponse(
+            status_code=exc.status_code,
+            content={"code": code, "detail": localized_message(code, locale)},
+            headers={**(headers or {}), "Content-Language": locale},
+        )
+    if headers:
+        return UTF8JSONResponse(
+            status_code=exc.status_code,
+            content={"detail": exc.detail},
+            headers=headers,
+        )
+    return UTF8JSONResponse(status_code=exc.status_code, content={"detail": exc.detail})
+
+
+async def validation_exception_handler(
+    request: Request, exc: RequestValidationError
+) -> Response:
+    """
+    Field errors are kept in detail as FastAPI renders them, localized summary of the
+    error is returned in message.
+
+    Unknown fields rejected in strict JSON mode are client bugs rather than invalid
+    values, they are reported with status 400 and names of the fields. Malformed path
+    parameters (e.g. user ID which is not UUID) are reported with status 400 as well.
+    """
+    locale = negotiate_locale(request.headers.get("Accept-Language"))
+    path_parameters = [
+        str(error["loc"][-1]) for error in exc.errors() if error["loc"][0] == "path"
+    ]
+    if path_parameters:
+        return UTF8JSONResponse(
+            status_code=400,
+            content={
+                "code": "invalid_path_parameter",
+                "message": localized_message("invalid_path_parameter", locale),
+                "fields": path_parameters,
+                "detail": jsonable_encoder(exc.errors()),
+            },
+            headers={"Content-Language": locale},
+        )
+    unknown_fields = [
+        str(error["loc"][-1])
+        for error in exc.errors()
+        if error["type"] == "value_error.extra"
+    ]
+    if unknown_fields:
+        return UTF8JSONResponse(
+            status_code=400,
+            content={
+                "code": "unknown_field",
+                "message": localized_message("unknown_field", locale),
+                "fields": unknown_fields,
+                "detail": jsonable_encoder(exc.errors()),
+            },
+            headers={"Content-Language": locale},
+        )
+    return UTF8JSONResponse(
+        status_code=422,
+        content={
+            "code": "validation_error",
+            "message": localized_message("validation_error", locale),
+            "detail": jsonable_encoder(exc.errors()),
+        },
+        headers={"Content-Language": locale},
+    )
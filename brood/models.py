@@ -11,14 +11,17 @@ from sqlalchemy import (
     Column,
     DateTime,
     ForeignKey,
+    Index,
     Integer,
+    LargeBinary,
     String,
+    Text,
     Enum as PgEnum,
     PrimaryKeyConstraint,
     MetaData,
 )
 from sqlalchemy.orm import relationship
-from sqlalchemy.dialects.postgresql import UUID
+from sqlalchemy.dialects.postgresql import JSONB, UUID
 from sqlalchemy.sql import expression
 from sqlalchemy.ext.compiler import compiles
 from sqlalchemy.sql.schema import UniqueConstraint
@@ -97,9 +100,16 @@ class User(Base):  # type: ignore
     email = Column(String, nullable=False)
     normalized_email = Column(String, nullable=False, index=True)
     password_hash = Column(String, nullable=False)
+    # Password was passed through HMAC with BROOD_PASSWORD_PEPPER before hashing
+    password_peppered = Column(Boolean, default=False, nullable=False)
     auth_type = Column(String(50), nullable=False)
     verified = Column(Boolean, default=False, nullable=False, index=True)
     autogenerated = Column(Boolean, default=False, nullable=False)
+    is_admin = Column(Boolean, default=False, nullable=False)
+    # Super-admins manage admin flags of other users
+    is_super_admin = Column(Boolean, default=False, nullable=False)
+    # Arbitrary metadata like display name or avatar URL
+    profile = Column(JSONB, nullable=True)
 
     application_id = Column(
         UUID(as_uuid=True),
@@ -120,7 +130,10 @@ class User(Base):  # type: ignore
     )
 
     tokens = relationship(
-        "Token", back_populates="user", cascade="all, delete, delete-orphan"
+        "Token",
+        back_populates="user",
+        cascade="all, delete, delete-orphan",
+        foreign_keys="Token.user_id",
     )
     groups = relationship(
         "GroupUser", back_populates="user", cascade="all, delete, delete-orphan"
@@ -132,6 +145,16 @@ class User(Base):  # type: ignore
 
 class Token(Base):  # type: ignore
     __tablename__ = "tokens"
+    # Names of revoked tokens could be reused
+    __table_args__ = (
+        Index(
+            "uq_tokens_user_id_name_active",
+            "user_id",
+            "name",
+            unique=True,
+            postgresql_where=expression.column("active"),
+        ),
+    )
 
     id = Column(
         UUID(as_uuid=True),
@@ -154,6 +177,60 @@ class Token(Base):  # type: ignore
     # a user
     restricted = Column(Boolean, default=False, nullable=False, index=True)
 
+    # Tokens without expiration time never expire
+    expires_at = Column(DateTime(timezone=True), nullable=True)
+    # Region where token was issued
+    region = Column(String, nullable=True)
+    # Token bound to application is rejected in requests on behalf of other applications
+    bound_application_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "applications.id",
+            name="fk_tokens_bound_application_id",
+            ondelete="CASCADE",
+        ),
+        nullable=True,
+    )
+    # Tokens of service accounts have no user, so they survive deletion of user accounts
+    service_account_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "service_accounts.id",
+            name="fk_tokens_service_account_id",
+            ondelete="CASCADE",
+        ),
+        nullable=True,
+        index=True,
+    )
+    # Group tokens have no user either, they are used by jobs of the group and survive
+    # removal of its members
+    group_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey("groups.id", name="fk_tokens_group_id", ondelete="CASCADE"),
+        nullable=True,
+        index=True,
+    )
+    # Super-admin who issued the token to act as the user. Such tokens are short-lived
+    # and could not be used for destructive operations
+    impersonated_by = Column(
+        UUID(as_uuid=True),
+        ForeignKey("users.id", name="fk_tokens_impersonated_by", ondelete="CASCADE"),
+        nullable=True,
+    )
+    # Human-readable name of the token, unique among active tokens of the user
+    name = Column(String(64), nullable=True)
+    # Explicit scopes of tokens derived by exchange, scopes of other tokens are defined
+    # by restricted flag
+    scopes = Column(JSONB, nullable=True)
+    # Token this token was exchanged from
+    derived_from_token_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "tokens.id", name="fk_tokens_derived_from_token_id", ondelete="CASCADE"
+        ),
+        nullable=True,
+    )
+
     created_at = Column(
         DateTime(timezone=True), server_default=utcnow(), nullable=False
     )
@@ -164,7 +241,8 @@ class Token(Base):  # type: ignore
         nullable=False,
     )
 
-    user = relationship("User", back_populates="tokens")
+    user = relationship("User", back_populates="tokens", foreign_keys=[user_id])
+    service_account = relationship("ServiceAccount")
 
 
 class VerificationEmail(Base):  # type: ignore
@@ -278,6 +356,11 @@ class GroupUser(Base):  # type: ignore
     )
     user_type = Column(PgEnum(Role, name="user_type"), nullable=False)
 
+    # Time user joined the group
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+
     group = relationship("Group", back_populates="user_ids")
     user = relationship("User", back_populates="groups")
 
@@ -441,3 +524,307 @@ class Application(Base):  # type: ignore
 
     name = Column(String, nullable=False)
     description = Column(String, nullable=True)
+    # Headers set on every response to requests made on behalf of application
+    response_headers = Column(JSONB, nullable=True)
+
+
+class ApplicationSlug(Base):  # type: ignore
+    """
+    Subdomain label routing requests to application, e.g. "app" in app.example.com.
+    """
+
+    __tablename__ = "application_slugs"
+
+    slug = Column(String, primary_key=True, unique=True, nullable=False)
+    application_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "applications.id",
+            name="fk_application_slugs_application_id",
+            ondelete="CASCADE",
+        ),
+        nullable=False,
+        index=True,
+    )
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+
+
+class ApplicationTransferRequest(Base):  # type: ignore
+    """
+    Pending transfer of application to new owner, applied when new owner accepts it with
+    the token. Applications are owned by groups, so new owner is a group.
+    """
+
+    __tablename__ = "application_transfer_requests"
+    # Only one transfer of application could be pending, expired pending transfers are
+    # deleted when new one is created
+    __table_args__ = (
+        Index(
+            "uq_application_transfer_requests_application_id_pending",
+            "application_id",
+            unique=True,
+            postgresql_where=expression.column("accepted_at").is_(None),
+        ),
+    )
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    application_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "applications.id",
+            name="fk_application_transfer_requests_application_id",
+            ondelete="CASCADE",
+        ),
+        nullable=False,
+        index=True,
+    )
+    requester_user_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "users.id",
+            name="fk_application_transfer_requests_requester_user_id",
+            ondelete="CASCADE",
+        ),
+        nullable=False,
+    )
+    new_owner_type = Column(String, nullable=False)
+    new_owner_id = Column(UUID(as_uuid=True), nullable=False)
+    token = Column(
+        UUID(as_uuid=True), default=uuid.uuid4, unique=True, nullable=False, index=True
+    )
+    expires_at = Column(DateTime(timezone=True), nullable=False)
+    accepted_at = Column(DateTime(timezone=True), nullable=True)
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+
+
+class ServiceAccount(Base):  # type: ignore
+    """
+    Non-human identity of application for machine-to-machine tokens (CI/CD pipelines).
+    """
+
+    __tablename__ = "service_accounts"
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    name = Column(String, nullable=False)
+    application_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "applications.id",
+            name="fk_service_accounts_application_id",
+            ondelete="CASCADE",
+        ),
+        nullable=False,
+        index=True,
+    )
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+
+
+class IdempotencyKey(Base):  # type: ignore
+    """
+    Responses recorded for POST requests with Idempotency-Key header, replayed on retries.
+    Record without response status is a reservation of request in flight.
+    """
+
+    __tablename__ = "idempotency_keys"
+    __table_args__ = (UniqueConstraint("key", "scope"),)
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    key = Column(String(64), nullable=False, index=True)
+    # SHA-256 of the caller credential, so keys of different callers never collide
+    scope = Column(String(64), nullable=False)
+    endpoint = Column(String(128), nullable=False)
+    response_status = Column(Integer, nullable=True)
+    response_body = Column(LargeBinary, nullable=True)
+    # List of [name, value] pairs, header could be repeated, e.g. Set-Cookie
+    response_headers = Column(JSONB, nullable=True)
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+    expires_at = Column(DateTime(timezone=True), nullable=False, index=True)
+
+
+class AuditEvent(Base):  # type: ignore
+    """
+    Audit log of privileged operations.
+    """
+
+    __tablename__ = "audit_events"
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    event_type = Column(String(100), nullable=False, index=True)
+    # Events are kept after users are deleted
+    actor_user_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "users.id", name="fk_audit_events_actor_user_id", ondelete="SET NULL"
+        ),
+        nullable=True,
+        index=True,
+    )
+    target_user_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "users.id", name="fk_audit_events_target_user_id", ondelete="SET NULL"
+        ),
+        nullable=True,
+        index=True,
+    )
+    details = Column(JSONB, nullable=True)
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+
+
+class UserDeletionConfirmation(Base):  # type: ignore
+    """
+    Short-lived token user has to provide to delete own account.
+    """
+
+    __tablename__ = "user_deletion_confirmations"
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    user_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "users.id",
+            name="fk_user_deletion_confirmations_user_id",
+            ondelete="CASCADE",
+        ),
+        nullable=False,
+        index=True,
+    )
+    expires_at = Column(DateTime(timezone=True), nullable=False)
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+
+
+class LoginHistory(Base):  # type: ignore
+    """
+    Login attempts of users, successful and failed ones.
+    """
+
+    __tablename__ = "login_history"
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    user_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey("users.id", name="fk_login_history_user_id", ondelete="CASCADE"),
+        nullable=False,
+        index=True,
+    )
+    ip = Column(String(45), nullable=True)
+    user_agent = Column(Text, nullable=True)
+    success = Column(Boolean, nullable=False)
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False, index=True
+    )
+
+
+class PasswordHistory(Base):  # type: ignore
+    """
+    Previous password hashes of users, pruned to BROOD_PASSWORD_HISTORY_SIZE entries.
+    """
+
+    __tablename__ = "password_history"
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    user_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey("users.id", name="fk_password_history_user_id", ondelete="CASCADE"),
+        nullable=False,
+        index=True,
+    )
+    password_hash = Column(String, nullable=False)
+    password_peppered = Column(Boolean, default=False, nullable=False)
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
+
+
+class WebAuthnCredential(Base):  # type: ignore
+    """
+    Passkeys registered by users for passwordless login.
+    """
+
+    __tablename__ = "webauthn_credentials"
+
+    id = Column(
+        UUID(as_uuid=True),
+        primary_key=True,
+        default=uuid.uuid4,
+        unique=True,
+        nullable=False,
+    )
+    user_id = Column(
+        UUID(as_uuid=True),
+        ForeignKey(
+            "users.id", name="fk_webauthn_credentials_user_id", ondelete="CASCADE"
+        ),
+        nullable=False,
+        index=True,
+    )
+    credential_id = Column(LargeBinary, nullable=False, unique=True)
+    public_key = Column(LargeBinary, nullable=False)
+    sign_count = Column(Integer, nullable=False, default=0)
+    aaguid = Column(LargeBinary, nullable=True)
+
+    created_at = Column(
+        DateTime(timezone=True), server_default=utcnow(), nullable=False
+    )
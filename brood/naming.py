@@ -0,0 +1,37 @@
+"""
+Conversion of JSON keys between snake_case used by Brood and camelCase preferred by
+JavaScript clients.
+"""
+import re
+from typing import Any, Callable
+
+SNAKE_SEPARATOR_REGEX = re.compile(r"_([a-z])")
+CAMEL_HUMP_REGEX = re.compile(r"([A-Z])")
+
+# Values of these keys are arbitrary client data, keys inside them are never renamed
+FREE_FORM_KEYS = {"resource_data", "profile", "response_headers", "details", "update"}
+
+
+def camel_case(key: str) -> str:
+    return SNAKE_SEPARATOR_REGEX.sub(lambda match: match.group(1).upper(), key)
+
+
+def snake_case(key: str) -> str:
+    return CAMEL_HUMP_REGEX.sub(lambda match: f"_{match.group(1).lower()}", key)
+
+
+def rename_keys(value: Any, rename: Callable[[str], str]) -> Any:
+    """
+    Renames keys of dictionaries in JSON-compatible value recursively, except keys
+    nested in free-form fields.
+    """
+    if isinstance(value, dict):
+        return {
+            (rename(key) if isinstance(key, str) else key): (
+                item if key in FREE_FORM_KEYS else rename_keys(item, rename)
+            )
+            for key, item in value.items()
+        }
+    if isinstance(value, list):
+        return [rename_keys(item, rename) for item in value]
+    return value
@@ -0,0 +1,250 @@
+"""
+WebAuthn ceremonies for passwordless login with passkeys.
+
+Challenge of a ceremony is kept in cache under random session ID which is passed to the
+client in cookie, so begin and complete requests could be served by different workers.
+In-memory cache is not shared between workers, API with multiple workers requires Redis
+cache for passkeys.
+"""
+import hashlib
+import hmac
+import json
+import logging
+import secrets
+from typing import Any, Dict, List, NamedTuple, Optional, Tuple
+import uuid
+
+from pydantic import ValidationError
+from webauthn import (  # type: ignore
+    generate_authentication_options,
+    generate_registration_options,
+    options_to_json,
+    verify_authentication_response,
+    verify_registration_response,
+)
+from webauthn.helpers import base64url_to_bytes, bytes_to_base64url  # type: ignore
+from webauthn.helpers.exceptions import (  # type: ignore
+    InvalidAuthenticationResponse,
+    InvalidRegistrationResponse,
+)
+from webauthn.helpers.structs import (  # type: ignore
+    AuthenticationCredential,
+    AuthenticatorSelectionCriteria,
+    PublicKeyCredentialDescriptor,
+    RegistrationCredential,
+    ResidentKeyRequirement,
+)
+
+from . import exceptions
+from .cache import CacheMiss
+from .external import cache
+from .models import User, WebAuthnCredential
+from .settings import (
+    WEBAUTHN_DECOY_KEY,
+    WEBAUTHN_ORIGIN,
+    WEBAUTHN_RP_ID,
+    WEBAUTHN_RP_NAME,
+)
+
+logger = logging.getLogger(__name__)
+
+WEBAUTHN_SESSION_COOKIE = "brood_webauthn_session"
+WEBAUTHN_CHALLENGE_TTL_SECONDS = 300
+
+REGISTRATION_CEREMONY = "registration"
+AUTHENTICATION_CEREMONY = "authentication"
+
+DECOY_KEY = secrets.token_bytes(32)
+if WEBAUTHN_DECOY_KEY is not None:
+    DECOY_KEY = WEBAUTHN_DECOY_KEY.encode()
+
+
+class ChallengeState(NamedTuple):
+    challenge: bytes
+    # None for authentication challenge issued to unknown user
+    user_id: Optional[uuid.UUID]
+    application_id: Optional[uuid.UUID] = None
+
+
+class VerifiedCredential(NamedTuple):
+    credential_id: bytes
+    public_key: bytes
+    sign_count: int
+    aaguid: Optional[bytes] = None
+
+
+def challenge_cache_key(session_id: str) -> str:
+    return f"brood:webauthn_challenge:{session_id}"
+
+
+def store_challenge(
+    ceremony: str,
+    challenge: bytes,
+    user_id: Optional[uuid.UUID],
+    application_id: Optional[uuid.UUID] = None,
+) -> str:
+    """
+    Stores challenge of started ceremony, returns session ID to be set in cookie.
+    """
+    session_id = secrets.token_urlsafe(32)
+    state = {
+        "ceremony": ceremony,
+        "challenge": bytes_to_base64url(challenge),
+        "user_id": str(user_id) if user_id is not None else None,
+        "application_id": str(application_id) if application_id is not None else None,
+    }
+    cache.set(
+        challenge_cache_key(session_id),
+        json.dumps(state),
+        ttl=WEBAUTHN_CHALLENGE_TTL_SECONDS,
+    )
+    return session_id
+
+
+def pop_challenge(session_id: Optional[str], ceremony: str) -> ChallengeState:
+    """
+    Returns challenge of the ceremony and removes it from cache, so every challenge
+    could be answered only once.
+    """
+    if session_id is None or session_id == "":
+        raise exceptions.WebAuthnChallengeNotFound("WebAuthn session cookie is missing")
+    cache_key = challenge_cache_key(session_id)
+    try:
+        state = json.loads(cache.get(cache_key))
+    except CacheMiss:
+        raise exceptions.WebAuthnChallengeNotFound("WebAuthn challenge has expired")
+    cache.delete(cache_key)
+
+    if state["ceremony"] != ceremony:
+        raise exceptions.WebAuthnChallengeNotFound(
+            f"WebAuthn challenge was issued for {state['ceremony']}"
+        )
+    user_id = None
+    if state["user_id"] is not None:
+        user_id = uuid.UUID(state["user_id"])
+    application_id = None
+    if state["application_id"] is not None:
+        application_id = uuid.UUID(state["application_id"])
+    return ChallengeState(
+        challenge=base64url_to_bytes(state["challenge"]),
+        user_id=user_id,
+        application_id=application_id,
+    )
+
+
+def registration_options(
+    user: User, credentials: List[WebAuthnCredential]
+) -> Tuple[str, bytes]:
+    """
+    Returns PublicKeyCredentialCreationOptions as JSON and its challenge. Already
+    registered credentials are excluded, so authenticator is not registered twice.
+    """
+    options = generate_registration_options(
+        rp_id=WEBAUTHN_RP_ID,
+        rp_name=WEBAUTHN_RP_NAME,
+        user_id=str(user.id),
+        user_name=user.username,
+        exclude_credentials=[
+            PublicKeyCredentialDescriptor(id=credential.credential_id)
+            for credential in credentials
+        ],
+        authenticator_selection=AuthenticatorSelectionCriteria(
+            resident_key=ResidentKeyRequirement.PREFERRED
+        ),
+    )
+    return options_to_json(options), options.challenge
+
+
+def verify_registration(
+    credential: Dict[str, Any], challenge: bytes
+) -> VerifiedCredential:
+    """
+    Verifies attestation returned by authenticator for registration challenge.
+    """
+    try:
+        verification = verify_registration_response(
+            credential=RegistrationCredential.parse_obj(credential),
+            expected_challenge=challenge,
+            expected_rp_id=WEBAUTHN_RP_ID,
+            expected_origin=WEBAUTHN_ORIGIN,
+        )
+    except (InvalidRegistrationResponse, ValidationError, ValueError) as err:
+        raise exceptions.WebAuthnVerificationFailed(str(err))
+
+    aaguid: Optional[bytes] = None
+    if verification.aaguid:
+        aaguid = uuid.UUID(verification.aaguid).bytes
+    return VerifiedCredential(
+        credential_id=verification.credential_id,
+        public_key=verification.credential_public_key,
+        sign_count=verification.sign_count,
+        aaguid=aaguid,
+    )
+
+
+def authentication_options(credentials: List[WebAuthnCredential]) -> Tuple[str, bytes]:
+    """
+    Returns PublicKeyCredentialRequestOptions as JSON and its challenge, only the given
+    credentials are allowed to answer it.
+    """
+    options = generate_authentication_options(
+        rp_id=WEBAUTHN_RP_ID,
+        allow_credentials=[
+            PublicKeyCredentialDescriptor(id=credential.credential_id)
+            for credential in credentials
+        ],
+    )
+    return options_to_json(options), options.challenge
+
+
+def decoy_authentication_options(
+    login: str, application_id: Optional[uuid.UUID] = None
+) -> Tuple[str, bytes]:
+    """
+    Returns authentication options for unknown user or user without passkeys. They allow
+    one decoy credential, its ID is derived from the login, so repeated requests look
+    like requests for a user with a passkey.
+    """
+    decoy_id = hmac.new(
+        DECOY_KEY, f"{application_id}:{login}".encode(), hashlib.sha256
+    ).digest()
+    options = generate_authentication_options(
+        rp_id=WEBAUTHN_RP_ID,
+        allow_credentials=[PublicKeyCredentialDescriptor(id=decoy_id)],
+    )
+    return options_to_json(options), options.challenge
+
+
+def assertion_credential_id(credential: Dict[str, Any]) -> bytes:
+    """
+    Returns raw ID of credential used to sign assertion.
+    """
+    try:
+        return base64url_to_bytes(credential["rawId"])
+    except (KeyError, TypeError, ValueError):
+        raise exceptions.WebAuthnVerificationFailed("Credential rawId is invalid")
+
+
+def verify_authentication(
+    credential: Dict[str, Any],
+    challenge: bytes,
+    stored_credential: WebAuthnCredential,
+) -> int:
+    """
+    Verifies assertion signed by authenticator for authentication challenge. Returns new
+    sign count of the credential, counter which did not increase is reported as failure
+    as it indicates cloned authenticator.
+    """
+    try:
+        verification = verify_authentication_response(
+            credential=AuthenticationCredential.parse_obj(credential),
+            expected_challenge=challenge,
+            expected_rp_id=WEBAUTHN_RP_ID,
+            expected_origin=WEBAUTHN_ORIGIN,
+            credential_public_key=stored_credential.public_key,
+            credential_current_sign_count=stored_credential.sign_count,
+        )
+    except (InvalidAuthenticationResponse, ValidationError, ValueError) as err:
+        raise exceptions.WebAuthnVerificationFailed(str(err))
+
+    return verification.new_sign_count
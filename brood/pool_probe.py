@@ -0,0 +1,79 @@
+"""
+Verification of idle database connections.
+
+Connections idle in the pool could be silently dropped by NAT or firewall, probe pings
+them periodically, so dead connections are replaced before requests run into them.
+"""
+from datetime import datetime, timezone
+import logging
+from typing import Any, Dict, List, Optional
+
+from sqlalchemy import text
+from sqlalchemy.engine import Connection, Engine
+from sqlalchemy.exc import DBAPIError
+
+logger = logging.getLogger(__name__)
+
+
+class PoolProbe:
+    """
+    Checks out every idle connection of the pool at once and runs SELECT 1 on it. Result
+    of the last probe is reported by health endpoint.
+    """
+
+    def __init__(self, engine: Engine) -> None:
+        self.engine = engine
+        self.healthy: Optional[bool] = None
+        self.last_probe_at: Optional[datetime] = None
+        self.idle_connections = 0
+        self.dead_connections = 0
+        self.error: Optional[str] = None
+
+    def probe(self) -> None:
+        # At least one connection is checked, so database availability is known even
+        # with empty pool
+        idle_connections = max(self.engine.pool.checkedin(), 1)  # type: ignore
+        dead_connections = 0
+        connections: List[Connection] = []
+        healthy = True
+        error = None
+        try:
+            for _ in range(idle_connections):
+                connection = self.engine.connect()
+                connections.append(connection)
+                try:
+                    connection.execute(text("SELECT 1"))
+                except DBAPIError as err:
+                    if not err.connection_invalidated:
+                        raise
+                    # Dead connection is discarded by the pool, new one should work
+                    dead_connections += 1
+                    connection = self.engine.connect()
+                    connections.append(connection)
+                    connection.execute(text("SELECT 1"))
+        except Exception as err:
+            healthy = False
+            error = str(err)
+            logger.error(f"Database pool probe failed: {error}", extra={"error": error})
+        finally:
+            for connection in connections:
+                connection.close()
+
+        if dead_connections > 0:
+            logger.warning(
+                f"Database pool probe replaced {dead_connections} dead connections"
+            )
+        self.healthy = healthy
+        self.error = error
+        self.idle_connections = idle_connections
+        self.dead_connections = dead_connections
+        self.last_probe_at = datetime.now(timezone.utc)
+
+    def status(self) -> Dict[str, Any]:
+        return {
+            "healthy": self.healthy,
+            "last_probe_at": self.last_probe_at,
+            "idle_connections": self.idle_connections,
+            "dead_connections": self.dead_connections,
+            "error": self.error,
+        }
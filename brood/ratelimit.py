@@ -0,0 +1,79 @@
+"""
+In-memory rate limiting for Brood API.
+
+Limits are tracked per uvicorn worker, so effective limit is multiplied by number of workers.
+"""
+import threading
+import time
+from typing import Dict, Tuple
+
+
+class TokenBucketLimiter:
+    """
+    Token bucket per key (for example client IP). Each bucket holds up to capacity tokens and is
+    refilled with refill_rate tokens per second, every allowed request consumes one token.
+    """
+
+    def __init__(
+        self, capacity: int, refill_rate: float, max_buckets: int = 10000
+    ) -> None:
+        self.capacity = capacity
+        self.refill_rate = refill_rate
+        self.max_buckets = max_buckets
+        # Maps key to pair of available tokens and time of last refill
+        self._buckets: Dict[str, Tuple[float, float]] = {}
+        self._lock = threading.Lock()
+
+    def allow(self, key: str) -> bool:
+        """
+        Consumes token from bucket of the key, returns False if bucket is empty.
+        """
+        allowed, _ = self.consume(key)
+        return allowed
+
+    def consume(self, key: str) -> Tuple[bool, float]:
+        """
+        Consumes token from bucket of the key. Returns if request is allowed and number of
+        tokens left in the bucket.
+        """
+        now = time.monotonic()
+        with self._lock:
+            tokens, last_refill = self._buckets.get(key, (float(self.capacity), now))
+            tokens = min(
+                float(self.capacity), tokens + (now - last_refill) * self.refill_rate
+            )
+            allowed = tokens >= 1
+            if allowed:
+                tokens -= 1
+            self._buckets[key] = (tokens, now)
+            self._cleanup(now)
+        return allowed, tokens
+
+    def reset_at(self, tokens: float) -> int:
+        """
+        Unix timestamp when bucket with given number of tokens is refilled to capacity.
+        """
+        return int(time.time() + (self.capacity - tokens) / self.refill_rate) + 1
+
+    def retry_after(self) -> int:
+        """
+        Seconds until empty bucket has a token again.
+        """
+        return max(1, int(1 / self.refill_rate))
+
+    def _cleanup(self, now: float) -> None:
+        # Full buckets are equivalent to absent ones, drop them to bound memory usage
+        if len(self._buckets) < self.max_buckets:
+            return
+        full_after = self.capacity / self.refill_rate
+        self._buckets = {
+            key: (tokens, last_refill)
+            for key, (tokens, last_refill) in self._buckets.items()
+            if now - last_refill < full_after
+        }
+        # Under load from many keys, least recently used half of buckets is dropped
+        if len(self._buckets) >= self.max_buckets:
+            recent = sorted(
+                self._buckets.items(), key=lambda item: item[1][1], reverse=True
+            )
+            self._buckets = dict(recent[: self.max_buckets // 2])
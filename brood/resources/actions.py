@@ -1,19 +1,39 @@
 from collections import defaultdict
+import json
 import logging
-from typing import Any, Dict, List, Optional, Set
+from typing import Any, Dict, Iterator, List, Optional, Set, Tuple
 from uuid import UUID
 
-from sqlalchemy import or_
+from pydantic import ValidationError
+from sqlalchemy import and_, or_, text
+from sqlalchemy.exc import SQLAlchemyError
 from sqlalchemy.orm.session import Session
 
 from . import data
 from . import exceptions
 from . import models
-from ..models import Application
+from .events import RESOURCE_EVENTS_CHANNEL
+from ..models import Application, Group
 
 logger = logging.getLogger(__name__)
 
 
+def get_parent_groups_ids(db_session: Session, groups_ids: List[Any]) -> List[UUID]:
+    """
+    Return ids of parent groups for provided groups.
+    """
+    if not groups_ids:
+        return []
+    parents = (
+        db_session.query(Group.parent)
+        .filter(Group.id.in_(groups_ids))
+        .filter(Group.parent.isnot(None))
+        .distinct()
+        .all()
+    )
+    return [parent[0] for parent in parents]
+
+
 def acl_auth(
     db_session: Session, user_id: str, user_group_id_list: List[str], resource_id: UUID
 ) -> Dict[data.HolderType, List[str]]:
@@ -21,7 +41,11 @@ def acl_auth(
     Checks the authorization in ResourceHolderPermission model. If it represents
     a verified user or group user belongs to and generates dictionary with
     permissions for user and group. Otherwise raises a 403 error.
+
+    Permissions of parent groups are taken into account only if they were granted
+    with inherit flag.
     """
+    parent_group_id_list = get_parent_groups_ids(db_session, user_group_id_list)
 
     acl: Dict[data.HolderType, List[str]] = {
         data.HolderType.user: [],
@@ -43,6 +67,10 @@ def acl_auth(
             or_(
                 models.ResourceHolderPermission.user_id == user_id,
                 models.ResourceHolderPermission.group_id.in_(user_group_id_list),
+                and_(
+                    models.ResourceHolderPermission.group_id.in_(parent_group_id_list),
+                    models.ResourceHolderPermission.inherit.is_(True),
+                ),
             )
         )
         .all()
@@ -83,26 +111,30 @@ def acl_check(
         raise exceptions.PermissionsNotFound("No permissions for requested information")
 
 
-def create_resource(
+def add_resource(
     db_session: Session,
     user_id: UUID,
     application_id: UUID,
     resource_data: Dict[str, Any],
 ) -> models.Resource:
     """
-    Create new resource and permissions for that resource.
-    Also attach current user to this permissions.
+    Add new resource and permissions for that resource to the session without commit.
+    Current user and application group are attached to this permissions.
     """
+    application = (
+        db_session.query(Application).filter(Application.id == application_id).first()
+    )
+    if application is None:
+        raise exceptions.ResourceInvalidParameters(
+            f"There are no application with id: {application_id}"
+        )
+
     resource = models.Resource(
         application_id=application_id,
         resource_data=resource_data,
     )
     db_session.add(resource)
-    db_session.commit()
-
-    application = (
-        db_session.query(Application).filter(Application.id == application_id).first()
-    )
+    db_session.flush()
 
     for permission in data.ResourcePermissions:
         resource_permission = models.ResourcePermission(
@@ -110,7 +142,7 @@ def create_resource(
             permission=permission.value,
         )
         db_session.add(resource_permission)
-        db_session.commit()
+        db_session.flush()
 
         user_permission = models.ResourceHolderPermission(
             user_id=user_id,
@@ -126,11 +158,92 @@ def create_resource(
         )
         db_session.add(user_permission)
         db_session.add(application_group_permission)
-        db_session.commit()
+    db_session.flush()
+
+    return resource
+
+
+def create_resource(
+    db_session: Session,
+    user_id: UUID,
+    application_id: UUID,
+    resource_data: Dict[str, Any],
+) -> models.Resource:
+    """
+    Create new resource and permissions for that resource.
+    Also attach current user to this permissions.
+    """
+    resource = add_resource(db_session, user_id, application_id, resource_data)
+    db_session.commit()
 
     return resource
 
 
+def create_resources_batch(
+    db_session: Session,
+    user_id: UUID,
+    items: List[Dict[str, Any]],
+    atomic: bool = True,
+) -> Tuple[List[data.ResourceBatchItemResult], bool]:
+    """
+    Create resources from the list of creation requests.
+
+    In atomic mode either all resources are created or none of them. Otherwise every
+    item is created in its own savepoint and failed items do not affect the rest.
+
+    Returns per-item results in order of items and if any item failed.
+    """
+    results: List[data.ResourceBatchItemResult] = []
+    failed = False
+    for index, item in enumerate(items):
+        try:
+            request = data.ResourceCreationRequest.parse_obj(item)
+            with db_session.begin_nested():
+                resource = add_resource(
+                    db_session,
+                    user_id,
+                    request.application_id,
+                    request.resource_data,
+                )
+            results.append(
+                data.ResourceBatchItemResult(
+                    index=index,
+                    success=True,
+                    resource=data.ResourceResponse.from_orm(resource),
+                )
+            )
+        except (ValidationError, exceptions.ResourceInvalidParameters) as err:
+            failed = True
+            results.append(
+                data.ResourceBatchItemResult(index=index, success=False, error=str(err))
+            )
+        except SQLAlchemyError as err:
+            # Database errors could contain SQL and values of other rows
+            logger.error(
+                f"Unable to create resource {index} of batch: {str(err)}",
+                extra={"error": err},
+            )
+            failed = True
+            results.append(
+                data.ResourceBatchItemResult(
+                    index=index, success=False, error="Unable to create resource"
+                )
+            )
+
+    if atomic and failed:
+        db_session.rollback()
+        # Nothing is stored, so successfully validated items are reported as failed too
+        for result in results:
+            if result.success:
+                result.success = False
+                result.resource = None
+                result.error = "Batch is rolled back due to errors in other items"
+    else:
+        db_session.commit()
+
+    return results, failed
+
+
 def get_list_of_resources(
     db_session: Session,
     user_id: UUID,
@@ -141,6 +254,7 @@ def get_list_of_resources(
     """
     Return list of available resource to user.
     """
+    parent_groups_ids = get_parent_groups_ids(db_session, user_groups_ids)
     query = (
         db_session.query(models.Resource)
         .join(
@@ -151,6 +265,10 @@ def get_list_of_resources(
             or_(
                 models.ResourceHolderPermission.user_id == user_id,
                 models.ResourceHolderPermission.group_id.in_(user_groups_ids),
+                and_(
+                    models.ResourceHolderPermission.group_id.in_(parent_groups_ids),
+                    models.ResourceHolderPermission.inherit.is_(True),
+                ),
             )
         )
     )
@@ -164,6 +282,92 @@ def get_list_of_resources(
     return resources
 
 
+def get_shared_resources(
+    db_session: Session,
+    user_id: UUID,
+    user_groups_ids: List[UUID],
+    application_id: Optional[UUID] = None,
+) -> List[Tuple[models.Resource, data.ResourcePermissions]]:
+    """
+    Return resources available to user which user does not own, together with effective
+    permission. User owns resource if holds admin permission on it personally.
+
+    Resource could be shared through several holders (user itself, groups and parent
+    groups), it is listed once with the highest permission granted by any of them.
+    """
+    parent_groups_ids = get_parent_groups_ids(db_session, user_groups_ids)
+    owned_resources = (
+        db_session.query(models.ResourceHolderPermission.resource_id)
+        .join(
+            models.ResourcePermission,
+            models.ResourcePermission.id
+            == models.ResourceHolderPermission.permission_id,
+        )
+        .filter(models.ResourceHolderPermission.user_id == user_id)
+        .filter(
+            models.ResourcePermission.permission == data.ResourcePermissions.ADMIN.value
+        )
+    )
+    query = (
+        db_session.query(models.Resource, models.ResourcePermission.permission)
+        .join(
+            models.ResourceHolderPermission,
+            models.ResourceHolderPermission.resource_id == models.Resource.id,
+        )
+        .join(
+            models.ResourcePermission,
+            models.ResourcePermission.id
+            == models.ResourceHolderPermission.permission_id,
+        )
+        .filter(
+            or_(
+                models.ResourceHolderPermission.user_id == user_id,
+                models.ResourceHolderPermission.group_id.in_(user_groups_ids),
+                and_(
+                    models.ResourceHolderPermission.group_id.in_(parent_groups_ids),
+                    models.ResourceHolderPermission.inherit.is_(True),
+                ),
+            )
+        )
+        .filter(models.Resource.id.notin_(owned_resources))
+        .order_by(models.Resource.created_at, models.Resource.id)
+    )
+    if application_id is not None:
+        query = query.filter(models.Resource.application_id == application_id)
+
+    resources: Dict[UUID, models.Resource] = {}
+    levels: Dict[UUID, int] = {}
+    for resource, permission in query:
+        resources[resource.id] = resource
+        level = data.PERMISSION_LEVELS.index(data.ResourcePermissions(permission))
+        levels[resource.id] = max(level, levels.get(resource.id, 0))
+
+    return [
+        (resource, data.PERMISSION_LEVELS[levels[resource_id]])
+        for resource_id, resource in resources.items()
+    ]
+
+
+def iter_user_resources(
+    db_session: Session, user_id: UUID, batch_size: int = 500
+) -> Iterator[models.Resource]:
+    """
+    Iterates over resources user holds permissions on personally, not through groups.
+    """
+    holder_resources = db_session.query(
+        models.ResourceHolderPermission.resource_id
+    ).filter(models.ResourceHolderPermission.user_id == user_id)
+    query = (
+        db_session.query(models.Resource)
+        .filter(models.Resource.id.in_(holder_resources))
+        .order_by(models.Resource.created_at, models.Resource.id)
+        .execution_options(stream_results=True)
+        .yield_per(batch_size)
+    )
+    for resource in query:
+        yield resource
+
+
 def get_resource(db_session: Session, resource_id: UUID) -> models.Resource:
     """
     Get resource by id or name.
@@ -176,6 +380,23 @@ def get_resource(db_session: Session, resource_id: UUID) -> models.Resource:
     return resource
 
 
+def notify_resource_event(
+    db_session: Session, resource_id: UUID, event: data.ResourceEventType
+) -> None:
+    """
+    Publishes resource event, listeners receive it when transaction is committed.
+    """
+    db_session.execute(
+        text("SELECT pg_notify(:channel, :payload)"),
+        {
+            "channel": RESOURCE_EVENTS_CHANNEL,
+            "payload": json.dumps(
+                {"resource_id": str(resource_id), "event": event.value}
+            ),
+        },
+    )
+
+
 def update_resource_data(
     db_session: Session,
     resource_id: UUID,
@@ -200,6 +421,7 @@ def update_resource_data(
         except Exception:
             pass
     resource.resource_data = resource_data
+    notify_resource_event(db_session, resource_id, data.ResourceEventType.updated)
 
     db_session.commit()
 
@@ -216,6 +438,7 @@ def delete_resource(db_session: Session, resource_id: UUID) -> models.Resource:
         raise exceptions.ResourceNotFound("Not found requested resource")
 
     db_session.delete(resource)
+    notify_resource_event(db_session, resource_id, data.ResourceEventType.deleted)
     db_session.commit()
 
     return resource
@@ -272,6 +495,9 @@ def add_holder_permissions(
             else None,
             resource_id=resource_id,
             permission_id=permission.id,
+            inherit=permissions_request.inherit
+            if permissions_request.holder_type == data.HolderType.group
+            else False,
         )
         for permission in permissions_to_add_query.all()
     ]
@@ -1,5 +1,7 @@
+import asyncio
+import json
 import logging
-from typing import Any, Dict, List, Set
+from typing import Any, AsyncIterator, Dict, List, Optional, Set
 from uuid import UUID
 
 from fastapi import (
@@ -9,24 +11,43 @@ from fastapi import (
     Path,
     Depends,
     Request,
+    Response,
     Query,
     HTTPException,
 )
-from fastapi.middleware.cors import CORSMiddleware
+from fastapi.exceptions import RequestValidationError
+from fastapi.responses import StreamingResponse
 from sqlalchemy.orm.session import Session
+from starlette.exceptions import HTTPException as StarletteHTTPException
 
 from . import actions
 from . import data
 from . import exceptions
+from .events import resource_events_hub
 from .version import BROOD_RESOURCES_VERSION
 from ..data import VersionResponse
+from ..version import BROOD_COMMIT_HASH, PYTHON_VERSION
 from .. import models as brood_models
+from ..config_watcher import config_watcher
 from ..external import yield_db_session_from_env
-from ..middleware import get_current_user
-from ..settings import ORIGINS, DOCS_TARGET_PATH, BROOD_OPENAPI_LIST
+from ..middleware import (
+    DynamicCORSMiddleware,
+    UTF8JSONResponse,
+    get_current_user,
+    http_exception_handler,
+    location_path,
+    validation_exception_handler,
+)
+from ..settings import DOCS_TARGET_PATH, BROOD_OPENAPI_LIST
 
 SUBMODULE_NAME = "resources"
 
+# Comment is sent to idle event streams, so proxies do not close them by timeout
+EVENTS_KEEPALIVE_SECONDS = 15
+
+# Maximum number of resources created by one batch request
+MAX_BATCH_SIZE = 500
+
 tags_metadata = [
     {"name": "resources", "description": "Operations with resources."},
     {"name": "resource holders", "description": "Operations with resource holders."},
@@ -44,16 +65,20 @@ app = FastAPI(
     else None,
     docs_url=None,
     redoc_url=f"/{DOCS_TARGET_PATH}",
+    default_response_class=UTF8JSONResponse,
 )
 
 app.add_middleware(
-    CORSMiddleware,
-    allow_origins=ORIGINS,
+    DynamicCORSMiddleware,
+    get_origins=config_watcher.cors_allowed_origins,
     allow_credentials=True,
     allow_methods=["*"],
     allow_headers=["*"],
 )
 
+app.add_exception_handler(StarletteHTTPException, http_exception_handler)
+app.add_exception_handler(RequestValidationError, validation_exception_handler)
+
 
 def ensure_resource_permission(
     db_session: Session,
@@ -92,11 +117,19 @@ def ensure_resource_permission(
 
 @app.get("/version", response_model=VersionResponse)
 async def version() -> VersionResponse:
-    return VersionResponse(version=BROOD_RESOURCES_VERSION)
+    return VersionResponse(
+        version=BROOD_RESOURCES_VERSION,
+        commit_hash=BROOD_COMMIT_HASH,
+        python_version=PYTHON_VERSION,
+    )
 
 
-@app.post("/", tags=["resources"], response_model=data.ResourceResponse)
+@app.post(
+    "/", tags=["resources"], status_code=201, response_model=data.ResourceResponse
+)
 async def create_resource_handler(
+    request: Request,
+    response: Response,
     data: data.ResourceCreationRequest = Body(...),
     current_user: brood_models.User = Depends(get_current_user),
     db_session=Depends(yield_db_session_from_env),
@@ -104,6 +137,7 @@ async def create_resource_handler(
     """
     Create the resource.
     Current user will inherit all permissions to the resource.
+    Response has status 201 and Location header with path of the resource.
 
     - **data** (dict):
         - **application_id** (uuid)
@@ -117,12 +151,68 @@ async def create_resource_handler(
             resource_data=data.resource_data,
         )
     except Exception as err:
-        logger.error(f"Unhandled error in create_resource_handler: {str(err)}")
+        logger.error(
+            f"Unhandled error in create_resource_handler: {str(err)}",
+            extra={"error": err},
+        )
         raise HTTPException(status_code=500)
 
+    response.headers["Location"] = location_path(request, f"/{resource.id}")
     return resource
 
 
+@app.post("/batch", tags=["resources"], response_model=data.ResourceBatchResponse)
+async def create_resources_batch_handler(
+    response: Response,
+    items: List[Dict[str, Any]] = Body(...),
+    atomic: bool = Query(True),
+    current_user: brood_models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.ResourceBatchResponse:
+    """
+    Create list of resources in one request.
+    Current user will inherit all permissions to the created resources.
+
+    In atomic mode resources are created only if all items are valid, otherwise status
+    422 is returned. With atomic=false valid items are created and status 207 is
+    returned if some items failed. Every item is reported in results.
+
+    - **items** (list): Up to 500 resources in format of resource creation request
+    - **atomic** (boolean): Create all resources or none of them, true by default
+    """
+    if len(items) == 0:
+        raise HTTPException(status_code=400, detail="At least one resource is required")
+    if len(items) > MAX_BATCH_SIZE:
+        raise HTTPException(
+            status_code=400,
+            detail=f"Batch could contain at most {MAX_BATCH_SIZE} resources",
+        )
+
+    try:
+        results, failed = actions.create_resources_batch(
+            db_session=db_session,
+            user_id=current_user.id,
+            items=items,
+            atomic=atomic,
+        )
+    except Exception as err:
+        logger.error(
+            f"Unhandled error in create_resources_batch_handler: {str(err)}",
+            extra={"error": err},
+        )
+        raise HTTPException(status_code=500)
+
+    if failed:
+        response.status_code = 422 if atomic else 207
+    created = len([result for result in results if result.success])
+    return data.ResourceBatchResponse(
+        atomic=atomic,
+        created=created,
+        failed=len(results) - created,
+        results=results,
+    )
+
+
 @app.get("/", tags=["resources"], response_model=data.ResourcesListResponse)
 async def get_resources_list_handler(
     request: Request,
@@ -151,7 +241,10 @@ async def get_resources_list_handler(
             db_session, current_user.id, user_groups_ids, params, application_id
         )
     except Exception as err:
-        logger.error(f"Unhandled error in get_resources_list_handler: {str(err)}")
+        logger.error(
+            f"Unhandled error in get_resources_list_handler: {str(err)}",
+            extra={"error": err},
+        )
         raise HTTPException(status_code=500)
 
     return data.ResourcesListResponse(
@@ -168,6 +261,52 @@ async def get_resources_list_handler(
     )
 
 
+@app.get(
+    "/shared", tags=["resources"], response_model=data.SharedResourcesListResponse
+)
+async def get_shared_resources_handler(
+    application_id: Optional[UUID] = Query(None),
+    current_user: brood_models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> data.SharedResourcesListResponse:
+    """
+    Get a list of resources shared with the user directly or through groups with the
+    highest permission user has on them, resources user owns are not listed.
+
+    - **application_id** (uuid, null): Application ID to filter resources
+    """
+    try:
+        group_users_list = (
+            db_session.query(brood_models.GroupUser)
+            .filter(brood_models.GroupUser.user_id == current_user.id)
+            .all()
+        )
+        user_groups_ids = [group.group_id for group in group_users_list]
+        shared_resources = actions.get_shared_resources(
+            db_session, current_user.id, user_groups_ids, application_id
+        )
+    except Exception as err:
+        logger.error(
+            f"Unhandled error in get_shared_resources_handler: {str(err)}",
+            extra={"error": err},
+        )
+        raise HTTPException(status_code=500)
+
+    return data.SharedResourcesListResponse(
+        resources=[
+            data.SharedResourceResponse(
+                id=resource.id,
+                application_id=resource.application_id,
+                resource_data=resource.resource_data,
+                created_at=resource.created_at,
+                updated_at=resource.updated_at,
+                permission=permission,
+            )
+            for resource, permission in shared_resources
+        ]
+    )
+
+
 @app.get("/{resource_id}", tags=["resources"], response_model=data.ResourceResponse)
 async def get_resource_handler(
     resource_id: UUID = Path(...),
@@ -190,7 +329,9 @@ async def get_resource_handler(
     except exceptions.ResourceNotFound:
         raise HTTPException(status_code=404, detail="Resource not found")
     except Exception as err:
-        logger.error(f"Unhandled error in get_resource_handler: {str(err)}")
+        logger.error(
+            f"Unhandled error in get_resource_handler: {str(err)}", extra={"error": err}
+        )
         raise HTTPException(status_code=500)
 
     return data.ResourceResponse(
@@ -202,6 +343,55 @@ async def get_resource_handler(
     )
 
 
+async def resource_events(resource_id: UUID) -> AsyncIterator[str]:
+    queue = resource_events_hub.subscribe(resource_id)
+    try:
+        while True:
+            try:
+                event = await asyncio.wait_for(
+                    queue.get(), timeout=EVENTS_KEEPALIVE_SECONDS
+                )
+            except asyncio.TimeoutError:
+                yield ": keep-alive\n\n"
+                continue
+            # Listener failed, client should reconnect
+            if event is None:
+                return
+            yield f"event: {event['event']}\ndata: {json.dumps(event)}\n\n"
+            if event["event"] == data.ResourceEventType.deleted.value:
+                return
+    finally:
+        resource_events_hub.unsubscribe(resource_id, queue)
+
+
+@app.get("/{resource_id}/events", tags=["resources"])
+async def resource_events_handler(
+    resource_id: UUID = Path(...),
+    current_user: brood_models.User = Depends(get_current_user),
+    db_session=Depends(yield_db_session_from_env),
+) -> StreamingResponse:
+    """
+    Stream of resource changes as server-sent events. Events are "updated" and
+    "deleted", stream ends after resource is deleted.
+
+    - **resource_id** (uuid): Resource ID
+    """
+    ensure_resource_permission(
+        db_session,
+        current_user.id,
+        resource_id,
+        {data.ResourcePermissions.READ},
+    )
+    # Otherwise database connection is held until the stream ends
+    db_session.close()
+
+    return StreamingResponse(
+        resource_events(resource_id),
+        media_type="text/event-stream",
+        headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"},
+    )
+
+
 @app.put("/{resource_id}", tags=["resources"], response_model=data.ResourceResponse)
 async def update_resource_handler(
     resource_id: UUID = Path(...),
@@ -231,7 +421,9 @@ async def update_resource_handler(
     except exceptions.ResourceNotFound:
         raise HTTPException(status_code=404, detail="Resource not found")
     except Exception as err:
-        logger.error(f"Unhandled error in get_resource_handler: {str(err)}")
+        logger.error(
+            f"Unhandled error in get_resource_handler: {str(err)}", extra={"error": err}
+        )
         raise HTTPException(status_code=500)
 
     return data.ResourceResponse(
@@ -265,7 +457,10 @@ async def delete_resource_handler(
     except exceptions.ResourceNotFound:
         raise HTTPException(status_code=404, detail="Resource not found")
     except Exception as err:
-        logger.error(f"Unhandled error in delete_resource_handler: {str(err)}")
+        logger.error(
+            f"Unhandled error in delete_resource_handler: {str(err)}",
+            extra={"error": err},
+        )
         raise HTTPException(status_code=500)
 
     return data.ResourceResponse(
@@ -318,7 +513,8 @@ async def add_resource_holder_permissions_handler(
         raise HTTPException(status_code=404, detail="Resource not found")
     except Exception as err:
         logger.error(
-            f"Unhandled error in add_resource_holder_permissions_handler: {str(err)}"
+            f"Unhandled error in add_resource_holder_permissions_handler: {str(err)}",
+            extra={"error": err},
         )
         raise HTTPException(status_code=500)
 
@@ -357,7 +553,8 @@ async def get_resource_holders_permissions_handler(
         raise HTTPException(status_code=404, detail="Resource not found")
     except Exception as err:
         logger.error(
-            f"Unhandled error in get_resource_holders_permissions_handler: {str(err)}"
+            f"Unhandled error in get_resource_holders_permissions_handler: {str(err)}",
+            extra={"error": err},
         )
         raise HTTPException(status_code=500)
 
@@ -411,7 +608,8 @@ async def delete_resource_holder_permissions_handler(
         )
     except Exception as err:
         logger.error(
-            f"Unhandled error in delete_resource_holder_permissions_handler: {str(err)}"
+            f"Unhandled error in delete_resource_holder_permissions_handler: {str(err)}",
+            extra={"error": err},
         )
         raise HTTPException(status_code=500)
 
@@ -6,6 +6,7 @@ import json
 
 from .models import Resource
 from ..external import SessionLocal
+from ..settings import DB_URI, validate_db_uri
 
 
 def resources_list_handler(args: argparse.Namespace) -> None:
@@ -100,6 +101,10 @@ def main() -> None:
     parser_resources_create.set_defaults(func=resources_create_handler)
 
     args = parser.parse_args()
+    # Otherwise commands would fail connecting to placeholder database
+    db_uri_error = validate_db_uri(DB_URI)
+    if db_uri_error is not None:
+        parser.error(db_uri_error)
     args.func(args)
 
 
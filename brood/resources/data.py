@@ -5,6 +5,8 @@ from uuid import UUID
 
 from pydantic import BaseModel, Field
 
+from ..data import RequestModel
+
 
 class ResourcePermissions(Enum):
     ADMIN = "admin"
@@ -14,12 +16,27 @@ class ResourcePermissions(Enum):
     DELETE = "delete"
 
 
+# Permissions from the lowest to the highest, shared resources report the highest one
+PERMISSION_LEVELS = [
+    ResourcePermissions.READ,
+    ResourcePermissions.CREATE,
+    ResourcePermissions.UPDATE,
+    ResourcePermissions.DELETE,
+    ResourcePermissions.ADMIN,
+]
+
+
+class ResourceEventType(Enum):
+    updated = "updated"
+    deleted = "deleted"
+
+
 class HolderType(Enum):
     user = "user"
     group = "group"
 
 
-class ResourceCreationRequest(BaseModel):
+class ResourceCreationRequest(RequestModel):
     application_id: UUID
     resource_data: Dict[str, Any]
 
@@ -39,7 +56,31 @@ class ResourcesListResponse(BaseModel):
     resources: List[ResourceResponse] = Field(default_factory=list)
 
 
-class ResourceDataUpdateRequest(BaseModel):
+class ResourceBatchItemResult(BaseModel):
+    # Position of the item in request
+    index: int
+    success: bool
+    resource: Optional[ResourceResponse] = None
+    error: Optional[str] = None
+
+
+class ResourceBatchResponse(BaseModel):
+    atomic: bool
+    created: int
+    failed: int
+    results: List[ResourceBatchItemResult] = Field(default_factory=list)
+
+
+class SharedResourceResponse(ResourceResponse):
+    # Highest permission granted to the caller through any of holders
+    permission: ResourcePermissions
+
+
+class SharedResourcesListResponse(BaseModel):
+    resources: List[SharedResourceResponse] = Field(default_factory=list)
+
+
+class ResourceDataUpdateRequest(RequestModel):
     update: Dict[str, Any]
     drop_keys: List[str] = Field(default_factory=list)
 
@@ -55,7 +96,9 @@ class ResourceHoldersListResponse(BaseModel):
     holders: List[ResourceHolderResponse] = Field(default_factory=list)
 
 
-class ResourcePermissionsRequest(BaseModel):
+class ResourcePermissionsRequest(RequestModel):
     holder_id: UUID
     holder_type: HolderType
     permissions: List[ResourcePermissions] = Field(default_factory=list)
+    # Grant permissions to members of child groups, applies only to group holders
+    inherit: bool = False
@@ -0,0 +1,126 @@
+"""
+Live events about resource changes.
+
+Changes are published with PostgreSQL NOTIFY in the transaction which changes resource,
+every worker holds one LISTEN connection and fans notifications out to subscribers.
+"""
+import asyncio
+import json
+import logging
+import select
+import threading
+from collections import defaultdict
+from typing import Any, Dict, Optional, Set
+from uuid import UUID
+
+from ..draining import drain_state
+from ..external import engine
+
+logger = logging.getLogger(__name__)
+
+RESOURCE_EVENTS_CHANNEL = "brood_resource_events"
+
+
+class ResourceEventsHub:
+    """
+    Delivers resource events to subscribers of this worker. Listener thread is started
+    with the first subscription, if it fails or hub is stopped subscribers receive None
+    and should end their streams.
+    """
+
+    def __init__(self) -> None:
+        self._subscribers: Dict[UUID, Set[asyncio.Queue]] = defaultdict(set)
+        self._loop: Optional[asyncio.AbstractEventLoop] = None
+        self._listening = False
+        self._stop = threading.Event()
+
+    def subscribe(self, resource_id: UUID) -> asyncio.Queue:
+        queue: asyncio.Queue = asyncio.Queue()
+        if self._stop.is_set():
+            queue.put_nowait(None)
+            return queue
+        self._subscribers[resource_id].add(queue)
+        if not self._listening:
+            self._listening = True
+            self._loop = asyncio.get_event_loop()
+            thread = threading.Thread(
+                target=self._listen, name="resource-events-listener", daemon=True
+            )
+            thread.start()
+        return queue
+
+    def stop(self) -> None:
+        """
+        Ends streams of subscribers and makes listener thread exit within its wait
+        timeout. Must be called from the event loop.
+        """
+        self._stop.set()
+        if self._listening:
+            self._dispatch(None)
+
+    def stop_threadsafe(self) -> None:
+        """
+        Stops hub from any thread, e.g. from signal handler when worker starts draining.
+        """
+        if self._loop is None:
+            self._stop.set()
+            return
+        self._loop.call_soon_threadsafe(self.stop)
+
+    def unsubscribe(self, resource_id: UUID, queue: asyncio.Queue) -> None:
+        subscribers = self._subscribers.get(resource_id)
+        if subscribers is None:
+            return
+        subscribers.discard(queue)
+        if not subscribers:
+            del self._subscribers[resource_id]
+
+    def _dispatch(self, event: Optional[Dict[str, Any]]) -> None:
+        if event is None:
+            self._listening = False
+            for subscribers in self._subscribers.values():
+                for queue in subscribers:
+                    queue.put_nowait(None)
+            return
+        for queue in self._subscribers.get(UUID(event["resource_id"]), set()):
+            queue.put_nowait(event)
+
+    def _listen(self, wait_timeout_seconds: float = 5.0) -> None:
+        assert self._loop is not None
+        try:
+            # Connection is detached from the pool, it is held open by the listener
+            connection = engine.raw_connection()
+            connection.detach()
+            dbapi_connection = connection.connection
+            try:
+                dbapi_connection.autocommit = True
+                cursor = dbapi_connection.cursor()
+                cursor.execute(f"LISTEN {RESOURCE_EVENTS_CHANNEL}")
+                cursor.close()
+                while not self._stop.is_set():
+                    readable, _, _ = select.select(
+                        [dbapi_connection], [], [], wait_timeout_seconds
+                    )
+                    if not readable:
+                        continue
+                    dbapi_connection.poll()
+                    while dbapi_connection.notifies:
+                        notify = dbapi_connection.notifies.pop(0)
+                        self._loop.call_soon_threadsafe(
+                            self._dispatch, json.loads(notify.payload)
+                        )
+            finally:
+                connection.close()
+        except Exception as err:
+            if self._stop.is_set():
+                return
+            logger.error(
+                f"Listening for resource events failed: {str(err)}",
+                extra={"error": err},
+            )
+            self._loop.call_soon_threadsafe(self._dispatch, None)
+
+
+resource_events_hub = ResourceEventsHub()
+# Otherwise open streams keep draining worker alive until uvicorn shutdown timeout
+drain_state.on_draining(resource_events_hub.stop_threadsafe)
@@ -2,6 +2,7 @@ import uuid
 
 from sqlalchemy.ext.declarative import declarative_base
 from sqlalchemy import (
+    Boolean,
     Column,
     DateTime,
     ForeignKey,
@@ -118,6 +119,7 @@ class ResourceHolderPermission(Base):  # type: ignore
         UUID(as_uuid=True),
         ForeignKey("resource_permissions.id", ondelete="CASCADE"),
     )
+    inherit = Column(Boolean, default=False, nullable=False)
     created_at = Column(
         DateTime(timezone=True), server_default=utcnow(), nullable=False
     )
@@ -0,0 +1,56 @@
+import unittest
+import uuid
+from unittest import mock
+
+from sqlalchemy.orm import Query, Session
+
+from . import actions, data, models
+
+
+class TestGetSharedResources(unittest.TestCase):
+    def shared_resources(self, rows):
+        """
+        Builds shared resources query without database and returns result of
+        get_shared_resources for provided (resource, permission) rows.
+        """
+        with mock.patch.object(
+            actions, "get_parent_groups_ids", return_value=[uuid.uuid4()]
+        ), mock.patch.object(Query, "__iter__", return_value=iter(rows)):
+            return actions.get_shared_resources(
+                Session(), user_id=uuid.uuid4(), user_groups_ids=[uuid.uuid4()]
+            )
+
+    def test_resource_shared_directly_and_through_group_is_listed_once(self):
+        resource = models.Resource(id=uuid.uuid4())
+        other_resource = models.Resource(id=uuid.uuid4())
+        shared = self.shared_resources(
+            [
+                # Shared with user directly
+                (resource, data.ResourcePermissions.READ.value),
+                (other_resource, data.ResourcePermissions.READ.value),
+                # Shared with user's group
+                (resource, data.ResourcePermissions.UPDATE.value),
+                (resource, data.ResourcePermissions.CREATE.value),
+            ]
+        )
+        self.assertEqual(
+            shared,
+            [
+                (resource, data.ResourcePermissions.UPDATE),
+                (other_resource, data.ResourcePermissions.READ),
+            ],
+        )
+
+    def test_higher_direct_permission_is_kept(self):
+        resource = models.Resource(id=uuid.uuid4())
+        shared = self.shared_resources(
+            [
+                (resource, data.ResourcePermissions.DELETE.value),
+                (resource, data.ResourcePermissions.READ.value),
+            ]
+        )
+        self.assertEqual(shared, [(resource, data.ResourcePermissions.DELETE)])
+
+
+if __name__ == "__main__":
+    unittest.main()
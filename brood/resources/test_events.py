@@ -0,0 +1,84 @@
+import asyncio
+import json
+import unittest
+import uuid
+from unittest import mock
+
+from . import actions, api, data
+from .events import ResourceEventsHub
+from ..draining import DrainState
+
+
+class TestResourceEvents(unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        self.resource_id = uuid.uuid4()
+        self.hub = ResourceEventsHub()
+        # Events are dispatched by test instead of listener thread
+        self.hub._listening = True
+        patcher = mock.patch.object(api, "resource_events_hub", self.hub)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    async def asyncSetUp(self):
+        self.hub._loop = asyncio.get_running_loop()
+
+    async def next_message(self, stream):
+        message = asyncio.ensure_future(stream.__anext__())
+        # Let the stream subscribe before event is dispatched
+        await asyncio.sleep(0)
+        return message
+
+    async def test_update_triggers_event(self):
+        stream = api.resource_events(self.resource_id)
+        message = await self.next_message(stream)
+
+        db_session = mock.MagicMock()
+        query = db_session.query.return_value.filter.return_value
+        query.one_or_none.return_value = mock.Mock(resource_data={"name": "a"})
+        actions.update_resource_data(
+            db_session,
+            self.resource_id,
+            data.ResourceDataUpdateRequest(update={"name": "b"}),
+        )
+        payload = db_session.execute.call_args[0][1]["payload"]
+        self.hub._dispatch(json.loads(payload))
+
+        event = {"resource_id": str(self.resource_id), "event": "updated"}
+        self.assertEqual(
+            await message, f"event: updated\ndata: {json.dumps(event)}\n\n"
+        )
+        await stream.aclose()
+
+    async def test_events_of_other_resources_are_not_sent(self):
+        stream = api.resource_events(self.resource_id)
+        message = await self.next_message(stream)
+        self.hub._dispatch({"resource_id": str(uuid.uuid4()), "event": "updated"})
+        await asyncio.sleep(0)
+        self.assertFalse(message.done())
+        message.cancel()
+
+    async def test_stop_ends_streams(self):
+        stream = api.resource_events(self.resource_id)
+        message = await self.next_message(stream)
+        self.hub.stop()
+        with self.assertRaises(StopAsyncIteration):
+            await message
+
+    async def test_draining_ends_streams(self):
+        drain_state = DrainState()
+        drain_state.on_draining(self.hub.stop_threadsafe)
+        stream = api.resource_events(self.resource_id)
+        message = await self.next_message(stream)
+        drain_state.start_draining()
+        with self.assertRaises(StopAsyncIteration):
+            await message
+
+    async def test_subscription_after_stop_ends_right_away(self):
+        self.hub.stop()
+        stream = api.resource_events(self.resource_id)
+        with self.assertRaises(StopAsyncIteration):
+            await stream.__anext__()
+
+
+if __name__ == "__main__":
+    unittest.main()
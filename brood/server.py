@@ -0,0 +1,105 @@
+"""
+Runs Brood API with uvicorn listening on both IPv4 and IPv6 addresses.
+
+Uvicorn binds a single host, and IPv6 wildcard address does not accept IPv4 connections
+on systems where IPV6_V6ONLY is enabled by default. Here separate IPv4 and IPv6 sockets
+are bound on the same port and served by the same workers.
+
+On shutdown signal workers are marked as draining and keep serving requests for
+BROOD_DRAIN_DELAY_SECONDS before uvicorn stops accepting connections.
+"""
+import argparse
+import logging
+import socket
+import sys
+import threading
+from types import FrameType
+from typing import List, Optional
+
+import uvicorn
+from uvicorn.supervisors import Multiprocess
+
+from .draining import drain_state
+from .settings import DRAIN_DELAY_SECONDS
+
+logger = logging.getLogger(__name__)
+
+
+class DrainingServer(uvicorn.Server):
+    """
+    Marks worker as draining on the first shutdown signal, so health check responds with
+    503, and starts uvicorn shutdown after drain_delay seconds. Second signal shuts the
+    server down right away.
+    """
+
+    def __init__(self, config: uvicorn.Config, drain_delay: int) -> None:
+        super().__init__(config=config)
+        self.drain_delay = drain_delay
+
+    def handle_exit(self, sig: int, frame: Optional[FrameType]) -> None:
+        if drain_state.draining or self.drain_delay == 0:
+            drain_state.start_draining()
+            super().handle_exit(sig, frame)
+            return
+
+        drain_state.start_draining()
+        logger.info(f"Draining worker, shutdown in {self.drain_delay} seconds")
+        timer = threading.Timer(
+            self.drain_delay, super().handle_exit, args=(sig, frame)
+        )
+        timer.daemon = True
+        timer.start()
+
+
+def bind_socket(family: int, host: str, port: int) -> socket.socket:
+    sock = socket.socket(family, socket.SOCK_STREAM)
+    sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+    if family == socket.AF_INET6:
+        # Otherwise IPv6 socket may also claim IPv4 addresses and conflict with IPv4 one
+        sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 1)
+    sock.bind((host, port))
+    sock.set_inheritable(True)
+    return sock
+
+
+def dual_stack_sockets(port: int) -> List[socket.socket]:
+    return [
+        bind_socket(socket.AF_INET, "0.0.0.0", port),
+        bind_socket(socket.AF_INET6, "::", port),
+    ]
+
+
+def main() -> None:
+    parser = argparse.ArgumentParser(
+        description="Run Brood API on IPv4 and IPv6 wildcard addresses"
+    )
+    parser.add_argument("app", help="ASGI application, e.g. brood.api:app")
+    parser.add_argument("--port", type=int, default=7474, help="Port to listen on")
+    parser.add_argument(
+        "--workers", type=int, default=1, help="Number of worker processes"
+    )
+    parser.add_argument(
+        "--app-dir", default=".", help="Directory to look for the application in"
+    )
+    parser.add_argument(
+        "--drain-delay",
+        type=int,
+        default=DRAIN_DELAY_SECONDS,
+        help="Seconds to report worker as draining before shutdown",
+    )
+    args = parser.parse_args()
+
+    sys.path.insert(0, args.app_dir)
+    config = uvicorn.Config(args.app, port=args.port, workers=args.workers)
+    server = DrainingServer(config=config, drain_delay=args.drain_delay)
+    sockets = dual_stack_sockets(args.port)
+
+    # Each worker serves both sockets, shutdown drains connections from both of them
+    if config.workers > 1:
+        Multiprocess(config, target=server.run, sockets=sockets).run()
+    else:
+        server.run(sockets=sockets)
+
+
+if __name__ == "__main__":
+    main()
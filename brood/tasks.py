@@ -0,0 +1,112 @@
+"""
+Background tasks run by Brood API workers
+"""
+import asyncio
+from datetime import timedelta
+import logging
+import threading
+
+from . import actions
+from .config_watcher import config_watcher
+from .external import SessionLocal, pool_probe
+from .settings import (
+    CONFIG_RELOAD_INTERVAL_SECONDS,
+    DB_POOL_PROBE_INTERVAL_SECONDS,
+    LOGIN_HISTORY_RETENTION_DAYS,
+    TOKEN_REAP_INTERVAL_MINUTES,
+    TOKEN_RETENTION_HOURS,
+)
+
+logger = logging.getLogger(__name__)
+
+
+def cleanup_tokens() -> int:
+    db_session = SessionLocal()
+    try:
+        return actions.cleanup_tokens(
+            db_session, retention=timedelta(hours=TOKEN_RETENTION_HOURS)
+        )
+    finally:
+        db_session.close()
+
+
+def cleanup_login_history() -> int:
+    db_session = SessionLocal()
+    try:
+        return actions.cleanup_login_history(
+            db_session, retention=timedelta(days=LOGIN_HISTORY_RETENTION_DAYS)
+        )
+    finally:
+        db_session.close()
+
+
+async def token_reaper(interval_minutes: int = TOKEN_REAP_INTERVAL_MINUTES) -> None:
+    """
+    Periodically deletes expired and revoked tokens and old login history. Database work
+    runs in executor, so it does not block the event loop.
+    """
+    loop = asyncio.get_event_loop()
+    while True:
+        await asyncio.sleep(interval_minutes * 60)
+        try:
+            deleted = await loop.run_in_executor(None, cleanup_tokens)
+            logger.info(f"Token reaper deleted {deleted} expired and revoked tokens")
+        except Exception as err:
+            logger.error(f"Token reaper failed: {str(err)}", extra={"error": err})
+        try:
+            deleted = await loop.run_in_executor(None, cleanup_login_history)
+            logger.info(f"Token reaper deleted {deleted} old login history entries")
+        except Exception as err:
+            logger.error(
+                f"Login history cleanup failed: {str(err)}", extra={"error": err}
+            )
+
+
+async def config_reloader(
+    interval_seconds: int = CONFIG_RELOAD_INTERVAL_SECONDS,
+) -> None:
+    """
+    Periodically reloads settings which could be changed without restart.
+    """
+    loop = asyncio.get_event_loop()
+    while True:
+        try:
+            await loop.run_in_executor(None, config_watcher.reload)
+        except Exception as err:
+            logger.error(f"Config reload failed: {str(err)}", extra={"error": err})
+        await asyncio.sleep(interval_seconds)
+
+
+def config_listener() -> None:
+    """
+    Reloads settings on notifications about their change, runs in dedicated daemon
+    thread until config_watcher.stop is called on shutdown.
+    """
+    try:
+        config_watcher.listen()
+    except Exception as err:
+        logger.warning(
+            f"Listening for config changes failed, falling back to polling: {str(err)}",
+            extra={"error": err},
+        )
+
+
+def start_config_listener() -> threading.Thread:
+    thread = threading.Thread(
+        target=config_listener, name="config-listener", daemon=True
+    )
+    thread.start()
+    return thread
+
+
+async def db_pool_prober(
+    interval_seconds: int = DB_POOL_PROBE_INTERVAL_SECONDS,
+) -> None:
+    """
+    Periodically pings idle database connections, probe failures are recorded by probe
+    itself.
+    """
+    loop = asyncio.get_event_loop()
+    while True:
+        await asyncio.sleep(interval_seconds)
+        await loop.run_in_executor(None, pool_probe.probe)
@@ -0,0 +1,161 @@
+from datetime import datetime, timedelta, timezone
+import unittest
+import uuid
+from unittest import mock
+
+from psycopg2 import errorcodes
+from sqlalchemy.exc import IntegrityError
+
+from . import actions, exceptions
+
+
+def email_domains(allowed, blocked):
+    return mock.patch.multiple(
+        actions, ALLOWED_EMAIL_DOMAINS=allowed, BLOCKED_EMAIL_DOMAINS=blocked
+    )
+
+
+class TestVerifyEmailDomain(unittest.TestCase):
+    def test_both_lists_empty(self):
+        with email_domains([], []):
+            actions.verify_email_domain("user@example.com")
+
+    def test_allowed(self):
+        with email_domains(["example.com"], []):
+            actions.verify_email_domain("user@Example.com")
+
+    def test_not_in_allowlist(self):
+        with email_domains(["example.com"], []):
+            with self.assertRaises(actions.EmailDomainNotAllowed):
+                actions.verify_email_domain("user@other.com")
+
+    def test_blocked(self):
+        with email_domains([], ["mailinator.com"]):
+            with self.assertRaises(actions.EmailDomainBlocked):
+                actions.verify_email_domain("user@mailinator.com")
+
+    def test_blocklist_is_checked_before_allowlist(self):
+        with email_domains(["example.com"], ["example.com"]):
+            with self.assertRaises(actions.EmailDomainBlocked):
+                actions.verify_email_domain("user@example.com")
+
+    def test_subdomains(self):
+        with email_domains([".example.com"], []):
+            actions.verify_email_domain("user@eu.example.com")
+            with self.assertRaises(actions.EmailDomainNotAllowed):
+                actions.verify_email_domain("user@example.com")
+
+
+class TestNormalizeEmail(unittest.TestCase):
+    def test_lowercased(self):
+        self.assertEqual(
+            actions.normalize_email("User@Example.COM"), "user@example.com"
+        )
+
+    def test_gmail_subaddress_and_dots_are_removed(self):
+        self.assertEqual(
+            actions.normalize_email("First.Last+brood@gmail.com"),
+            "firstlast@gmail.com",
+        )
+
+    def test_outlook_keeps_dots(self):
+        self.assertEqual(
+            actions.normalize_email("first.last+brood@outlook.com"),
+            "first.last@outlook.com",
+        )
+
+    def test_other_domains_keep_subaddress_and_dots(self):
+        self.assertEqual(
+            actions.normalize_email("first.last+brood@example.com"),
+            "first.last+brood@example.com",
+        )
+
+
+def transfer_session(transfer, application=None):
+    """
+    Session mock which finds the transfer and the application by any filter.
+    """
+    db_session = mock.MagicMock()
+
+    def query(model):
+        found = transfer if model is actions.ApplicationTransferRequest else application
+        query_mock = mock.MagicMock()
+        query_mock.filter.return_value.one_or_none.return_value = found
+        query_mock.filter.return_value.first.return_value = found
+        return query_mock
+
+    db_session.query.side_effect = query
+    return db_session
+
+
+class TestApplicationTransfers(unittest.TestCase):
+    def setUp(self):
+        patcher = mock.patch.object(actions, "create_audit_event")
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.application_id = uuid.uuid4()
+        self.transfer = mock.Mock(
+            application_id=self.application_id,
+            token=uuid.uuid4(),
+            new_owner_id=uuid.uuid4(),
+            expires_at=datetime.now(timezone.utc) + timedelta(hours=1),
+            accepted_at=None,
+        )
+        self.application = mock.Mock(id=self.application_id, group_id=uuid.uuid4())
+
+    def test_acceptance_moves_application(self):
+        db_session = transfer_session(self.transfer, self.application)
+        application = actions.accept_application_transfer(
+            db_session, self.application_id, self.transfer.token
+        )
+        self.assertEqual(application.group_id, self.transfer.new_owner_id)
+        self.assertIsNotNone(self.transfer.accepted_at)
+        db_session.commit.assert_called_once()
+
+    def test_expired_token(self):
+        self.transfer.expires_at = datetime.now(timezone.utc) - timedelta(seconds=1)
+        previous_group_id = self.application.group_id
+        db_session = transfer_session(self.transfer, self.application)
+        with self.assertRaises(exceptions.ApplicationTransferExpired):
+            actions.accept_application_transfer(
+                db_session, self.application_id, self.transfer.token
+            )
+        self.assertEqual(self.application.group_id, previous_group_id)
+        db_session.commit.assert_not_called()
+
+    def test_unknown_token(self):
+        db_session = transfer_session(None, self.application)
+        with self.assertRaises(exceptions.ApplicationTransferNotFound):
+            actions.accept_application_transfer(
+                db_session, self.application_id, uuid.uuid4()
+            )
+
+    def test_cancellation(self):
+        db_session = transfer_session(self.transfer)
+        actions.cancel_application_transfer(db_session, self.application_id)
+        db_session.delete.assert_called_once_with(self.transfer)
+        db_session.commit.assert_called_once()
+
+    def test_cancellation_without_pending_transfer(self):
+        db_session = transfer_session(None)
+        with self.assertRaises(exceptions.ApplicationTransferNotFound):
+            actions.cancel_application_transfer(db_session, self.application_id)
+
+    def test_concurrent_transfer_is_rejected(self):
+        db_session = transfer_session(None)
+        db_session.commit.side_effect = IntegrityError(
+            "INSERT", {}, mock.Mock(pgcode=errorcodes.UNIQUE_VIOLATION)
+        )
+        with mock.patch.object(actions, "get_group", return_value=mock.Mock()):
+            with self.assertRaises(exceptions.ApplicationTransferExists):
+                actions.create_application_transfer(
+                    db_session,
+                    application_id=self.application_id,
+                    requester_user_id=uuid.uuid4(),
+                    new_group_id=uuid.uuid4(),
+                )
+        db_session.rollback.assert_called_once()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,126 @@
+import random
+import string
+import unittest
+import uuid
+from typing import List
+from unittest import mock
+
+from fastapi import Depends, FastAPI
+
+from . import actions, middleware
+from .middleware import (
+    IdempotencyMiddleware,
+    RateLimitMiddleware,
+    oauth2_scheme,
+    reject_impersonated_changes,
+)
+
+SEED_CORPUS = [
+    "",
+    "Bearer valid",
+    "Bearer ",
+    "Bearer",
+    " Bearer",
+    "bearer  ",
+    "Basic dXNlcjpwYXNz",
+    f"Bearer {'a' * 10 * 1024}",
+    "a" * 10 * 1024,
+    f"Bearer {uuid.uuid4()}",
+    f"Bearer {uuid.uuid4()} extra",
+    f"BEARER {uuid.uuid4()}",
+]
+
+
+def random_corpus(size: int, seed: int = 359) -> List[str]:
+    generator = random.Random(seed)
+    corpus: List[str] = []
+    for _ in range(size):
+        length = generator.randint(0, 128)
+        value = "".join(generator.choice(string.printable) for _ in range(length))
+        # Header values could not contain line breaks
+        value = value.replace("\r", " ").replace("\n", " ")
+        if generator.random() < 0.5:
+            value = f"Bearer {value}"
+        corpus.append(value)
+    return corpus
+
+
+def authorized_app() -> FastAPI:
+    """
+    Application with every Brood parser of Authorization header in front of a route
+    which only requires bearer token.
+    """
+    app = FastAPI(dependencies=[Depends(reject_impersonated_changes)])
+
+    @app.post("/user/fuzz")
+    async def fuzz_handler(token: str = Depends(oauth2_scheme)):
+        return {"status": "ok"}
+
+    app.add_middleware(IdempotencyMiddleware)
+    app.add_middleware(RateLimitMiddleware, get_limit=lambda: 10**6)
+    return app
+
+
+async def request_status(app: FastAPI, authorization: str) -> int:
+    scope = {
+        "type": "http",
+        "http_version": "1.1",
+        "method": "POST",
+        "scheme": "http",
+        "path": "/user/fuzz",
+        "raw_path": b"/user/fuzz",
+        "root_path": "",
+        "query_string": b"",
+        "headers": [
+            (b"host", b"testserver"),
+            (b"authorization", authorization.encode("latin-1")),
+            (b"idempotency-key", str(uuid.uuid4()).encode()),
+        ],
+        "client": ("127.0.0.1", 50000),
+        "server": ("testserver", 80),
+    }
+    messages = [{"type": "http.request", "body": b"", "more_body": False}]
+    statuses = []
+
+    async def receive():
+        if messages:
+            return messages.pop(0)
+        return {"type": "http.disconnect"}
+
+    async def send(message):
+        if message["type"] == "http.response.start":
+            statuses.append(message["status"])
+
+    await app(scope, receive, send)
+    return statuses[0]
+
+
+class TestAuthorizationHeaderParsing(unittest.IsolatedAsyncioTestCase):
+    def setUp(self):
+        # Database is not reached, token lookups and idempotency records are mocked
+        for patcher in [
+            mock.patch.object(middleware, "SessionLocal"),
+            mock.patch.object(middleware, "is_impersonation_token", return_value=False),
+            mock.patch.object(actions, "reserve_idempotency_key"),
+            mock.patch.object(actions, "complete_idempotency_key"),
+            mock.patch.object(actions, "release_idempotency_key"),
+        ]:
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        self.app = authorized_app()
+
+    async def test_seed_corpus(self):
+        for authorization in SEED_CORPUS:
+            with self.subTest(authorization=authorization[:32]):
+                status = await request_status(self.app, authorization)
+                self.assertIn(status, {200, 400, 401})
+
+    async def test_random_corpus(self):
+        for authorization in random_corpus(200):
+            with self.subTest(authorization=authorization[:32]):
+                status = await request_status(self.app, authorization)
+                self.assertIn(status, {200, 400, 401})
+
+
+if __name__ == "__main__":
+    unittest.main()
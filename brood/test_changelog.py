@@ -0,0 +1,41 @@
+import unittest
+
+from .changelog import parse_changelog
+
+CHANGELOG = """# Changelog
+
+## [Unreleased]
+
+### Added
+
+- Passkey login
+  with WebAuthn
+
+## [0.1.0] - 2021-11-01
+
+### Changed
+
+* Emails are normalized
+"""
+
+
+class TestParseChangelog(unittest.TestCase):
+    def test_entries(self):
+        entries = parse_changelog(CHANGELOG)
+        self.assertEqual([entry.version for entry in entries], ["Unreleased", "0.1.0"])
+        self.assertIsNone(entries[0].date)
+        self.assertEqual(entries[0].changes, ["Passkey login with WebAuthn"])
+        self.assertEqual(entries[1].date, "2021-11-01")
+        self.assertEqual(entries[1].changes, ["Emails are normalized"])
+
+    def test_invalid_version_heading(self):
+        with self.assertRaises(ValueError):
+            parse_changelog("## 0.1.0\n")
+
+    def test_change_outside_of_version(self):
+        with self.assertRaises(ValueError):
+            parse_changelog("- Orphan change\n")
+
+
+if __name__ == "__main__":
+    unittest.main()
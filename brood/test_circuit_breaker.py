@@ -0,0 +1,71 @@
+import unittest
+from unittest import mock
+
+from .circuit_breaker import CircuitBreaker, CircuitOpen, CircuitState
+
+
+class TestCircuitBreaker(unittest.TestCase):
+    def setUp(self):
+        self.now = 1000.0
+        patcher = mock.patch("time.monotonic", side_effect=lambda: self.now)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.breaker = CircuitBreaker(threshold=2, open_duration=30)
+
+    def open_circuit(self):
+        self.breaker.record_failure()
+        self.breaker.record_failure()
+
+    def test_closed_circuit_allows_calls(self):
+        self.assertFalse(self.breaker.allow())
+        self.breaker.record_failure()
+        self.assertFalse(self.breaker.allow())
+
+    def test_opens_at_threshold(self):
+        self.open_circuit()
+        self.assertEqual(self.breaker.state, CircuitState.open)
+        with self.assertRaises(CircuitOpen):
+            self.breaker.allow()
+
+    def test_half_open_lets_one_probe_through(self):
+        self.open_circuit()
+        self.now += 30
+        self.assertTrue(self.breaker.allow())
+        self.assertEqual(self.breaker.state, CircuitState.half_open)
+        with self.assertRaises(CircuitOpen):
+            self.breaker.allow()
+
+    def test_successful_probe_closes_circuit(self):
+        self.open_circuit()
+        self.now += 30
+        self.breaker.allow()
+        self.breaker.record_success()
+        self.assertEqual(self.breaker.state, CircuitState.closed)
+        self.assertFalse(self.breaker.allow())
+
+    def test_failed_probe_opens_circuit(self):
+        self.open_circuit()
+        self.now += 30
+        self.breaker.allow()
+        self.breaker.record_failure()
+        self.assertEqual(self.breaker.state, CircuitState.open)
+        with self.assertRaises(CircuitOpen):
+            self.breaker.allow()
+
+    def test_released_probe_lets_next_call_through(self):
+        self.open_circuit()
+        self.now += 30
+        self.breaker.allow()
+        self.breaker.release_probe()
+        self.assertTrue(self.breaker.allow())
+
+    def test_lost_probe_expires(self):
+        self.open_circuit()
+        self.now += 30
+        self.breaker.allow()
+        self.now += 30
+        self.assertTrue(self.breaker.allow())
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,118 @@
+import asyncio
+import unittest
+
+from fastapi import FastAPI
+
+from .draining import drain_state
+from .middleware import (
+    ConcurrencyLimitMiddleware,
+    InFlightMiddleware,
+    is_unmatched_route,
+    redact_body,
+)
+
+
+class TestRedactBody(unittest.TestCase):
+    def test_json_values_are_redacted(self):
+        body = b'{"username": "user", "password": "secret\\"pass", "access_token": 1}'
+        self.assertEqual(
+            redact_body(body, 1024),
+            '{"username": "user", "password": "***", "access_token": "***"}',
+        )
+
+    def test_form_values_are_redacted(self):
+        body = b"username=user&password=secret&client_secret=abc"
+        self.assertEqual(
+            redact_body(body, 1024), "username=user&password=***&client_secret=***"
+        )
+
+    def test_redacted_before_truncation(self):
+        body = b'{"password": "secret"}'
+        self.assertEqual(redact_body(body, 16), '{"password": "**...(truncated)')
+
+
+class TestEventStreamsAreNotCounted(unittest.IsolatedAsyncioTestCase):
+    async def count_while_streaming(self, middleware_class, count, content_type):
+        """
+        Returns count of requests in flight while response is streamed and after it.
+        """
+        started = asyncio.Event()
+        finish = asyncio.Event()
+
+        async def app(scope, receive, send):
+            await send(
+                {
+                    "type": "http.response.start",
+                    "status": 200,
+                    "headers": [(b"content-type", content_type)],
+                }
+            )
+            started.set()
+            await finish.wait()
+            await send({"type": "http.response.body", "body": b""})
+
+        async def send(message):
+            pass
+
+        middleware = middleware_class(app)
+        request = asyncio.ensure_future(middleware({"type": "http"}, None, send))
+        await started.wait()
+        streaming_count = count(middleware)
+        finish.set()
+        await request
+        return streaming_count, count(middleware)
+
+    async def test_concurrency_limit(self):
+        def middleware_class(app):
+            return ConcurrencyLimitMiddleware(app, limit=1)
+
+        def count(middleware):
+            return middleware.in_flight
+
+        self.assertEqual(
+            await self.count_while_streaming(
+                middleware_class, count, b"application/json"
+            ),
+            (1, 0),
+        )
+        self.assertEqual(
+            await self.count_while_streaming(
+                middleware_class, count, b"text/event-stream"
+            ),
+            (0, 0),
+        )
+
+    async def test_in_flight(self):
+        def count(middleware):
+            return drain_state.in_flight
+
+        self.assertEqual(
+            await self.count_while_streaming(
+                InFlightMiddleware, count, b"application/json"
+            ),
+            (1, 0),
+        )
+        self.assertEqual(
+            await self.count_while_streaming(
+                InFlightMiddleware, count, b"text/event-stream; charset=utf-8"
+            ),
+            (0, 0),
+        )
+
+
+class TestIsUnmatchedRoute(unittest.TestCase):
+    def test_no_endpoint(self):
+        self.assertTrue(is_unmatched_route({"type": "http"}))
+
+    def test_mounted_application_endpoint(self):
+        self.assertTrue(is_unmatched_route({"type": "http", "endpoint": FastAPI()}))
+
+    def test_route_endpoint(self):
+        async def endpoint():
+            pass
+
+        self.assertFalse(is_unmatched_route({"type": "http", "endpoint": endpoint}))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,31 @@
+import unittest
+
+from .naming import camel_case, rename_keys, snake_case
+
+
+class TestNaming(unittest.TestCase):
+    def test_camel_case(self):
+        self.assertEqual(camel_case("created_at"), "createdAt")
+        self.assertEqual(camel_case("id"), "id")
+
+    def test_snake_case(self):
+        self.assertEqual(snake_case("createdAt"), "created_at")
+        self.assertEqual(snake_case("id"), "id")
+
+    def test_rename_keys_recursively(self):
+        value = {"user_id": "1", "tokens": [{"token_type": "bugout"}]}
+        self.assertEqual(
+            rename_keys(value, camel_case),
+            {"userId": "1", "tokens": [{"tokenType": "bugout"}]},
+        )
+
+    def test_rename_keys_skips_free_form_values(self):
+        value = {"resource_data": {"some_key": 1}, "profile": {"display_name": "a"}}
+        self.assertEqual(
+            rename_keys(value, camel_case),
+            {"resourceData": {"some_key": 1}, "profile": {"display_name": "a"}},
+        )
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,44 @@
+import unittest
+from unittest import mock
+
+from .ratelimit import TokenBucketLimiter
+
+
+class TestTokenBucketLimiter(unittest.TestCase):
+    def setUp(self):
+        self.now = 1000.0
+        patcher = mock.patch("time.monotonic", side_effect=lambda: self.now)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_bucket_is_exhausted_and_refilled(self):
+        limiter = TokenBucketLimiter(capacity=2, refill_rate=1)
+        self.assertTrue(limiter.allow("a"))
+        self.assertTrue(limiter.allow("a"))
+        self.assertFalse(limiter.allow("a"))
+        self.now += 1
+        self.assertTrue(limiter.allow("a"))
+
+    def test_buckets_are_per_key(self):
+        limiter = TokenBucketLimiter(capacity=1, refill_rate=1)
+        self.assertTrue(limiter.allow("a"))
+        self.assertFalse(limiter.allow("a"))
+        self.assertTrue(limiter.allow("b"))
+
+    def test_full_buckets_are_dropped(self):
+        limiter = TokenBucketLimiter(capacity=1, refill_rate=1, max_buckets=2)
+        limiter.allow("a")
+        self.now += 1
+        limiter.allow("b")
+        self.assertEqual(set(limiter._buckets), {"b"})
+
+    def test_least_recently_used_buckets_are_dropped(self):
+        limiter = TokenBucketLimiter(capacity=10, refill_rate=1, max_buckets=4)
+        for key in ["a", "b", "c", "d"]:
+            limiter.allow(key)
+            self.now += 1
+        self.assertEqual(set(limiter._buckets), {"c", "d"})
+
+
+if __name__ == "__main__":
+    unittest.main()
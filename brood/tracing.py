@@ -0,0 +1,67 @@
+"""
+Optional OpenTelemetry tracing, enabled when BROOD_OTEL_ENDPOINT is set.
+
+OpenTelemetry packages are imported only when tracing is enabled, so deployments without it
+do not need them installed.
+"""
+import logging
+from typing import Optional
+
+from fastapi import FastAPI
+from sqlalchemy.engine import Engine
+
+from .settings import OTEL_ENDPOINT, OTEL_SERVICE_NAME
+
+logger = logging.getLogger(__name__)
+
+tracing_enabled = False
+
+
+def setup_tracing(app: FastAPI, engine: Engine) -> None:
+    """
+    Initializes tracer provider with OTLP exporter and instruments request handlers and
+    database calls.
+    """
+    global tracing_enabled
+    if OTEL_ENDPOINT is None:
+        return
+
+    from opentelemetry import trace  # type: ignore
+    from opentelemetry.exporter.otlp.proto.http.trace_exporter import (  # type: ignore
+        OTLPSpanExporter,
+    )
+    from opentelemetry.instrumentation.fastapi import (  # type: ignore
+        FastAPIInstrumentor,
+    )
+    from opentelemetry.instrumentation.sqlalchemy import (  # type: ignore
+        SQLAlchemyInstrumentor,
+    )
+    from opentelemetry.sdk.resources import Resource  # type: ignore
+    from opentelemetry.sdk.trace import TracerProvider  # type: ignore
+    from opentelemetry.sdk.trace.export import BatchSpanProcessor  # type: ignore
+
+    provider = TracerProvider(
+        resource=Resource.create({"service.name": OTEL_SERVICE_NAME})
+    )
+    provider.add_span_processor(
+        BatchSpanProcessor(OTLPSpanExporter(endpoint=OTEL_ENDPOINT))
+    )
+    trace.set_tracer_provider(provider)
+
+    FastAPIInstrumentor.instrument_app(app)
+    SQLAlchemyInstrumentor().instrument(engine=engine)
+
+    tracing_enabled = True
+    logger.info(f"OpenTelemetry tracing enabled, exporting spans to {OTEL_ENDPOINT}")
+
+
+def set_request_id_attribute(request_id: Optional[str]) -> None:
+    """
+    Adds request ID to the current span, does nothing if tracing is disabled.
+    """
+    if not tracing_enabled or request_id is None:
+        return
+
+    from opentelemetry import trace  # type: ignore
+
+    trace.get_current_span().set_attribute("brood.request_id", request_id)
@@ -1,5 +1,11 @@
 """
 Brood library and API version.
 """
+import os
+import platform
 
 BROOD_VERSION = "0.2.3"
+
+# Commit the deployment was built from, set by deploy script and Docker build
+BROOD_COMMIT_HASH = os.environ.get("BROOD_COMMIT_HASH") or "unknown"
+PYTHON_VERSION = platform.python_version()
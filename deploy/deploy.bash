@@ -38,6 +38,7 @@ echo
 echo "Retrieving deployment parameters"
 mkdir -p "${SECRETS_DIR}"
 AWS_DEFAULT_REGION="${AWS_DEFAULT_REGION}" "${PYTHON}" "${PARAMETERS_SCRIPT}" "${AWS_SSM_PARAMETER_PATH}" -o "${PARAMETERS_ENV_PATH}"
+echo "BROOD_COMMIT_HASH=$(git -C "${APP_DIR}" rev-parse --short HEAD)" >> "${PARAMETERS_ENV_PATH}"
 
 echo
 echo
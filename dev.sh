@@ -11,6 +11,29 @@ BROOD_APP_DIR="${BROOD_APP_DIR:-$PWD}"
 BROOD_ASGI_APP="${BROOD_ASGI_APP:-brood.api:app}"
 BROOD_UVICORN_WORKERS="${BROOD_UVICORN_WORKERS:-2}"
 
+# Combined host:port address takes precedence over BROOD_HOST and BROOD_PORT
+if [ -n "$BROOD_LISTEN_ADDR" ]; then
+  BROOD_HOST="${BROOD_LISTEN_ADDR%:*}"
+  BROOD_PORT="${BROOD_LISTEN_ADDR##*:}"
+  # Strip brackets from IPv6 address, e.g. [::1]:7474
+  BROOD_HOST="${BROOD_HOST#[}"
+  BROOD_HOST="${BROOD_HOST%]}"
+fi
+
+if ! [ "$BROOD_PORT" -ge 1 ] 2>/dev/null || [ "$BROOD_PORT" -gt 65535 ]; then
+  echo "Invalid port: $BROOD_PORT, expected number from 1 to 65535" >&2
+  exit 1
+fi
+
+# Listen on both IPv4 and IPv6 wildcard addresses, host settings are ignored
+if [ "$BROOD_LISTEN_DUAL_STACK" = "true" ]; then
+  exec python -m brood.server \
+    --port "$BROOD_PORT" \
+    --app-dir "$BROOD_APP_DIR" \
+    --workers "$BROOD_UVICORN_WORKERS" \
+    "$BROOD_ASGI_APP"
+fi
+
 uvicorn --reload \
   --port "$BROOD_PORT" \
   --host "$BROOD_HOST" \
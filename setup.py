@@ -10,6 +10,7 @@ setup(
     name="bugout-brood",
     version=BROOD_VERSION,
     packages=find_packages(),
+    package_data={"brood": ["CHANGELOG.md"]},
     install_requires=[
         "argon2_cffi",
         "boto3>=1.20.2",
@@ -22,10 +23,20 @@ setup(
         "sqlalchemy>=1.4.26",
         "stripe>=2.61.0",
         "uvicorn>=0.15.0",
+        "webauthn>=1.6.0,<2.0.0",
     ],
     extras_require={
         "dev": ["alembic>=1.7.4", "black", "isort", "mypy"],
         "distribute": ["setuptools", "twine", "wheel"],
+        "aws": ["boto3"],
+        "msgpack": ["msgpack"],
+        "redis": ["redis"],
+        "tracing": [
+            "opentelemetry-sdk",
+            "opentelemetry-exporter-otlp-proto-http",
+            "opentelemetry-instrumentation-fastapi",
+            "opentelemetry-instrumentation-sqlalchemy",
+        ],
     },
     description="Brood: Bugout authentication",
     long_description=long_description,